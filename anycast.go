@@ -0,0 +1,117 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"sort"
+	"sync"
+)
+
+// AnycastInstance - a distinct server instance seen behind an address,
+// identified by the NSID in its responses
+type AnycastInstance struct {
+	Identity string   `json:"identity"`
+	Serials  []uint32 `json:"serials"`
+	Probes   int      `json:"probes"`
+}
+
+// AnycastResult - the instances seen by the probes sent to an address
+type AnycastResult struct {
+	Probes    int               `json:"probes"`
+	Errors    int               `json:"errors"`
+	Instances []AnycastInstance `json:"instances"`
+}
+
+// unknownInstance is the identity of instances that don't return NSID
+const unknownInstance = "unknown"
+
+// probeAnycast sends opts.anycast SOA queries with NSID to the server
+// address ip, and groups the answers by the identity of the instance that
+// sent them. Each query uses a new socket, and so a different source
+// port, and every other one is sent over TCP, to be routed to as many of
+// the instances behind an anycast address as possible.
+func (rn *Runner) probeAnycast(ctx context.Context, zone string, ip net.IP, opts Options) *AnycastResult {
+
+	var wg sync.WaitGroup
+	var mu sync.Mutex
+
+	res := &AnycastResult{Probes: opts.anycast}
+	byIdentity := make(map[string]*AnycastInstance)
+
+	for i := 0; i < opts.anycast; i++ {
+		popts := opts
+		popts.Qopts.nsid = true
+		popts.Qopts.retries = 1
+		if i%2 == 1 {
+			popts.Qopts.tcp = true
+		}
+
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			result, err := getSerial(ctx, zone, ip, popts)
+
+			mu.Lock()
+			defer mu.Unlock()
+			if err != nil {
+				res.Errors++
+				return
+			}
+			identity := result.nsid
+			if identity == "" {
+				identity = unknownInstance
+			}
+			inst, ok := byIdentity[identity]
+			if !ok {
+				inst = &AnycastInstance{Identity: identity}
+				byIdentity[identity] = inst
+			}
+			inst.Probes++
+			for _, s := range inst.Serials {
+				if s == result.serial {
+					return
+				}
+			}
+			inst.Serials = append(inst.Serials, result.serial)
+		}()
+	}
+	wg.Wait()
+
+	for _, inst := range byIdentity {
+		sort.Slice(inst.Serials, func(i, j int) bool {
+			return serialDelta(inst.Serials[i], inst.Serials[j]) > 0
+		})
+		res.Instances = append(res.Instances, *inst)
+	}
+	sort.Slice(res.Instances, func(i, j int) bool {
+		return res.Instances[i].Identity < res.Instances[j].Identity
+	})
+	return res
+}
+
+// serials returns all the serials seen at any instance
+func (a *AnycastResult) serials() []uint32 {
+	var serials []uint32
+	for _, inst := range a.Instances {
+		serials = append(serials, inst.Serials...)
+	}
+	return serials
+}
+
+func printAnycast(a *AnycastResult, opts *Options) {
+
+	if opts.json || a == nil {
+		return
+	}
+
+	for _, inst := range a.Instances {
+		for _, serial := range inst.Serials {
+			fmt.Printf("%15d   instance %s (%d of %d probes)\n",
+				serial, inst.Identity, inst.Probes, a.Probes)
+		}
+	}
+	if a.Errors > 0 {
+		fmt.Printf("%15s   %d of %d probes failed\n", "", a.Errors, a.Probes)
+	}
+}
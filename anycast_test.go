@@ -0,0 +1,139 @@
+package main
+
+import (
+	"context"
+	"encoding/hex"
+	"net"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+// anycastHandler answers SOA queries as if from several instances behind
+// one address, taking turns: the i-th query is answered by instance
+// i % len(serials), with NSID "node-<i>" and the serial of that instance.
+func anycastHandler(serials []uint32) dns.Handler {
+	var queries atomic.Int32
+	return dns.HandlerFunc(func(w dns.ResponseWriter, r *dns.Msg) {
+		n := int(queries.Add(1)-1) % len(serials)
+		m := new(dns.Msg)
+		m.SetReply(r)
+		m.Authoritative = true
+		m.Answer = []dns.RR{
+			&dns.SOA{
+				Hdr: dns.RR_Header{
+					Name:   r.Question[0].Name,
+					Rrtype: dns.TypeSOA,
+					Class:  dns.ClassINET,
+					Ttl:    3600,
+				},
+				Ns:     "ns1.example.com.",
+				Mbox:   "admin.example.com.",
+				Serial: serials[n],
+			},
+		}
+		if opt := r.IsEdns0(); opt != nil {
+			m.SetEdns0(opt.UDPSize(), false)
+			for _, o := range opt.Option {
+				if o.Option() == dns.EDNS0NSID {
+					ropt := m.IsEdns0()
+					ropt.Option = append(ropt.Option, &dns.EDNS0_NSID{
+						Code: dns.EDNS0NSID,
+						Nsid: hex.EncodeToString([]byte("node-" + string(rune('a'+n)))),
+					})
+				}
+			}
+		}
+		w.WriteMsg(m)
+	})
+}
+
+func TestProbeAnycast(t *testing.T) {
+	_, port := newMockDNSServerSamePort(t, anycastHandler([]uint32{100, 99}))
+
+	opts := Options{
+		anycast: 6,
+		Qopts: QueryOptions{
+			timeout: 2 * time.Second,
+			retries: 1,
+			bufsize: defaultBufsize,
+			port:    port,
+		},
+	}
+	res := NewRunner().probeAnycast(context.Background(), "example.com.",
+		net.ParseIP("127.0.0.1"), opts)
+
+	if res.Probes != 6 || res.Errors != 0 {
+		t.Errorf("probes %d errors %d, want 6 and 0", res.Probes, res.Errors)
+	}
+	if len(res.Instances) != 2 {
+		t.Fatalf("got %d instances, want 2: %+v", len(res.Instances), res.Instances)
+	}
+	want := []AnycastInstance{
+		{Identity: "node-a", Serials: []uint32{100}, Probes: 3},
+		{Identity: "node-b", Serials: []uint32{99}, Probes: 3},
+	}
+	for i, inst := range res.Instances {
+		if inst.Identity != want[i].Identity || inst.Probes != want[i].Probes ||
+			len(inst.Serials) != 1 || inst.Serials[0] != want[i].Serials[0] {
+			t.Errorf("instance %d = %+v, want %+v", i, inst, want[i])
+		}
+	}
+}
+
+func TestRunAnycast(t *testing.T) {
+	t.Run("lagging instance returns 1", func(t *testing.T) {
+		_, port := newMockDNSServerSamePort(t, anycastHandler([]uint32{100, 99}))
+
+		rn := NewRunner()
+		opts := Options{
+			noqueryns:  true,
+			additional: "127.0.0.1",
+			anycast:    4,
+			json:       true,
+			Qopts: QueryOptions{
+				timeout: 2 * time.Second,
+				retries: 1,
+				bufsize: defaultBufsize,
+				port:    port,
+			},
+		}
+		status, message := rn.run(context.Background(), "example.com.", opts)
+		if status != 1 {
+			t.Errorf("run() status = %d, want 1; message = %q", status, message)
+		}
+		if len(rn.output.Responses) != 1 || rn.output.Responses[0].Anycast == nil {
+			t.Fatalf("run() responses = %+v, want 1 with anycast result", rn.output.Responses)
+		}
+		if n := len(rn.output.Responses[0].Anycast.Instances); n != 2 {
+			t.Errorf("got %d instances, want 2", n)
+		}
+	})
+
+	t.Run("unanimous instances return 0", func(t *testing.T) {
+		_, port := newMockDNSServerSamePort(t, anycastHandler([]uint32{100, 100, 100}))
+
+		rn := NewRunner()
+		opts := Options{
+			noqueryns:  true,
+			additional: "127.0.0.1",
+			anycast:    6,
+			json:       true,
+			Qopts: QueryOptions{
+				timeout: 2 * time.Second,
+				retries: 1,
+				bufsize: defaultBufsize,
+				port:    port,
+			},
+		}
+		status, message := rn.run(context.Background(), "example.com.", opts)
+		if status != 0 {
+			t.Errorf("run() status = %d, want 0; message = %q", status, message)
+		}
+		if n := len(rn.output.Responses[0].Anycast.Instances); n != 3 {
+			t.Errorf("got %d instances, want 3", n)
+		}
+	})
+}
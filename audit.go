@@ -0,0 +1,160 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"strings"
+
+	"github.com/miekg/dns"
+)
+
+// auditRecursionNames are names outside the zones of most servers, used
+// to check whether they answer recursive queries, in order of preference
+var auditRecursionNames = []string{"www.iana.org.", "www.rfc-editor.org."}
+
+// Audit findings
+const (
+	findingOpenResolver = "open_resolver"
+	findingAXFR         = "axfr_allowed"
+	findingVersion      = "version_disclosed"
+)
+
+// AuditReport - the outcome of the security audit of a server address:
+// whether it answers recursive queries for names outside the zone,
+// allows zone transfers of the zone, and discloses its software version
+type AuditReport struct {
+	Recursion          string   `json:"recursion"`
+	RecursionAvailable bool     `json:"recursion_available,omitempty"`
+	AXFR               string   `json:"axfr"`
+	Version            string   `json:"version,omitempty"`
+	Findings           []string `json:"findings,omitempty"`
+}
+
+// auditRecursionName returns a name to check recursion with, which is
+// neither in zone nor above it.
+func auditRecursionName(zone string) string {
+	for _, name := range auditRecursionNames {
+		if !dns.IsSubDomain(zone, name) && !dns.IsSubDomain(name, zone) {
+			return name
+		}
+	}
+	return auditRecursionNames[0]
+}
+
+// auditQuery sends query once to the server address ip.
+func (rn *Runner) auditQuery(ctx context.Context, query *dns.Msg, ip net.IP, qopts QueryOptions) (*dns.Msg, error) {
+
+	var response *dns.Msg
+	var err error
+	if qopts.tcp || qopts.tls {
+		response, err = sendQueryTCP(ctx, query, []net.IP{ip}, qopts, new(QueryInfo))
+	} else {
+		response, err = sendQueryUDP(ctx, query, []net.IP{ip}, qopts, new(QueryInfo))
+	}
+	return response, classifyError(err)
+}
+
+// checkRecursion sends a recursive query for a name outside zone to the
+// server address ip, and returns "open" if it answers it, "refused" if
+// it refuses it, "closed" if it answers in any other way, or the class
+// of the error if the query fails, and whether the response has the RA
+// flag set.
+func (rn *Runner) checkRecursion(ctx context.Context, zone string, ip net.IP, qopts QueryOptions) (string, bool) {
+
+	qopts.rdflag = true
+	response, err := rn.auditQuery(ctx, MakeQuery(auditRecursionName(zone), dns.TypeA, qopts), ip, qopts)
+	switch {
+	case err != nil:
+		return errorCode(err), false
+	case response.Rcode == dns.RcodeRefused:
+		return "refused", response.RecursionAvailable
+	case response.Rcode == dns.RcodeSuccess && len(response.Answer) > 0 && !response.Authoritative:
+		return "open", response.RecursionAvailable
+	}
+	return "closed", response.RecursionAvailable
+}
+
+// checkAXFR asks the server address ip for a zone transfer of zone, over
+// TCP and without TSIG, and returns "allowed" if the first message of
+// the transfer starts with the zone's SOA record, the response code in
+// lower case if the transfer is denied, or the class of the error if it
+// fails. Only the first message is read.
+func (rn *Runner) checkAXFR(ctx context.Context, zone string, ip net.IP, qopts QueryOptions) string {
+
+	if !qopts.tls {
+		qopts.tcp = true
+	}
+	response, err := rn.auditQuery(ctx, MakeQuery(zone, dns.TypeAXFR, qopts), ip, qopts)
+	switch {
+	case err != nil:
+		return errorCode(err)
+	case response.Rcode != dns.RcodeSuccess:
+		return strings.ToLower(dns.RcodeToString[response.Rcode])
+	case len(response.Answer) > 0 && response.Answer[0].Header().Rrtype == dns.TypeSOA:
+		return "allowed"
+	}
+	return "denied"
+}
+
+// checkAudit runs the security audit checks on the server address ip in
+// turn: recursion, zone transfer and version disclosure. The queries are
+// sent once each, without TSIG, NSID or cookies.
+func (rn *Runner) checkAudit(ctx context.Context, zone string, ip net.IP, opts Options) *AuditReport {
+
+	qopts := opts.Qopts
+	qopts.retries = 1
+	qopts.tsig = nil
+	qopts.nsid = false
+	qopts.cookie = ""
+
+	report := new(AuditReport)
+	report.Recursion, report.RecursionAvailable = rn.checkRecursion(ctx, zone, ip, qopts)
+	if report.Recursion == "open" {
+		report.Findings = append(report.Findings, findingOpenResolver)
+	}
+	report.AXFR = rn.checkAXFR(ctx, zone, ip, qopts)
+	if report.AXFR == "allowed" {
+		report.Findings = append(report.Findings, findingAXFR)
+	}
+	vopts := opts
+	vopts.Qopts = qopts
+	for _, qname := range chaosVersionNames {
+		if report.Version = rn.queryChaosTXT(ctx, qname, ip, vopts); report.Version != "" {
+			report.Findings = append(report.Findings, findingVersion)
+			break
+		}
+	}
+	return report
+}
+
+// status returns the exit status for the report: 8 if there are
+// findings, and 0 otherwise.
+func (a *AuditReport) status() int {
+	if a == nil || a.Findings == nil {
+		return 0
+	}
+	return 8
+}
+
+// note returns a note on the audit findings for the text output, or an
+// empty string if there are none.
+func (a *AuditReport) note() string {
+	if a == nil || a.Findings == nil {
+		return ""
+	}
+	return fmt.Sprintf("[AUDIT: %s]", strings.Join(a.Findings, ","))
+}
+
+func printAudit(a *AuditReport, opts *Options) {
+
+	if opts.json || a == nil {
+		return
+	}
+	version := a.Version
+	if version == "" {
+		version = "hidden"
+	}
+	fmt.Printf("%15s   audit: recursion=%s axfr=%s version=%q\n", "",
+		a.Recursion, a.AXFR, version)
+}
@@ -0,0 +1,157 @@
+package main
+
+import (
+	"context"
+	"net"
+	"slices"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+// auditHandler answers SOA queries for example.com., and, if exposed is
+// set, recursive queries for other names, zone transfers and
+// version.bind queries, which it refuses otherwise.
+func auditHandler(exposed bool) dns.Handler {
+	return dns.HandlerFunc(func(w dns.ResponseWriter, r *dns.Msg) {
+		q := r.Question[0]
+		m := new(dns.Msg)
+		m.SetReply(r)
+
+		switch {
+		case q.Qtype == dns.TypeSOA:
+			soaMockHandler(2024010100).ServeDNS(w, r)
+			return
+		case !exposed:
+			m.Rcode = dns.RcodeRefused
+		case q.Qtype == dns.TypeAXFR:
+			m.Answer = []dns.RR{&dns.SOA{Hdr: dns.RR_Header{Name: q.Name, Rrtype: dns.TypeSOA,
+				Class: dns.ClassINET, Ttl: 3600}, Ns: "ns1.example.com.",
+				Mbox: "admin.example.com.", Serial: 2024010100}}
+		case q.Qclass == dns.ClassCHAOS && q.Name == "version.bind.":
+			m.Answer = []dns.RR{&dns.TXT{Hdr: dns.RR_Header{Name: q.Name, Rrtype: dns.TypeTXT,
+				Class: dns.ClassCHAOS}, Txt: []string{"9.18.24"}}}
+		case q.Qtype == dns.TypeA && r.RecursionDesired:
+			m.RecursionAvailable = true
+			m.Answer = []dns.RR{&dns.A{Hdr: dns.RR_Header{Name: q.Name, Rrtype: dns.TypeA,
+				Class: dns.ClassINET, Ttl: 300}, A: net.ParseIP("192.0.2.80")}}
+		default:
+			m.Rcode = dns.RcodeRefused
+		}
+		w.WriteMsg(m)
+	})
+}
+
+func TestCheckAudit(t *testing.T) {
+	tests := []struct {
+		name      string
+		exposed   bool
+		recursion string
+		axfr      string
+		version   string
+		findings  []string
+	}{
+		{"locked down", false, "refused", "refused", "", nil},
+		{"exposed", true, "open", "allowed", "9.18.24",
+			[]string{findingOpenResolver, findingAXFR, findingVersion}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, port := newMockDNSServerSamePort(t, auditHandler(tt.exposed))
+
+			rn := NewRunner()
+			opts := Options{
+				Qopts: QueryOptions{
+					timeout: time.Second,
+					retries: 3,
+					bufsize: defaultBufsize,
+					port:    port,
+				},
+			}
+			a := rn.checkAudit(context.Background(), "example.com.", net.ParseIP("127.0.0.1"), opts)
+
+			if a.Recursion != tt.recursion || a.AXFR != tt.axfr || a.Version != tt.version {
+				t.Errorf("checkAudit() = %+v, want recursion %s axfr %s version %q",
+					a, tt.recursion, tt.axfr, tt.version)
+			}
+			if !slices.Equal(a.Findings, tt.findings) {
+				t.Errorf("Findings = %v, want %v", a.Findings, tt.findings)
+			}
+			if (a.note() == "") != (tt.findings == nil) || (a.status() == 0) != (tt.findings == nil) {
+				t.Errorf("note() = %q, status() = %d with findings %v", a.note(), a.status(), a.Findings)
+			}
+		})
+	}
+}
+
+func TestAuditRecursionName(t *testing.T) {
+	tests := []struct {
+		zone     string
+		expected string
+	}{
+		{"example.com.", "www.iana.org."},
+		{"iana.org.", "www.rfc-editor.org."},
+		{"org.", "www.iana.org."},
+	}
+	for _, tt := range tests {
+		if got := auditRecursionName(tt.zone); got != tt.expected {
+			t.Errorf("auditRecursionName(%s) = %s, want %s", tt.zone, got, tt.expected)
+		}
+	}
+}
+
+// slowHandler delays the answers of handler by delay.
+func slowHandler(handler dns.Handler, delay time.Duration) dns.Handler {
+	return dns.HandlerFunc(func(w dns.ResponseWriter, r *dns.Msg) {
+		time.Sleep(delay)
+		handler.ServeDNS(w, r)
+	})
+}
+
+func TestRunAudit(t *testing.T) {
+	tests := []struct {
+		name    string
+		exposed bool
+		rttwarn int
+		status  int
+	}{
+		{"no findings", false, 0, 0},
+		{"findings", true, 0, 8},
+		{"slow server without findings", false, 1, 5},
+		{"findings outrank a slow server", true, 1, 8},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			handler := auditHandler(tt.exposed)
+			if tt.rttwarn > 0 {
+				handler = slowHandler(handler, 5*time.Millisecond)
+			}
+			_, port := newMockDNSServerSamePort(t, handler)
+
+			rn := NewRunner()
+			opts := Options{
+				noqueryns:  true,
+				additional: "127.0.0.1",
+				audit:      true,
+				json:       true,
+				rttwarn:    tt.rttwarn,
+				Qopts: QueryOptions{
+					timeout: time.Second,
+					retries: 1,
+					bufsize: defaultBufsize,
+					port:    port,
+				},
+			}
+			status, message := rn.run(context.Background(), "example.com.", opts)
+			if status != tt.status {
+				t.Errorf("run() status = %d, want %d; message = %q", status, tt.status, message)
+			}
+			if len(rn.output.Responses) != 1 || rn.output.Responses[0].Audit == nil {
+				t.Fatalf("run() responses = %+v, want one with an audit", rn.output.Responses)
+			}
+		})
+	}
+}
@@ -0,0 +1,170 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"io/fs"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+// DiscoveryCache - cache of nameserver names and addresses obtained
+// during nameserver discovery, shared across zones and kept for the TTL
+// of the records. It can optionally be saved to a file, so that it is
+// also shared across program invocations. A nil *DiscoveryCache is a
+// valid cache that never holds anything.
+type DiscoveryCache struct {
+	mu      sync.Mutex
+	file    string
+	entries map[string]cacheEntry
+}
+
+// cacheEntry - cached record data for a name and type
+type cacheEntry struct {
+	Values  []string  `json:"values"`
+	Expires time.Time `json:"expires"`
+}
+
+// NewDiscoveryCache creates an empty in-memory cache
+func NewDiscoveryCache() *DiscoveryCache {
+	return &DiscoveryCache{
+		entries: make(map[string]cacheEntry),
+	}
+}
+
+// LoadDiscoveryCache creates a cache backed by the given file, loading
+// the unexpired entries in it. A missing file yields an empty cache.
+func LoadDiscoveryCache(filename string) (*DiscoveryCache, error) {
+
+	cache := NewDiscoveryCache()
+	cache.file = filename
+
+	b, err := os.ReadFile(filename)
+	if errors.Is(err, fs.ErrNotExist) {
+		return cache, nil
+	}
+	if err != nil {
+		return cache, err
+	}
+	var entries map[string]cacheEntry
+	if err := json.Unmarshal(b, &entries); err != nil {
+		return cache, err
+	}
+
+	now := time.Now()
+	for key, e := range entries {
+		if e.Expires.After(now) {
+			cache.entries[key] = e
+		}
+	}
+	return cache, nil
+}
+
+// Save writes the unexpired entries of the cache to its file, if any
+func (c *DiscoveryCache) Save() error {
+
+	if c == nil || c.file == "" {
+		return nil
+	}
+
+	c.mu.Lock()
+	now := time.Now()
+	entries := make(map[string]cacheEntry, len(c.entries))
+	for key, e := range c.entries {
+		if e.Expires.After(now) {
+			entries[key] = e
+		}
+	}
+	b, err := json.Marshal(entries)
+	c.mu.Unlock()
+	if err != nil {
+		return err
+	}
+
+	tmpfile := c.file + ".tmp"
+	if err := os.WriteFile(tmpfile, b, 0644); err != nil {
+		return err
+	}
+	return os.Rename(tmpfile, c.file)
+}
+
+func cacheKey(name string, rrtype uint16) string {
+	return dns.CanonicalName(name) + "/" + dns.TypeToString[rrtype]
+}
+
+// Get returns the cached values for name and rrtype, if present and
+// unexpired. An empty list of values is a cached negative answer.
+func (c *DiscoveryCache) Get(name string, rrtype uint16) ([]string, bool) {
+
+	if c == nil {
+		return nil, false
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	key := cacheKey(name, rrtype)
+	e, ok := c.entries[key]
+	if !ok {
+		return nil, false
+	}
+	if !e.Expires.After(time.Now()) {
+		delete(c.entries, key)
+		return nil, false
+	}
+	return e.Values, true
+}
+
+// Put caches the values for name and rrtype for ttl seconds
+func (c *DiscoveryCache) Put(name string, rrtype uint16, values []string, ttl uint32) {
+
+	if c == nil || ttl == 0 {
+		return
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.entries[cacheKey(name, rrtype)] = cacheEntry{
+		Values:  values,
+		Expires: time.Now().Add(time.Duration(ttl) * time.Second),
+	}
+}
+
+// responseTTL returns the time for which the answer to a query for
+// rrtype in response may be cached: the smallest TTL of the answer
+// records, or for a negative answer the negative caching TTL from the
+// SOA record in the authority section (RFC 2308), or 0 if neither.
+func responseTTL(response *dns.Msg, rrtype uint16) uint32 {
+
+	var ttl uint32
+	var found bool
+
+	for _, rr := range response.Answer {
+		t := rr.Header().Rrtype
+		if t != rrtype && t != dns.TypeCNAME {
+			continue
+		}
+		if !found || rr.Header().Ttl < ttl {
+			ttl = rr.Header().Ttl
+			found = true
+		}
+	}
+	if found {
+		return ttl
+	}
+
+	for _, rr := range response.Ns {
+		if soa, ok := rr.(*dns.SOA); ok {
+			ttl = soa.Hdr.Ttl
+			if soa.Minttl < ttl {
+				ttl = soa.Minttl
+			}
+			return ttl
+		}
+	}
+	return 0
+}
@@ -0,0 +1,204 @@
+package main
+
+import (
+	"context"
+	"net"
+	"os"
+	"path/filepath"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+func TestDiscoveryCacheGetPut(t *testing.T) {
+	cache := NewDiscoveryCache()
+
+	if _, ok := cache.Get("ns1.example.com.", dns.TypeA); ok {
+		t.Error("Get() on empty cache returned a value")
+	}
+
+	cache.Put("ns1.example.com.", dns.TypeA, []string{"192.0.2.1"}, 300)
+	values, ok := cache.Get("NS1.Example.COM.", dns.TypeA)
+	if !ok || len(values) != 1 || values[0] != "192.0.2.1" {
+		t.Errorf("Get() = %v, %v, want [192.0.2.1], true", values, ok)
+	}
+	if _, ok := cache.Get("ns1.example.com.", dns.TypeAAAA); ok {
+		t.Error("Get() returned a value for the wrong type")
+	}
+
+	// Negative answers are cached as empty lists
+	cache.Put("ns1.example.com.", dns.TypeAAAA, []string{}, 300)
+	values, ok = cache.Get("ns1.example.com.", dns.TypeAAAA)
+	if !ok || len(values) != 0 {
+		t.Errorf("Get() = %v, %v, want [], true", values, ok)
+	}
+
+	// Zero TTL answers are not cached
+	cache.Put("ns2.example.com.", dns.TypeA, []string{"192.0.2.2"}, 0)
+	if _, ok := cache.Get("ns2.example.com.", dns.TypeA); ok {
+		t.Error("Get() returned a value cached with zero TTL")
+	}
+
+	// Expired entries are not returned
+	cache.entries[cacheKey("ns3.example.com.", dns.TypeA)] = cacheEntry{
+		Values:  []string{"192.0.2.3"},
+		Expires: time.Now().Add(-time.Second),
+	}
+	if _, ok := cache.Get("ns3.example.com.", dns.TypeA); ok {
+		t.Error("Get() returned an expired value")
+	}
+
+	// A nil cache is valid and empty
+	var nilcache *DiscoveryCache
+	nilcache.Put("ns1.example.com.", dns.TypeA, []string{"192.0.2.1"}, 300)
+	if _, ok := nilcache.Get("ns1.example.com.", dns.TypeA); ok {
+		t.Error("Get() on nil cache returned a value")
+	}
+	if err := nilcache.Save(); err != nil {
+		t.Errorf("Save() on nil cache returned error: %v", err)
+	}
+}
+
+func TestDiscoveryCacheFile(t *testing.T) {
+	fname := filepath.Join(t.TempDir(), "cache.json")
+
+	cache, err := LoadDiscoveryCache(fname)
+	if err != nil {
+		t.Fatalf("LoadDiscoveryCache() of missing file returned error: %v", err)
+	}
+	cache.Put("example.com.", dns.TypeNS, []string{"ns1.example.com."}, 300)
+	cache.entries[cacheKey("old.example.com.", dns.TypeA)] = cacheEntry{
+		Values:  []string{"192.0.2.9"},
+		Expires: time.Now().Add(-time.Second),
+	}
+	if err := cache.Save(); err != nil {
+		t.Fatalf("Save() returned error: %v", err)
+	}
+
+	cache, err = LoadDiscoveryCache(fname)
+	if err != nil {
+		t.Fatalf("LoadDiscoveryCache() returned error: %v", err)
+	}
+	values, ok := cache.Get("example.com.", dns.TypeNS)
+	if !ok || len(values) != 1 || values[0] != "ns1.example.com." {
+		t.Errorf("Get() after reload = %v, %v, want [ns1.example.com.], true", values, ok)
+	}
+	if len(cache.entries) != 1 {
+		t.Errorf("reloaded cache has %d entries, want 1", len(cache.entries))
+	}
+
+	if err := os.WriteFile(fname, []byte("not json"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	cache, err = LoadDiscoveryCache(fname)
+	if err == nil {
+		t.Error("LoadDiscoveryCache() of corrupt file expected error")
+	}
+	if cache == nil {
+		t.Error("LoadDiscoveryCache() of corrupt file should still return a cache")
+	}
+}
+
+func TestResponseTTL(t *testing.T) {
+	a := func(ttl uint32) dns.RR {
+		return &dns.A{Hdr: dns.RR_Header{Name: "ns1.example.com.", Rrtype: dns.TypeA,
+			Class: dns.ClassINET, Ttl: ttl}, A: net.ParseIP("192.0.2.1")}
+	}
+	soa := &dns.SOA{Hdr: dns.RR_Header{Name: "example.com.", Rrtype: dns.TypeSOA,
+		Class: dns.ClassINET, Ttl: 3600}, Minttl: 600}
+
+	tests := []struct {
+		name     string
+		answer   []dns.RR
+		ns       []dns.RR
+		expected uint32
+	}{
+		{"smallest answer TTL", []dns.RR{a(300), a(100), a(200)}, nil, 100},
+		{"negative answer uses SOA minimum", nil, []dns.RR{soa}, 600},
+		{"nothing cacheable", nil, nil, 0},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			m := new(dns.Msg)
+			m.Answer = tt.answer
+			m.Ns = tt.ns
+			if ttl := responseTTL(m, dns.TypeA); ttl != tt.expected {
+				t.Errorf("responseTTL() = %d, want %d", ttl, tt.expected)
+			}
+		})
+	}
+}
+
+// addressMockHandler returns a resolver handler answering A and AAAA
+// queries for any name, counting the queries it receives.
+func addressMockHandler(count *atomic.Int32) dns.Handler {
+	return dns.HandlerFunc(func(w dns.ResponseWriter, r *dns.Msg) {
+		count.Add(1)
+		m := new(dns.Msg)
+		m.SetReply(r)
+		q := r.Question[0]
+		hdr := dns.RR_Header{Name: q.Name, Rrtype: q.Qtype, Class: dns.ClassINET, Ttl: 300}
+		switch q.Qtype {
+		case dns.TypeA:
+			m.Answer = []dns.RR{&dns.A{Hdr: hdr, A: net.ParseIP("192.0.2.1")}}
+		case dns.TypeAAAA:
+			m.Answer = []dns.RR{&dns.AAAA{Hdr: hdr, AAAA: net.ParseIP("2001:db8::1")}}
+		}
+		w.WriteMsg(m)
+	})
+}
+
+func TestGetRequestsCached(t *testing.T) {
+	var count atomic.Int32
+	server := newMockDNSServer(t, addressMockHandler(&count))
+	defer server.close()
+	<-server.ready
+	host, port, _ := net.SplitHostPort(server.udpAddr)
+
+	opts := &Options{
+		resolvers: NewResolverConfig(Resolver{ip: net.ParseIP(host)}),
+		cache:     NewDiscoveryCache(),
+		Qopts: QueryOptions{
+			timeout: 2 * time.Second,
+			retries: 1,
+			bufsize: defaultBufsize,
+			port:    port,
+		},
+	}
+
+	nsNames := []string{"ns2.example.com.", "ns1.example.com.", "192.0.2.53"}
+	requests := getRequests(context.Background(), nsNames, opts)
+	if len(requests) != 5 {
+		t.Fatalf("getRequests() returned %d requests, want 5", len(requests))
+	}
+	if n := count.Load(); n != 4 {
+		t.Errorf("resolver received %d queries, want 4", n)
+	}
+
+	// Requests are ordered by name, IPv6 before IPv4
+	expected := []struct{ name, ip string }{
+		{"192.0.2.53", "192.0.2.53"},
+		{"ns1.example.com.", "2001:db8::1"},
+		{"ns1.example.com.", "192.0.2.1"},
+		{"ns2.example.com.", "2001:db8::1"},
+		{"ns2.example.com.", "192.0.2.1"},
+	}
+	for i, e := range expected {
+		if requests[i].nsname != e.name || requests[i].nsip.String() != e.ip {
+			t.Errorf("getRequests()[%d] = %s %s, want %s %s", i,
+				requests[i].nsname, requests[i].nsip, e.name, e.ip)
+		}
+	}
+
+	// A second discovery is answered from the cache
+	requests = getRequests(context.Background(), nsNames, opts)
+	if len(requests) != 5 {
+		t.Errorf("cached getRequests() returned %d requests, want 5", len(requests))
+	}
+	if n := count.Load(); n != 4 {
+		t.Errorf("resolver received %d queries after cached lookup, want 4", n)
+	}
+}
@@ -0,0 +1,81 @@
+package main
+
+import (
+	"context"
+	"net"
+	"strings"
+	"sync"
+
+	"github.com/miekg/dns"
+)
+
+// CHAOS class TXT names that servers answer with their identity and
+// software version (RFC 4892), in order of preference.
+var (
+	chaosIdentityNames = []string{"hostname.bind.", "id.server."}
+	chaosVersionNames  = []string{"version.bind.", "version.server."}
+)
+
+// ChaosInfo - server identity and version obtained with CHAOS queries
+type ChaosInfo struct {
+	identity string
+	version  string
+}
+
+// queryChaosTXT returns the text of the CHAOS class TXT record qname at
+// the server address ip, or an empty string if there is none. These
+// queries are sent only once, since many servers don't answer them.
+func (rn *Runner) queryChaosTXT(ctx context.Context, qname string, ip net.IP, opts Options) string {
+
+	qopts := opts.Qopts
+	qopts.rdflag = false
+	qopts.nsid = false
+	qopts.retries = 1
+	qopts.qclass = dns.ClassCHAOS
+	qopts.tsig = nil
+
+	response, err := SendQuery(ctx, qname, dns.TypeTXT, []net.IP{ip}, qopts)
+	if err != nil || response == nil || response.Rcode != dns.RcodeSuccess {
+		return ""
+	}
+	for _, rr := range response.Answer {
+		if txt, ok := rr.(*dns.TXT); ok {
+			return strings.Join(txt.Txt, "")
+		}
+	}
+	return ""
+}
+
+// getChaosInfo queries all the identity and version names at the server
+// address ip in parallel, and returns the most preferred answer of each.
+func (rn *Runner) getChaosInfo(ctx context.Context, ip net.IP, opts Options) ChaosInfo {
+
+	var wg sync.WaitGroup
+
+	names := make([]string, 0, len(chaosIdentityNames)+len(chaosVersionNames))
+	names = append(names, chaosIdentityNames...)
+	names = append(names, chaosVersionNames...)
+	answers := make([]string, len(names))
+
+	for i, qname := range names {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			answers[i] = rn.queryChaosTXT(ctx, qname, ip, opts)
+		}()
+	}
+	wg.Wait()
+
+	first := func(answers []string) string {
+		for _, a := range answers {
+			if a != "" {
+				return a
+			}
+		}
+		return ""
+	}
+	return ChaosInfo{
+		identity: first(answers[:len(chaosIdentityNames)]),
+		version:  first(answers[len(chaosIdentityNames):]),
+	}
+}
@@ -0,0 +1,125 @@
+package main
+
+import (
+	"context"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+// chaosHandler answers CHAOS class TXT queries for the names in txt,
+// refuses other CHAOS queries, and answers SOA queries with a fixed
+// serial.
+func chaosHandler(txt map[string]string) dns.Handler {
+	return dns.HandlerFunc(func(w dns.ResponseWriter, r *dns.Msg) {
+		q := r.Question[0]
+		m := new(dns.Msg)
+		if q.Qclass != dns.ClassCHAOS {
+			classHandler(dns.RcodeSuccess, true, true, false).ServeDNS(w, r)
+			return
+		}
+		text, ok := txt[q.Name]
+		if !ok || q.Qtype != dns.TypeTXT {
+			m.SetRcode(r, dns.RcodeRefused)
+			w.WriteMsg(m)
+			return
+		}
+		m.SetReply(r)
+		m.Answer = []dns.RR{&dns.TXT{
+			Hdr: dns.RR_Header{
+				Name:   q.Name,
+				Rrtype: dns.TypeTXT,
+				Class:  dns.ClassCHAOS,
+			},
+			Txt: []string{text},
+		}}
+		w.WriteMsg(m)
+	})
+}
+
+func TestGetChaosInfo(t *testing.T) {
+	tests := []struct {
+		name         string
+		txt          map[string]string
+		wantIdentity string
+		wantVersion  string
+	}{
+		{
+			name:         "preferred names",
+			txt:          map[string]string{"hostname.bind.": "ns1-fra", "id.server.": "other", "version.bind.": "9.18.1"},
+			wantIdentity: "ns1-fra",
+			wantVersion:  "9.18.1",
+		},
+		{
+			name:         "fallback names",
+			txt:          map[string]string{"id.server.": "ns1-ams", "version.server.": "NSD 4.8.0"},
+			wantIdentity: "ns1-ams",
+			wantVersion:  "NSD 4.8.0",
+		},
+		{
+			name: "no answers",
+			txt:  map[string]string{},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			server := newMockDNSServer(t, chaosHandler(tt.txt))
+			defer server.close()
+			host, port, _ := net.SplitHostPort(server.udpAddr)
+
+			opts := Options{
+				Qopts: QueryOptions{
+					timeout: 2 * time.Second,
+					retries: 3,
+					bufsize: defaultBufsize,
+					port:    port,
+				},
+			}
+			info := NewRunner().getChaosInfo(context.Background(), net.ParseIP(host), opts)
+			if info.identity != tt.wantIdentity {
+				t.Errorf("identity = %q, want %q", info.identity, tt.wantIdentity)
+			}
+			if info.version != tt.wantVersion {
+				t.Errorf("version = %q, want %q", info.version, tt.wantVersion)
+			}
+		})
+	}
+}
+
+func TestRunChaos(t *testing.T) {
+	server := newMockDNSServer(t, chaosHandler(map[string]string{
+		"hostname.bind.": "ns1-fra",
+		"version.bind.":  "9.18.1",
+	}))
+	defer server.close()
+	host, port, _ := net.SplitHostPort(server.udpAddr)
+
+	rn := NewRunner()
+	opts := Options{
+		noqueryns:  true,
+		additional: host,
+		chaos:      true,
+		json:       true,
+		Qopts: QueryOptions{
+			timeout: 2 * time.Second,
+			retries: 1,
+			bufsize: defaultBufsize,
+			port:    port,
+		},
+	}
+	status, message := rn.run(context.Background(), "example.com.", opts)
+	if status != 0 {
+		t.Fatalf("run() status = %d, want 0; message = %q", status, message)
+	}
+	if len(rn.output.Responses) != 1 {
+		t.Fatalf("run() got %d responses, want 1", len(rn.output.Responses))
+	}
+	r := rn.output.Responses[0]
+	if r.Serial != 2024010100 || r.Identity != "ns1-fra" || r.Version != "9.18.1" {
+		t.Errorf("response serial %d identity %q version %q, want 2024010100 ns1-fra 9.18.1",
+			r.Serial, r.Identity, r.Version)
+	}
+}
@@ -0,0 +1,348 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/BurntSushi/toml"
+	"github.com/miekg/dns"
+)
+
+// ConfigSettings - check settings in the configuration file. Each one
+// corresponds to a command line flag; unset ones are nil.
+type ConfigSettings struct {
+	Master      *string        `toml:"master"`
+	Additional  []string       `toml:"additional"`
+	NoQueryNS   *bool          `toml:"no_query_ns"`
+	Resolver    []string       `toml:"resolver"`
+	Drift       *int           `toml:"drift"`
+	DriftFile   *string        `toml:"drift_file"`
+	Timeout     *int           `toml:"timeout"`
+	Retries     *int           `toml:"retries"`
+	Deadline    *int           `toml:"deadline"`
+	TCP         *bool          `toml:"tcp"`
+	TLS         *bool          `toml:"tls"`
+	Source      []string       `toml:"source"`
+	IPv4Only    *bool          `toml:"ipv4_only"`
+	IPv6Only    *bool          `toml:"ipv6_only"`
+	Bufsize     *int           `toml:"bufsize"`
+	NSID        *bool          `toml:"nsid"`
+	Chaos       *bool          `toml:"chaos"`
+	RTTWarn     *int           `toml:"rtt_warn"`
+	RTTCrit     *int           `toml:"rtt_crit"`
+	RTTMedian   *bool          `toml:"rtt_median"`
+	ErrorStatus map[string]int `toml:"error_status"`
+	TSIG        *string        `toml:"tsig"`
+	JSON        *bool          `toml:"json"`
+	Sort        *bool          `toml:"sort"`
+}
+
+// ConfigKey - a TSIG key in the configuration file
+type ConfigKey struct {
+	Algorithm string `toml:"algorithm"`
+	Secret    string `toml:"secret"`
+}
+
+// ConfigProfile - a named check profile, applying to the listed zones
+type ConfigProfile struct {
+	ConfigSettings
+	Zones []string `toml:"zones"`
+}
+
+// Config - the configuration file: default settings, TSIG keys, and
+// check profiles
+type Config struct {
+	Defaults ConfigSettings           `toml:"defaults"`
+	Keys     map[string]ConfigKey     `toml:"keys"`
+	Profiles map[string]ConfigProfile `toml:"profiles"`
+}
+
+// LoadConfig reads and validates a configuration file, reporting all
+// the problems found in it at once.
+func LoadConfig(filename string) (*Config, error) {
+
+	var config Config
+
+	md, err := toml.DecodeFile(filename, &config)
+	if err != nil {
+		return nil, err
+	}
+
+	var errs []error
+	for _, key := range md.Undecoded() {
+		errs = append(errs, fmt.Errorf("unknown setting: %s", key.String()))
+	}
+	errs = append(errs, config.validate()...)
+	if len(errs) > 0 {
+		return nil, fmt.Errorf("%s: %w", filename, errors.Join(errs...))
+	}
+	return &config, nil
+}
+
+// validate checks the values of the configuration, and returns all the
+// errors found.
+func (c *Config) validate() []error {
+
+	var errs []error
+
+	for name, key := range c.Keys {
+		alg := key.Algorithm
+		if alg == "" {
+			alg = defaultTSIGAlgorithm
+		}
+		if _, err := newTSIGKey(alg, name, key.Secret); err != nil {
+			errs = append(errs, fmt.Errorf("keys.%s: %s", name, err.Error()))
+		}
+	}
+
+	errs = append(errs, c.Defaults.validate("defaults", c.Keys)...)
+	if err := c.Defaults.rttOrder("defaults", nil); err != nil {
+		errs = append(errs, err)
+	}
+
+	zoneProfile := make(map[string]string)
+	for _, name := range c.profileNames() {
+		p := c.Profiles[name]
+		section := "profiles." + name
+		errs = append(errs, p.validate(section, c.Keys)...)
+		if err := p.rttOrder(section, &c.Defaults); err != nil {
+			errs = append(errs, err)
+		}
+		for _, zone := range p.Zones {
+			zone = dns.CanonicalName(zone)
+			if other, ok := zoneProfile[zone]; ok {
+				errs = append(errs, fmt.Errorf("%s: zone %s is also in profiles.%s",
+					section, zone, other))
+				continue
+			}
+			zoneProfile[zone] = name
+		}
+	}
+	return errs
+}
+
+// validate checks the values of the settings in a section
+func (s *ConfigSettings) validate(section string, keys map[string]ConfigKey) []error {
+
+	var errs []error
+
+	nonNegative := func(name string, v *int) {
+		if v != nil && *v < 0 {
+			errs = append(errs, fmt.Errorf("%s.%s: must not be negative", section, name))
+		}
+	}
+	positive := func(name string, v *int) {
+		if v != nil && *v <= 0 {
+			errs = append(errs, fmt.Errorf("%s.%s: must be positive", section, name))
+		}
+	}
+
+	nonNegative("drift", s.Drift)
+	positive("timeout", s.Timeout)
+	positive("retries", s.Retries)
+	nonNegative("deadline", s.Deadline)
+	nonNegative("rtt_warn", s.RTTWarn)
+	nonNegative("rtt_crit", s.RTTCrit)
+	if s.Bufsize != nil && (*s.Bufsize < 512 || *s.Bufsize > 65535) {
+		errs = append(errs, fmt.Errorf("%s.bufsize: must be between 512 and 65535", section))
+	}
+	if s.Master != nil && *s.Master != "" {
+		if _, err := parseServer(*s.Master); err != nil {
+			errs = append(errs, fmt.Errorf("%s.master: %s", section, err.Error()))
+		}
+	}
+	if len(s.Additional) > 0 {
+		if _, err := parseServers(strings.Join(s.Additional, ",")); err != nil {
+			errs = append(errs, fmt.Errorf("%s.additional: %s", section, err.Error()))
+		}
+	}
+	if s.Resolver != nil {
+		if _, err := parseResolvers(strings.Join(s.Resolver, ",")); err != nil {
+			errs = append(errs, fmt.Errorf("%s.resolver: %s", section, err.Error()))
+		}
+	}
+	if len(s.Source) > 0 {
+		if _, err := parseSources(strings.Join(s.Source, ",")); err != nil {
+			errs = append(errs, fmt.Errorf("%s.source: %s", section, err.Error()))
+		}
+	}
+	if s.TSIG != nil {
+		if _, ok := keys[*s.TSIG]; !ok {
+			errs = append(errs, fmt.Errorf("%s.tsig: unknown key %s", section, *s.TSIG))
+		}
+	}
+	if s.ErrorStatus != nil {
+		if _, err := parseErrorStatus(errorStatusString(s.ErrorStatus)); err != nil {
+			errs = append(errs, fmt.Errorf("%s.error_status: %s", section, err.Error()))
+		}
+	}
+	return errs
+}
+
+// rttOrder checks that rtt_crit isn't lower than rtt_warn in a section,
+// taking the values the section doesn't set from defaults, if given.
+func (s *ConfigSettings) rttOrder(section string, defaults *ConfigSettings) error {
+
+	warn, crit := s.RTTWarn, s.RTTCrit
+	if defaults != nil {
+		if warn == nil {
+			warn = defaults.RTTWarn
+		}
+		if crit == nil {
+			crit = defaults.RTTCrit
+		}
+	}
+	if warn != nil && crit != nil && *warn > 0 && *crit > 0 && *crit < *warn {
+		return fmt.Errorf("%s.rtt_crit: must not be lower than rtt_warn", section)
+	}
+	return nil
+}
+
+func (c *Config) profileNames() []string {
+	names := make([]string, 0, len(c.Profiles))
+	for name := range c.Profiles {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// selectProfile returns the named profile, or if no name is given, the
+// profile that lists the zone, if any.
+func (c *Config) selectProfile(name, zone string) (*ConfigProfile, error) {
+
+	if name != "" {
+		p, ok := c.Profiles[name]
+		if !ok {
+			return nil, fmt.Errorf("unknown profile: %s", name)
+		}
+		return &p, nil
+	}
+	if zone == "" {
+		return nil, nil
+	}
+	for _, name := range c.profileNames() {
+		p := c.Profiles[name]
+		for _, z := range p.Zones {
+			if dns.CanonicalName(z) == dns.CanonicalName(zone) {
+				return &p, nil
+			}
+		}
+	}
+	return nil, nil
+}
+
+// errorStatusString formats an error status policy like -errstatus
+func errorStatusString(policy map[string]int) string {
+	items := make([]string, 0, len(policy))
+	for class, status := range policy {
+		items = append(items, fmt.Sprintf("%s=%d", class, status))
+	}
+	sort.Strings(items)
+	return strings.Join(items, ",")
+}
+
+// flagValues returns the settings as values of the corresponding
+// command line flags.
+func (s *ConfigSettings) flagValues(keys map[string]ConfigKey) map[string]string {
+
+	values := make(map[string]string)
+
+	setString := func(name string, v *string) {
+		if v != nil {
+			values[name] = *v
+		}
+	}
+	setInt := func(name string, v *int) {
+		if v != nil {
+			values[name] = strconv.Itoa(*v)
+		}
+	}
+	setBool := func(name string, v *bool) {
+		if v != nil {
+			values[name] = strconv.FormatBool(*v)
+		}
+	}
+
+	setString("m", s.Master)
+	if s.Additional != nil {
+		values["a"] = strings.Join(s.Additional, ",")
+	}
+	setBool("n", s.NoQueryNS)
+	if s.Resolver != nil {
+		values["resolver"] = strings.Join(s.Resolver, ",")
+	}
+	setInt("d", s.Drift)
+	setString("df", s.DriftFile)
+	setInt("t", s.Timeout)
+	setInt("r", s.Retries)
+	setInt("deadline", s.Deadline)
+	setBool("c", s.TCP)
+	setBool("tls", s.TLS)
+	if s.Source != nil {
+		values["source"] = strings.Join(s.Source, ",")
+	}
+	setBool("4", s.IPv4Only)
+	setBool("6", s.IPv6Only)
+	setInt("b", s.Bufsize)
+	setBool("nsid", s.NSID)
+	setBool("chaos", s.Chaos)
+	setInt("rttwarn", s.RTTWarn)
+	setInt("rttcrit", s.RTTCrit)
+	setBool("rttmedian", s.RTTMedian)
+	if s.ErrorStatus != nil {
+		values["errstatus"] = errorStatusString(s.ErrorStatus)
+	}
+	if s.TSIG != nil {
+		key := keys[*s.TSIG]
+		alg := key.Algorithm
+		if alg == "" {
+			alg = defaultTSIGAlgorithm
+		}
+		values["y"] = alg + ":" + *s.TSIG + ":" + key.Secret
+	}
+	setBool("j", s.JSON)
+	setBool("s", s.Sort)
+	return values
+}
+
+// applyConfig sets the flags from the defaults of the configuration
+// file and the selected profile, which overrides them, except for flags
+// given on the command line, which override both.
+func applyConfig(filename, profile, zone string) error {
+
+	config, err := LoadConfig(filename)
+	if err != nil {
+		return err
+	}
+	p, err := config.selectProfile(profile, zone)
+	if err != nil {
+		return err
+	}
+
+	values := config.Defaults.flagValues(config.Keys)
+	if p != nil {
+		for name, value := range p.flagValues(config.Keys) {
+			values[name] = value
+		}
+	}
+
+	explicit := make(map[string]bool)
+	flag.Visit(func(f *flag.Flag) {
+		explicit[f.Name] = true
+	})
+
+	for name, value := range values {
+		if explicit[name] {
+			continue
+		}
+		if err := flag.Set(name, value); err != nil {
+			return fmt.Errorf("%s: setting -%s: %s", filename, name, err.Error())
+		}
+	}
+	return nil
+}
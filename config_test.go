@@ -0,0 +1,215 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+const testConfig = `
+[defaults]
+timeout = 5
+retries = 2
+nsid = true
+
+[keys."xfr-key"]
+algorithm = "hmac-sha512"
+secret = "c2VjcmV0LXNlY3JldC1zZWNyZXQ="
+
+[profiles.corp]
+zones = ["example.com", "Example.NET."]
+master = "192.0.2.1"
+additional = ["sec1.example.org", "sec2.example.org"]
+drift = 2
+tsig = "xfr-key"
+json = true
+
+[profiles.thirdparty]
+zones = ["example.org"]
+timeout = 10
+rtt_warn = 200
+error_status = { timeout = 1, lame = 0 }
+`
+
+func writeConfig(t *testing.T, content string) string {
+	fname := filepath.Join(t.TempDir(), "checkzoneserial.toml")
+	if err := os.WriteFile(fname, []byte(content), 0644); err != nil {
+		t.Fatal(err)
+	}
+	return fname
+}
+
+func TestLoadConfig(t *testing.T) {
+	config, err := LoadConfig(writeConfig(t, testConfig))
+	if err != nil {
+		t.Fatalf("LoadConfig() unexpected error: %v", err)
+	}
+	if *config.Defaults.Timeout != 5 || !*config.Defaults.NSID {
+		t.Errorf("defaults = %+v", config.Defaults)
+	}
+	corp := config.Profiles["corp"]
+	if *corp.Master != "192.0.2.1" || *corp.Drift != 2 || len(corp.Additional) != 2 {
+		t.Errorf("profiles.corp = %+v", corp)
+	}
+
+	tests := []struct {
+		name    string
+		profile string
+		zone    string
+		want    string
+		wantErr bool
+	}{
+		{"by zone", "", "example.com.", "corp", false},
+		{"by zone ignores case", "", "example.net", "corp", false},
+		{"by name", "thirdparty", "example.com.", "thirdparty", false},
+		{"no matching zone", "", "example.info.", "", false},
+		{"unknown name", "bogus", "", "", true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			p, err := config.selectProfile(tt.profile, tt.zone)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("selectProfile() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			switch {
+			case tt.want == "" && p != nil:
+				t.Errorf("selectProfile() = %+v, want none", p)
+			case tt.want != "" && (p == nil || p.Zones[0] != config.Profiles[tt.want].Zones[0]):
+				t.Errorf("selectProfile() = %+v, want profile %s", p, tt.want)
+			}
+		})
+	}
+}
+
+func TestLoadConfigErrors(t *testing.T) {
+	content := `
+[defaults]
+timeout = 0
+bufsize = 100
+colour = "blue"
+master = "ftp://ns1.example.com"
+rtt_warn = 200
+rtt_crit = 100
+
+[keys.k1]
+algorithm = "hmac-md4"
+secret = "c2VjcmV0"
+
+[profiles.a]
+zones = ["example.com"]
+tsig = "missing"
+drift = -1
+
+[profiles.b]
+zones = ["example.com."]
+error_status = { bogus = 1 }
+additional = ["ns1.example.net", "bad..name"]
+source = ["192.0.2.1+192.0.2.2"]
+
+[profiles.c]
+rtt_crit = 150
+`
+	_, err := LoadConfig(writeConfig(t, content))
+	if err == nil {
+		t.Fatal("LoadConfig() expected error")
+	}
+	for _, want := range []string{
+		"unknown setting: defaults.colour",
+		"defaults.timeout",
+		"defaults.bufsize",
+		"keys.k1",
+		"profiles.a.tsig: unknown key missing",
+		"profiles.a.drift",
+		"profiles.b: zone example.com. is also in profiles.a",
+		"profiles.b.error_status",
+		"defaults.master",
+		"defaults.rtt_crit: must not be lower than rtt_warn",
+		"profiles.b.additional",
+		"profiles.b.source",
+		"profiles.c.rtt_crit: must not be lower than rtt_warn",
+	} {
+		if !strings.Contains(err.Error(), want) {
+			t.Errorf("LoadConfig() error doesn't report %q:\n%v", want, err)
+		}
+	}
+
+	if _, err := LoadConfig(writeConfig(t, "[defaults\n")); err == nil {
+		t.Error("LoadConfig() expected error for bad syntax")
+	}
+}
+
+func TestConfigOptions(t *testing.T) {
+	// Save original args and restore them after the test
+	origArgs := os.Args
+	defer func() { os.Args = origArgs }()
+
+	fname := writeConfig(t, testConfig)
+
+	t.Run("profile by zone", func(t *testing.T) {
+		resetFlags()
+		os.Args = []string{"cmd", "-config", fname, "example.com"}
+		_, opts, err := doFlags()
+		if err != nil {
+			t.Fatalf("Unexpected error: %v", err)
+		}
+		if opts.Qopts.timeout != 5*time.Second || opts.Qopts.retries != 2 || !opts.Qopts.nsid {
+			t.Errorf("Expected defaults timeout 5s retries 2 nsid, got %v %d %v",
+				opts.Qopts.timeout, opts.Qopts.retries, opts.Qopts.nsid)
+		}
+		if opts.masterIP.String() != "192.0.2.1" || opts.delta != 2 || !opts.json ||
+			opts.additional != "sec1.example.org,sec2.example.org" {
+			t.Errorf("Expected corp profile, got master %v delta %d json %v additional %q",
+				opts.masterIP, opts.delta, opts.json, opts.additional)
+		}
+		if opts.Qopts.tsig == nil || opts.Qopts.tsig.name != "xfr-key." ||
+			opts.Qopts.tsig.algorithm != "hmac-sha512." {
+			t.Errorf("Expected TSIG key xfr-key., got %+v", opts.Qopts.tsig)
+		}
+	})
+
+	t.Run("command line overrides file", func(t *testing.T) {
+		resetFlags()
+		os.Args = []string{"cmd", "-config", fname, "-profile", "thirdparty", "-t", "1", "example.com"}
+		_, opts, err := doFlags()
+		if err != nil {
+			t.Fatalf("Unexpected error: %v", err)
+		}
+		if opts.Qopts.timeout != time.Second {
+			t.Errorf("Expected timeout 1s from command line, got %v", opts.Qopts.timeout)
+		}
+		if opts.rttwarn != 200 || opts.errstatus["timeout"] != 1 || opts.errstatus["lame"] != 0 {
+			t.Errorf("Expected thirdparty profile, got rttwarn %d errstatus %v",
+				opts.rttwarn, opts.errstatus)
+		}
+		if opts.masterIP != nil {
+			t.Errorf("Expected no master, got %v", opts.masterIP)
+		}
+	})
+
+	t.Run("no profile for zone", func(t *testing.T) {
+		resetFlags()
+		os.Args = []string{"cmd", "-config", fname, "example.info"}
+		_, opts, err := doFlags()
+		if err != nil {
+			t.Fatalf("Unexpected error: %v", err)
+		}
+		if opts.Qopts.timeout != 5*time.Second || opts.masterIP != nil {
+			t.Errorf("Expected defaults only, got timeout %v master %v",
+				opts.Qopts.timeout, opts.masterIP)
+		}
+	})
+
+	for _, args := range [][]string{
+		{"cmd", "-profile", "corp", "example.com"},
+		{"cmd", "-config", fname, "-profile", "bogus", "example.com"},
+		{"cmd", "-config", filepath.Join(t.TempDir(), "missing"), "example.com"},
+	} {
+		resetFlags()
+		os.Args = args
+		if _, _, err := doFlags(); err == nil {
+			t.Errorf("Expected error for %v", args[1:])
+		}
+	}
+}
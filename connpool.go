@@ -0,0 +1,228 @@
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+// errConnFailed is returned when a pipelined connection fails before a
+// response is received; the query can be retried on a fresh connection.
+var errConnFailed = errors.New("pipelined connection failed")
+
+// ConnManager - keeps one TCP or DNS over TLS connection open per server
+// address, and pipelines queries over it, matching responses to queries
+// by message ID, since they can arrive out of order (RFC 7766, Section 7).
+type ConnManager struct {
+	mu    sync.Mutex
+	conns map[string]*pipeConn
+}
+
+// pipeConn - a single pipelined connection to a server
+type pipeConn struct {
+	key     string
+	conn    *dns.Conn
+	wmu     sync.Mutex // serializes writes to conn
+	mu      sync.Mutex // protects pending and err
+	pending map[uint16]*pendingQuery
+	err     error
+	ready   chan struct{} // closed once dialing has completed
+	done    chan struct{} // closed once the connection has failed
+}
+
+// pendingQuery - a query awaiting its response on a pipelined connection
+type pendingQuery struct {
+	question dns.Question
+	response chan *dns.Msg
+}
+
+// NewConnManager creates an empty connection manager
+func NewConnManager() *ConnManager {
+	return &ConnManager{
+		conns: make(map[string]*pipeConn),
+	}
+}
+
+// Close closes all open connections
+func (cm *ConnManager) Close() {
+	cm.mu.Lock()
+	conns := cm.conns
+	cm.conns = make(map[string]*pipeConn)
+	cm.mu.Unlock()
+
+	for _, pc := range conns {
+		<-pc.ready
+		if pc.conn != nil {
+			pc.conn.Close()
+		}
+	}
+}
+
+// getConn returns the open connection to destination over the given
+// network ("tcp" or "tcp-tls"), dialing a new one if needed. Concurrent
+// callers wait for a single dial rather than each opening a connection.
+func (cm *ConnManager) getConn(ctx context.Context, network, destination string, qopts QueryOptions) (*pipeConn, error) {
+
+	key := network + "/" + destination
+
+	cm.mu.Lock()
+	pc, ok := cm.conns[key]
+	if ok {
+		cm.mu.Unlock()
+		<-pc.ready
+		if pc.conn == nil {
+			return nil, pc.err
+		}
+		return pc, nil
+	}
+	pc = &pipeConn{
+		key:     key,
+		pending: make(map[uint16]*pendingQuery),
+		ready:   make(chan struct{}),
+		done:    make(chan struct{}),
+	}
+	cm.conns[key] = pc
+	cm.mu.Unlock()
+
+	c := new(dns.Client)
+	c.Net = network
+	c.Timeout = qopts.timeout
+	c.Dialer = qopts.dialer(network, destination)
+	if network == "tcp-tls" {
+		c.TLSConfig = &tls.Config{InsecureSkipVerify: true}
+	}
+	conn, err := c.DialContext(ctx, destination)
+	if err != nil {
+		cm.remove(pc)
+		pc.err = err
+		close(pc.ready)
+		return nil, err
+	}
+	pc.conn = conn
+	close(pc.ready)
+	go cm.readLoop(pc)
+	return pc, nil
+}
+
+// remove forgets a connection, so that the next query dials anew
+func (cm *ConnManager) remove(pc *pipeConn) {
+	cm.mu.Lock()
+	if cm.conns[pc.key] == pc {
+		delete(cm.conns, pc.key)
+	}
+	cm.mu.Unlock()
+}
+
+// readLoop reads responses from a pipelined connection and hands each one
+// to the query waiting for it, until the connection fails or is closed.
+func (cm *ConnManager) readLoop(pc *pipeConn) {
+
+	var err error
+	var m *dns.Msg
+
+	for {
+		m, err = pc.conn.ReadMsg()
+		if err != nil {
+			break
+		}
+		pc.mu.Lock()
+		pq, ok := pc.pending[m.Id]
+		if ok && len(m.Question) == 1 && questionMatches(m.Question[0], pq.question) {
+			delete(pc.pending, m.Id)
+			pq.response <- m
+		}
+		pc.mu.Unlock()
+	}
+
+	cm.remove(pc)
+
+	pc.mu.Lock()
+	pc.err = err
+	pc.pending = nil
+	pc.mu.Unlock()
+	pc.conn.Close()
+	close(pc.done)
+}
+
+// questionMatches reports whether a response question matches the query
+func questionMatches(q1, q2 dns.Question) bool {
+	return q1.Qtype == q2.Qtype && q1.Qclass == q2.Qclass &&
+		dns.CanonicalName(q1.Name) == dns.CanonicalName(q2.Name)
+}
+
+// exchange sends a query over the pipelined connection and waits for
+// its response. If the message ID is already in use on the connection,
+// the query is sent with a fresh ID.
+func (pc *pipeConn) exchange(ctx context.Context, query *dns.Msg, timeout time.Duration) (*dns.Msg, error) {
+
+	pq := &pendingQuery{
+		question: query.Question[0],
+		response: make(chan *dns.Msg, 1),
+	}
+
+	pc.mu.Lock()
+	if pc.pending == nil {
+		pc.mu.Unlock()
+		return nil, errConnFailed
+	}
+	for {
+		if _, inuse := pc.pending[query.Id]; !inuse {
+			break
+		}
+		query.Id = dns.Id()
+	}
+	id := query.Id
+	pc.pending[id] = pq
+	pc.mu.Unlock()
+
+	pc.wmu.Lock()
+	pc.conn.SetWriteDeadline(time.Now().Add(timeout))
+	err := pc.conn.WriteMsg(query)
+	pc.wmu.Unlock()
+	if err != nil {
+		pc.conn.Close()
+		return nil, fmt.Errorf("%w: %s", errConnFailed, err.Error())
+	}
+
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+
+	select {
+	case response := <-pq.response:
+		return response, nil
+	case <-pc.done:
+		select {
+		case response := <-pq.response:
+			return response, nil
+		default:
+			return nil, fmt.Errorf("%w: %v", errConnFailed, pc.err)
+		}
+	case <-timer.C:
+		err = fmt.Errorf("read %s: %w", pc.conn.RemoteAddr(), os.ErrDeadlineExceeded)
+	case <-ctx.Done():
+		err = ctx.Err()
+	}
+
+	pc.mu.Lock()
+	if pc.pending != nil {
+		delete(pc.pending, id)
+	}
+	pc.mu.Unlock()
+	return nil, err
+}
+
+// Exchange sends a query to destination over a pipelined connection
+func (cm *ConnManager) Exchange(ctx context.Context, query *dns.Msg, network, destination string, qopts QueryOptions) (*dns.Msg, error) {
+
+	pc, err := cm.getConn(ctx, network, destination, qopts)
+	if err != nil {
+		return nil, err
+	}
+	return pc.exchange(ctx, query, qopts.timeout)
+}
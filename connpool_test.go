@@ -0,0 +1,217 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+// pipelineServer is a raw TCP DNS server that counts the connections it
+// accepts. On each connection it reads batch queries and then answers
+// them in reverse order. If dropFirst is set, the first connection is
+// closed after reading a query, without answering it; if stallFirst is
+// set, the queries on the first connection are read but never answered.
+type pipelineServer struct {
+	listener   net.Listener
+	accepted   atomic.Int32
+	batch      int
+	dropFirst  bool
+	stallFirst bool
+}
+
+func newPipelineServer(t *testing.T, batch int, dropFirst, stallFirst bool) *pipelineServer {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Failed to start pipeline server: %v", err)
+	}
+	s := &pipelineServer{listener: l, batch: batch, dropFirst: dropFirst, stallFirst: stallFirst}
+	go s.serve()
+	t.Cleanup(func() { l.Close() })
+	return s
+}
+
+func (s *pipelineServer) serve() {
+	for {
+		c, err := s.listener.Accept()
+		if err != nil {
+			return
+		}
+		n := s.accepted.Add(1)
+		go s.serveConn(&dns.Conn{Conn: c}, n == 1 && s.dropFirst, n == 1 && s.stallFirst)
+	}
+}
+
+func (s *pipelineServer) serveConn(conn *dns.Conn, drop, stall bool) {
+	defer conn.Close()
+	for stall {
+		if _, err := conn.ReadMsg(); err != nil {
+			return
+		}
+	}
+	for {
+		var queries []*dns.Msg
+		for len(queries) < s.batch {
+			q, err := conn.ReadMsg()
+			if err != nil {
+				return
+			}
+			if drop {
+				return
+			}
+			queries = append(queries, q)
+		}
+		for i := len(queries) - 1; i >= 0; i-- {
+			m := new(dns.Msg)
+			m.SetReply(queries[i])
+			m.Answer = []dns.RR{&dns.TXT{
+				Hdr: dns.RR_Header{
+					Name:   queries[i].Question[0].Name,
+					Rrtype: dns.TypeTXT,
+					Class:  dns.ClassINET,
+				},
+				Txt: []string{queries[i].Question[0].Name},
+			}}
+			if err := conn.WriteMsg(m); err != nil {
+				return
+			}
+		}
+	}
+}
+
+func (s *pipelineServer) port() string {
+	_, port, _ := net.SplitHostPort(s.listener.Addr().String())
+	return port
+}
+
+func TestConnManagerPipelining(t *testing.T) {
+	const numQueries = 8
+
+	server := newPipelineServer(t, numQueries, false, false)
+	cm := NewConnManager()
+	defer cm.Close()
+
+	qopts := QueryOptions{
+		tcp:     true,
+		timeout: 2 * time.Second,
+		retries: 1,
+		bufsize: defaultBufsize,
+		port:    server.port(),
+		conns:   cm,
+	}
+
+	var wg sync.WaitGroup
+	errs := make(chan error, numQueries)
+	for i := 0; i < numQueries; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			qname := fmt.Sprintf("q%d.example.com.", i)
+			response, err := SendQuery(context.Background(), qname, dns.TypeTXT,
+				[]net.IP{net.ParseIP("127.0.0.1")}, qopts)
+			if err != nil {
+				errs <- err
+				return
+			}
+			txt, ok := response.Answer[0].(*dns.TXT)
+			if !ok || txt.Txt[0] != qname {
+				errs <- fmt.Errorf("query %s got mismatched answer %v", qname, response.Answer[0])
+			}
+		}(i)
+	}
+	wg.Wait()
+	close(errs)
+
+	for err := range errs {
+		t.Error(err)
+	}
+	if n := server.accepted.Load(); n != 1 {
+		t.Errorf("server accepted %d connections, want 1", n)
+	}
+}
+
+func TestConnManagerFallback(t *testing.T) {
+	server := newPipelineServer(t, 1, true, false)
+	cm := NewConnManager()
+	defer cm.Close()
+
+	qopts := QueryOptions{
+		tcp:     true,
+		timeout: 2 * time.Second,
+		retries: 1,
+		bufsize: defaultBufsize,
+		port:    server.port(),
+		conns:   cm,
+	}
+
+	response, err := SendQuery(context.Background(), "example.com.", dns.TypeTXT,
+		[]net.IP{net.ParseIP("127.0.0.1")}, qopts)
+	if err != nil {
+		t.Fatalf("SendQuery() unexpected error: %v", err)
+	}
+	if len(response.Answer) != 1 {
+		t.Errorf("SendQuery() got %d answers, want 1", len(response.Answer))
+	}
+	if n := server.accepted.Load(); n != 2 {
+		t.Errorf("server accepted %d connections, want 2", n)
+	}
+
+	// The failed connection is discarded, so the next query dials anew
+	// and then keeps that connection.
+	for i := 0; i < 2; i++ {
+		if _, err := SendQuery(context.Background(), "example.com.", dns.TypeTXT,
+			[]net.IP{net.ParseIP("127.0.0.1")}, qopts); err != nil {
+			t.Fatalf("SendQuery() unexpected error: %v", err)
+		}
+	}
+	if n := server.accepted.Load(); n != 3 {
+		t.Errorf("server accepted %d connections, want 3", n)
+	}
+}
+
+func TestConnManagerStalledFallback(t *testing.T) {
+	server := newPipelineServer(t, 1, false, true)
+	cm := NewConnManager()
+	defer cm.Close()
+
+	qopts := QueryOptions{
+		tcp:     true,
+		timeout: 300 * time.Millisecond,
+		retries: 1,
+		bufsize: defaultBufsize,
+		port:    server.port(),
+		conns:   cm,
+	}
+
+	// The shared connection never answers, so the query times out on it
+	// and is retried on a fresh connection.
+	response, err := SendQuery(context.Background(), "example.com.", dns.TypeTXT,
+		[]net.IP{net.ParseIP("127.0.0.1")}, qopts)
+	if err != nil {
+		t.Fatalf("SendQuery() unexpected error: %v", err)
+	}
+	if len(response.Answer) != 1 {
+		t.Errorf("SendQuery() got %d answers, want 1", len(response.Answer))
+	}
+	if n := server.accepted.Load(); n != 2 {
+		t.Errorf("server accepted %d connections, want 2", n)
+	}
+}
+
+func TestQuestionMatches(t *testing.T) {
+	q := dns.Question{Name: "Example.COM.", Qtype: dns.TypeSOA, Qclass: dns.ClassINET}
+	if !questionMatches(q, dns.Question{Name: "example.com.", Qtype: dns.TypeSOA, Qclass: dns.ClassINET}) {
+		t.Error("questionMatches() should ignore case")
+	}
+	if questionMatches(q, dns.Question{Name: "example.com.", Qtype: dns.TypeNS, Qclass: dns.ClassINET}) {
+		t.Error("questionMatches() should compare qtype")
+	}
+	if questionMatches(q, dns.Question{Name: "example.net.", Qtype: dns.TypeSOA, Qclass: dns.ClassINET}) {
+		t.Error("questionMatches() should compare qname")
+	}
+}
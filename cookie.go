@@ -0,0 +1,134 @@
+package main
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"net"
+	"strings"
+	"sync"
+
+	"github.com/miekg/dns"
+)
+
+// Cookie lengths in octets (RFC 7873, Section 4)
+const (
+	clientCookieLen    = 8
+	minServerCookieLen = 8
+	maxServerCookieLen = 32
+)
+
+// CookieJar - the DNS cookies (RFC 7873) used with each server address:
+// the client cookie, derived from a secret of the run and the server
+// address, and the last server cookie the server returned
+type CookieJar struct {
+	secret []byte
+	mu     sync.Mutex
+	server map[string]string
+}
+
+// NewCookieJar creates a cookie jar with a new random secret
+func NewCookieJar() *CookieJar {
+	secret := make([]byte, 16)
+	rand.Read(secret)
+	return &CookieJar{
+		secret: secret,
+		server: make(map[string]string),
+	}
+}
+
+// clientCookie returns the hex encoded client cookie for a server
+// address, which is the same for all queries to it in the run.
+func (j *CookieJar) clientCookie(ip net.IP) string {
+	mac := hmac.New(sha256.New, j.secret)
+	mac.Write(ip.To16())
+	return hex.EncodeToString(mac.Sum(nil)[:clientCookieLen])
+}
+
+// cookie returns the hex encoded cookie to send to a server address:
+// the client cookie, followed by the server cookie, if one is known.
+func (j *CookieJar) cookie(ip net.IP) string {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	return j.clientCookie(ip) + j.server[ip.String()]
+}
+
+// CookieInfo - the DNS cookies exchanged with a server
+type CookieInfo struct {
+	Client   string `json:"client"`
+	Server   string `json:"server,omitempty"`
+	Valid    bool   `json:"valid"`
+	Retried  bool   `json:"badcookie_retry,omitempty"`
+	Accepted *bool  `json:"accepted,omitempty"`
+	Changed  *bool  `json:"server_cookie_changed,omitempty"`
+}
+
+// update records the server cookie in a response to a query sent to ip,
+// if it is valid: 8 to 32 octets long and returned with the client
+// cookie that was sent (RFC 7873, Section 5.3), and returns the cookies
+// exchanged.
+func (j *CookieJar) update(ip net.IP, response *dns.Msg) *CookieInfo {
+
+	info := &CookieInfo{Client: j.clientCookie(ip)}
+
+	opt := response.IsEdns0()
+	if opt == nil {
+		return info
+	}
+	for _, o := range opt.Option {
+		c, ok := o.(*dns.EDNS0_COOKIE)
+		if !ok {
+			continue
+		}
+		cookie := strings.ToLower(c.Cookie)
+		if !strings.HasPrefix(cookie, info.Client) {
+			info.Server = cookie
+			return info
+		}
+		info.Server = cookie[len(info.Client):]
+		n := len(info.Server) / 2
+		info.Valid = n >= minServerCookieLen && n <= maxServerCookieLen
+	}
+	if info.Valid {
+		j.mu.Lock()
+		j.server[ip.String()] = info.Server
+		j.mu.Unlock()
+	}
+	return info
+}
+
+// checkCookie sends another SOA query to the server address ip, with
+// the server cookie it returned in info, and records in info whether
+// the server accepted it and returned a valid server cookie again, and
+// if so, whether that server cookie differs from the first one.
+func (rn *Runner) checkCookie(ctx context.Context, zone string, ip net.IP, opts Options, info *CookieInfo) {
+	result, err := getSerial(ctx, zone, ip, opts)
+	accepted := err == nil && result.cookie != nil && result.cookie.Valid && !result.cookie.Retried
+	info.Accepted = &accepted
+	if accepted {
+		changed := result.cookie.Server != info.Server
+		info.Changed = &changed
+	}
+}
+
+// note returns a note on the server's cookie support for the text
+// output, or an empty string if it is as expected.
+func (c *CookieInfo) note() string {
+	switch {
+	case c == nil:
+		return ""
+	case c.Server == "":
+		return "[no server cookie]"
+	case !c.Valid:
+		return "[invalid server cookie]"
+	case c.Retried:
+		return "[BADCOOKIE->retry]"
+	case c.Accepted != nil && !*c.Accepted:
+		return "[server cookie rejected]"
+	case c.Changed != nil && *c.Changed:
+		return "[server cookie changed]"
+	}
+	return ""
+}
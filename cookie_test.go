@@ -0,0 +1,205 @@
+package main
+
+import (
+	"context"
+	"net"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+// cookieHandler answers SOA queries for example.com., returning the
+// client cookie of each query followed by serverCookie. If enforce is
+// set, queries without the server cookie get BADCOOKIE responses. It
+// counts the queries it receives.
+func cookieHandler(serverCookie string, enforce bool, count *atomic.Int32) dns.Handler {
+	return dns.HandlerFunc(func(w dns.ResponseWriter, r *dns.Msg) {
+		count.Add(1)
+		m := new(dns.Msg)
+		m.SetReply(r)
+
+		var cookie string
+		if qopt := r.IsEdns0(); qopt != nil {
+			for _, o := range qopt.Option {
+				if c, ok := o.(*dns.EDNS0_COOKIE); ok {
+					cookie = c.Cookie
+				}
+			}
+		}
+		opt := new(dns.OPT)
+		opt.Hdr.Name = "."
+		opt.Hdr.Rrtype = dns.TypeOPT
+		opt.SetUDPSize(1232)
+		if cookie != "" && serverCookie != "" {
+			opt.Option = []dns.EDNS0{&dns.EDNS0_COOKIE{Code: dns.EDNS0COOKIE,
+				Cookie: cookie[:2*clientCookieLen] + serverCookie}}
+		}
+		m.Extra = []dns.RR{opt}
+
+		if enforce && !strings.HasSuffix(cookie, serverCookie) {
+			m.Rcode = dns.RcodeBadCookie
+		} else {
+			m.Answer = []dns.RR{&dns.SOA{Hdr: dns.RR_Header{Name: r.Question[0].Name,
+				Rrtype: dns.TypeSOA, Class: dns.ClassINET, Ttl: 3600},
+				Ns: "ns1.example.com.", Mbox: "admin.example.com.", Serial: 2024010100}}
+		}
+		w.WriteMsg(m)
+	})
+}
+
+func TestGetSerialCookies(t *testing.T) {
+	tests := []struct {
+		name         string
+		serverCookie string
+		enforce      bool
+		valid        bool
+		retried      bool
+		queries      int32
+		note         string
+	}{
+		{"server cookie", "0123456789abcdef", false, true, false, 1, ""},
+		{"enforced cookies", "0123456789abcdef", true, true, true, 2, "[BADCOOKIE->retry]"},
+		{"no server cookie", "", false, false, false, 1, "[no server cookie]"},
+		{"short server cookie", "01234567", false, false, false, 1, "[invalid server cookie]"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var count atomic.Int32
+			server := newMockDNSServer(t, cookieHandler(tt.serverCookie, tt.enforce, &count))
+			defer server.close()
+			<-server.ready
+			host, port, _ := net.SplitHostPort(server.udpAddr)
+			ip := net.ParseIP(host)
+
+			jar := NewCookieJar()
+			opts := Options{
+				Qopts: QueryOptions{
+					timeout: 2 * time.Second,
+					retries: 1,
+					bufsize: defaultBufsize,
+					port:    port,
+					cookies: jar,
+				},
+			}
+			result, err := getSerial(context.Background(), "example.com.", ip, opts)
+			if err != nil {
+				t.Fatalf("getSerial() returned error: %v", err)
+			}
+			c := result.cookie
+			if c == nil {
+				t.Fatal("getSerial() returned no cookie information")
+			}
+			if c.Client != jar.clientCookie(ip) || c.Valid != tt.valid || c.Retried != tt.retried {
+				t.Errorf("cookie = %+v, want valid %v retried %v", c, tt.valid, tt.retried)
+			}
+			if n := count.Load(); n != tt.queries {
+				t.Errorf("server received %d queries, want %d", n, tt.queries)
+			}
+			if note := c.note(); note != tt.note {
+				t.Errorf("note() = %q, want %q", note, tt.note)
+			}
+			// A valid server cookie is sent back in later queries
+			want := jar.clientCookie(ip)
+			if tt.valid {
+				want += tt.serverCookie
+			}
+			if cookie := jar.cookie(ip); cookie != want {
+				t.Errorf("cookie() = %s, want %s", cookie, want)
+			}
+		})
+	}
+}
+
+func TestClientCookie(t *testing.T) {
+	jar := NewCookieJar()
+	ip1, ip2 := net.ParseIP("192.0.2.1"), net.ParseIP("192.0.2.2")
+
+	c1 := jar.clientCookie(ip1)
+	if len(c1) != 2*clientCookieLen {
+		t.Errorf("clientCookie() = %s, want %d octets", c1, clientCookieLen)
+	}
+	if jar.clientCookie(ip1) != c1 {
+		t.Error("clientCookie() differs between calls for the same server")
+	}
+	if jar.clientCookie(ip2) == c1 {
+		t.Error("clientCookie() is the same for different servers")
+	}
+	if NewCookieJar().clientCookie(ip1) == c1 {
+		t.Error("clientCookie() is the same for different jars")
+	}
+}
+
+func TestRunCookies(t *testing.T) {
+	var count atomic.Int32
+	server := newMockDNSServer(t, cookieHandler("0123456789abcdef", true, &count))
+	defer server.close()
+	<-server.ready
+	host, port, _ := net.SplitHostPort(server.udpAddr)
+
+	rn := NewRunner()
+	opts := Options{
+		noqueryns:  true,
+		additional: host,
+		cookie:     true,
+		json:       true,
+		Qopts: QueryOptions{
+			timeout: 2 * time.Second,
+			retries: 1,
+			bufsize: defaultBufsize,
+			port:    port,
+		},
+	}
+	status, message := rn.run(context.Background(), "example.com.", opts)
+	if status != 0 {
+		t.Fatalf("run() status = %d, want 0; message = %q", status, message)
+	}
+	c := rn.output.Responses[0].Cookie
+	if c == nil || !c.Valid || c.Accepted == nil || !*c.Accepted ||
+		c.Changed == nil || *c.Changed {
+		t.Errorf("response cookie = %+v, want valid, accepted and unchanged", c)
+	}
+}
+
+func TestRunCookiesChanged(t *testing.T) {
+	// The server returns a new server cookie from the second query on
+	var count, queries atomic.Int32
+	handlers := []dns.Handler{
+		cookieHandler("0123456789abcdef", false, &count),
+		cookieHandler("fedcba9876543210", false, &count),
+	}
+	server := newMockDNSServer(t, dns.HandlerFunc(func(w dns.ResponseWriter, r *dns.Msg) {
+		handlers[min(int(queries.Add(1))-1, 1)].ServeDNS(w, r)
+	}))
+	defer server.close()
+	<-server.ready
+	host, port, _ := net.SplitHostPort(server.udpAddr)
+
+	rn := NewRunner()
+	opts := Options{
+		noqueryns:  true,
+		additional: host,
+		cookie:     true,
+		json:       true,
+		Qopts: QueryOptions{
+			timeout: 2 * time.Second,
+			retries: 1,
+			bufsize: defaultBufsize,
+			port:    port,
+		},
+	}
+	status, message := rn.run(context.Background(), "example.com.", opts)
+	if status != 0 {
+		t.Fatalf("run() status = %d, want 0; message = %q", status, message)
+	}
+	c := rn.output.Responses[0].Cookie
+	if c == nil || c.Accepted == nil || !*c.Accepted || c.Changed == nil || !*c.Changed {
+		t.Errorf("response cookie = %+v, want accepted and changed", c)
+	}
+	if note := c.note(); note != "[server cookie changed]" {
+		t.Errorf("note() = %q, want [server cookie changed]", note)
+	}
+}
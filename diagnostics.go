@@ -0,0 +1,53 @@
+package main
+
+import (
+	"github.com/miekg/dns"
+)
+
+// Diagnostics - transport level details of the query to a server and of
+// its response, for troubleshooting
+type Diagnostics struct {
+	Transport string    `json:"transport"`
+	Attempts  int       `json:"attempts"`
+	Truncated bool      `json:"truncated"`
+	Size      int       `json:"size,omitempty"`
+	EDNS      *EDNSInfo `json:"edns,omitempty"`
+	AA        bool      `json:"aa"`
+	TC        bool      `json:"tc"`
+	RA        bool      `json:"ra"`
+	Rcode     string    `json:"rcode,omitempty"`
+}
+
+// EDNSInfo - the EDNS parameters of a response (RFC 6891)
+type EDNSInfo struct {
+	Version uint8  `json:"version"`
+	UDPSize uint16 `json:"udpsize"`
+}
+
+// newDiagnostics collects the diagnostics for a query carried out as
+// described by info. The response may be nil if the query failed, in
+// which case only the transport details are filled in.
+func newDiagnostics(info *QueryInfo, response *dns.Msg) *Diagnostics {
+
+	d := &Diagnostics{
+		Transport: info.transport,
+		Attempts:  info.attempts,
+		Truncated: info.truncated,
+	}
+	if response == nil {
+		return d
+	}
+
+	d.Size = response.Len()
+	d.AA = response.Authoritative
+	d.TC = response.Truncated
+	d.RA = response.RecursionAvailable
+	d.Rcode = dns.RcodeToString[response.Rcode]
+	if opt := response.IsEdns0(); opt != nil {
+		d.EDNS = &EDNSInfo{
+			Version: opt.Version(),
+			UDPSize: opt.UDPSize(),
+		}
+	}
+	return d
+}
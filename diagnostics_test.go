@@ -0,0 +1,62 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/miekg/dns"
+)
+
+func TestNewDiagnostics(t *testing.T) {
+	t.Run("failed query", func(t *testing.T) {
+		info := &QueryInfo{transport: "udp", attempts: 3, timeouts: 3}
+		d := newDiagnostics(info, nil)
+		if d.Transport != "udp" || d.Attempts != 3 {
+			t.Errorf("newDiagnostics() = %+v, want udp transport and 3 attempts", d)
+		}
+		if d.Size != 0 || d.EDNS != nil || d.Rcode != "" {
+			t.Errorf("newDiagnostics() has response details without a response: %+v", d)
+		}
+	})
+
+	t.Run("response with EDNS", func(t *testing.T) {
+		query := new(dns.Msg)
+		query.SetQuestion("example.com.", dns.TypeSOA)
+		response := new(dns.Msg)
+		response.SetReply(query)
+		response.Authoritative = true
+		response.SetEdns0(1232, false)
+
+		info := &QueryInfo{transport: "tcp", attempts: 2, truncated: true, tcpFallback: true}
+		d := newDiagnostics(info, response)
+		if d.Transport != "tcp" || d.Attempts != 2 || !d.Truncated {
+			t.Errorf("newDiagnostics() transport details = %+v", d)
+		}
+		if !d.AA || d.TC || d.RA {
+			t.Errorf("newDiagnostics() flags aa %v tc %v ra %v, want aa only", d.AA, d.TC, d.RA)
+		}
+		if d.Rcode != "NOERROR" {
+			t.Errorf("newDiagnostics() rcode = %q, want NOERROR", d.Rcode)
+		}
+		if d.Size != response.Len() {
+			t.Errorf("newDiagnostics() size = %d, want %d", d.Size, response.Len())
+		}
+		if d.EDNS == nil || d.EDNS.Version != 0 || d.EDNS.UDPSize != 1232 {
+			t.Errorf("newDiagnostics() edns = %+v, want version 0 udpsize 1232", d.EDNS)
+		}
+	})
+
+	t.Run("response without EDNS", func(t *testing.T) {
+		query := new(dns.Msg)
+		query.SetQuestion("example.com.", dns.TypeSOA)
+		response := new(dns.Msg)
+		response.SetRcode(query, dns.RcodeRefused)
+
+		d := newDiagnostics(&QueryInfo{transport: "udp", attempts: 1}, response)
+		if d.EDNS != nil {
+			t.Errorf("newDiagnostics() edns = %+v, want nil", d.EDNS)
+		}
+		if d.Rcode != "REFUSED" {
+			t.Errorf("newDiagnostics() rcode = %q, want REFUSED", d.Rcode)
+		}
+	})
+}
@@ -0,0 +1,280 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"net"
+	"net/netip"
+	"os"
+	"slices"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// Prefix lengths of the networks that addresses are considered to share
+// a point of failure in
+const (
+	diversityPrefix4 = 24
+	diversityPrefix6 = 48
+)
+
+// diversityMetrics are the metrics of a Diversity report that the
+// -divpolicy minimums apply to
+var diversityMetrics = []string{"names", "addresses", "ipv6", "prefixes", "asns"}
+
+// ASNEntry - an address prefix and its origin AS number
+type ASNEntry struct {
+	prefix netip.Prefix
+	asn    uint32
+}
+
+// ASNTable - address prefix to origin AS mappings, read from -asnfile
+type ASNTable []ASNEntry
+
+// LoadASNTable reads address prefix to origin AS mappings from a file.
+// Each line has a CIDR prefix and an AS number, with or without an "AS"
+// prefix. Blank lines and lines starting with '#' are ignored.
+func LoadASNTable(filename string) (ASNTable, error) {
+
+	var table ASNTable
+
+	f, err := os.Open(filename)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	scanner := bufio.NewScanner(f)
+	lineno := 0
+	for scanner.Scan() {
+		lineno++
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		entry, err := parseASNEntry(strings.Fields(line))
+		if err != nil {
+			return nil, fmt.Errorf("%s:%d: %s", filename, lineno, err.Error())
+		}
+		table = append(table, entry)
+	}
+	return table, scanner.Err()
+}
+
+// parseASNEntry parses the fields of an ASN table line: the prefix, and
+// its origin AS number.
+func parseASNEntry(fields []string) (ASNEntry, error) {
+
+	var entry ASNEntry
+	var err error
+
+	if len(fields) != 2 {
+		return entry, fmt.Errorf("want <prefix> <asn>")
+	}
+	entry.prefix, err = netip.ParsePrefix(fields[0])
+	if err != nil {
+		return entry, fmt.Errorf("invalid prefix %q", fields[0])
+	}
+	entry.prefix = entry.prefix.Masked()
+	asn := strings.TrimPrefix(strings.ToUpper(fields[1]), "AS")
+	n, err := strconv.ParseUint(asn, 10, 32)
+	if err != nil {
+		return entry, fmt.Errorf("invalid AS number %q", fields[1])
+	}
+	entry.asn = uint32(n)
+	return entry, nil
+}
+
+// lookup returns the origin AS number of the longest prefix in the table
+// that contains ip, and false if there is none.
+func (t ASNTable) lookup(ip net.IP) (uint32, bool) {
+
+	addr, ok := netip.AddrFromSlice(ip)
+	if !ok {
+		return 0, false
+	}
+	addr = addr.Unmap()
+
+	var asn uint32
+	bits := -1
+	for _, e := range t {
+		if e.prefix.Bits() > bits && e.prefix.Contains(addr) {
+			asn, bits = e.asn, e.prefix.Bits()
+		}
+	}
+	return asn, bits >= 0
+}
+
+// Diversity - the resilience of the nameserver set of a zone: how many
+// names and addresses it has, how many names have IPv6 addresses, and
+// how many distinct networks and origin ASes the addresses are in
+type Diversity struct {
+	Names        int      `json:"names"`
+	Addresses    int      `json:"addresses"`
+	IPv4         int      `json:"ipv4_addresses"`
+	IPv6         int      `json:"ipv6_addresses"`
+	IPv6Names    int      `json:"ipv6_names"`
+	Prefixes     int      `json:"prefixes"`
+	SharedPrefix int      `json:"shared_prefix_addresses"`
+	ASNs         []uint32 `json:"asns,omitempty"`
+	NoASN        int      `json:"no_asn_addresses,omitempty"`
+	Failed       []string `json:"policy_failed,omitempty"`
+}
+
+// parseDiversityPolicy parses a -divpolicy specification, a comma
+// separated list of metric=N minimums.
+func parseDiversityPolicy(s string) (map[string]int, error) {
+
+	policy := make(map[string]int)
+	if s == "" {
+		return policy, nil
+	}
+
+	for _, item := range strings.Split(s, ",") {
+		metric, value, ok := strings.Cut(strings.TrimSpace(item), "=")
+		if !ok {
+			return nil, fmt.Errorf("invalid policy %q: want metric=N", item)
+		}
+		if !slices.Contains(diversityMetrics, metric) {
+			return nil, fmt.Errorf("unknown metric %q: want one of %s",
+				metric, strings.Join(diversityMetrics, ", "))
+		}
+		minimum, err := strconv.Atoi(value)
+		if err != nil || minimum < 0 {
+			return nil, fmt.Errorf("invalid minimum for %s: %q", metric, value)
+		}
+		policy[metric] = minimum
+	}
+	return policy, nil
+}
+
+// diversityPrefix returns the /24 or /48 network of ip.
+func diversityPrefix(ip net.IP) string {
+	if ip4 := ip.To4(); ip4 != nil {
+		return ip4.Mask(net.CIDRMask(diversityPrefix4, 32)).String() + "/24"
+	}
+	return ip.Mask(net.CIDRMask(diversityPrefix6, 128)).String() + "/48"
+}
+
+// diversityRequests returns the requests to report the diversity of:
+// the requests to be queried, or, if -4, -6 or a source set of one
+// family leaves out the addresses of the other family, the requests
+// for the addresses of both families, so that the report doesn't depend
+// on the query filter.
+func diversityRequests(ctx context.Context, nsNameList []string, requests []*Request, opts *Options) []*Request {
+
+	if !opts.V4Only && !opts.V6Only {
+		return requests
+	}
+	dopts := *opts
+	dopts.V4Only, dopts.V6Only = false, false
+	return getRequests(ctx, nsNameList, &dopts)
+}
+
+// checkDiversity reports the resilience of the nameserver set given by
+// requests, and checks it against the minimums in policy. The origin
+// ASes are only counted if an ASN table is given.
+func checkDiversity(requests []*Request, asns ASNTable, policy map[string]int) *Diversity {
+
+	d := new(Diversity)
+	names := make(map[string]bool)
+	ipv6Names := make(map[string]bool)
+	addresses := make(map[string]bool)
+	prefixes := make(map[string]int)
+	asnSet := make(map[uint32]bool)
+
+	for _, r := range requests {
+		names[r.nsname] = true
+		if r.nsip.To4() == nil {
+			ipv6Names[r.nsname] = true
+		}
+		if addresses[r.nsip.String()] {
+			continue
+		}
+		addresses[r.nsip.String()] = true
+		if r.nsip.To4() != nil {
+			d.IPv4++
+		} else {
+			d.IPv6++
+		}
+		prefixes[diversityPrefix(r.nsip)]++
+		if asns != nil {
+			if asn, ok := asns.lookup(r.nsip); ok {
+				asnSet[asn] = true
+			} else {
+				d.NoASN++
+			}
+		}
+	}
+
+	d.Names = len(names)
+	d.Addresses = len(addresses)
+	d.IPv6Names = len(ipv6Names)
+	d.Prefixes = len(prefixes)
+	for _, n := range prefixes {
+		if n > 1 {
+			d.SharedPrefix += n
+		}
+	}
+	for asn := range asnSet {
+		d.ASNs = append(d.ASNs, asn)
+	}
+	sort.Slice(d.ASNs, func(i, j int) bool { return d.ASNs[i] < d.ASNs[j] })
+
+	for _, metric := range diversityMetrics {
+		if minimum, ok := policy[metric]; ok && d.value(metric) < minimum {
+			d.Failed = append(d.Failed, fmt.Sprintf("%s %d < %d", metric, d.value(metric), minimum))
+		}
+	}
+	return d
+}
+
+// value returns the value of a diversity metric.
+func (d *Diversity) value(metric string) int {
+	switch metric {
+	case "names":
+		return d.Names
+	case "addresses":
+		return d.Addresses
+	case "ipv6":
+		return d.IPv6Names
+	case "prefixes":
+		return d.Prefixes
+	case "asns":
+		return len(d.ASNs)
+	}
+	return 0
+}
+
+// status returns the exit status for the report: 7 if the nameserver
+// set doesn't meet the policy, and 0 otherwise.
+func (d *Diversity) status() int {
+	if d == nil || d.Failed == nil {
+		return 0
+	}
+	return 7
+}
+
+func printDiversity(d *Diversity, asns ASNTable, opts *Options) {
+
+	if opts.json || d == nil {
+		return
+	}
+	fmt.Printf("## diversity: %d names, %d addresses (%d IPv4, %d IPv6), %d of %d names with IPv6\n",
+		d.Names, d.Addresses, d.IPv4, d.IPv6, d.IPv6Names, d.Names)
+	fmt.Printf("## diversity: %d distinct /24 and /48 prefixes, %d addresses sharing one\n",
+		d.Prefixes, d.SharedPrefix)
+	if asns != nil {
+		s := make([]string, len(d.ASNs))
+		for i, asn := range d.ASNs {
+			s[i] = fmt.Sprintf("AS%d", asn)
+		}
+		fmt.Printf("## diversity: %d origin ASNs %s, %d addresses without one\n",
+			len(d.ASNs), strings.Join(s, " "), d.NoASN)
+	}
+	if d.Failed != nil {
+		fmt.Printf("## diversity: policy not met: %s\n", strings.Join(d.Failed, ", "))
+	}
+}
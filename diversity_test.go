@@ -0,0 +1,242 @@
+package main
+
+import (
+	"context"
+	"net"
+	"net/netip"
+	"os"
+	"path/filepath"
+	"slices"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestLoadASNTable(t *testing.T) {
+	dir := t.TempDir()
+	fname := filepath.Join(dir, "asn")
+	content := `# provider A
+192.0.2.0/24      64500
+192.0.2.128/25    AS64501
+
+2001:db8::/32     as64502
+`
+	if err := os.WriteFile(fname, []byte(content), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	table, err := LoadASNTable(fname)
+	if err != nil {
+		t.Fatalf("LoadASNTable() unexpected error: %v", err)
+	}
+	if len(table) != 3 {
+		t.Fatalf("LoadASNTable() got %d entries, want 3", len(table))
+	}
+
+	tests := []struct {
+		ip    string
+		asn   uint32
+		found bool
+	}{
+		{"192.0.2.1", 64500, true},
+		{"192.0.2.200", 64501, true}, // longest prefix wins
+		{"2001:db8::53", 64502, true},
+		{"198.51.100.1", 0, false},
+	}
+	for _, tt := range tests {
+		asn, found := table.lookup(net.ParseIP(tt.ip))
+		if asn != tt.asn || found != tt.found {
+			t.Errorf("lookup(%s) = %d, %v, want %d, %v", tt.ip, asn, found, tt.asn, tt.found)
+		}
+	}
+
+	for _, bad := range []string{"192.0.2.0/24\n", "192.0.2.0/33 64500\n", "192.0.2.0/24 ASX\n"} {
+		if err := os.WriteFile(fname, []byte(bad), 0644); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := LoadASNTable(fname); err == nil {
+			t.Errorf("LoadASNTable(%q) expected error", bad)
+		}
+	}
+}
+
+func TestParseDiversityPolicy(t *testing.T) {
+	policy, err := parseDiversityPolicy("names=2, ipv6=1,asns=2")
+	if err != nil {
+		t.Fatalf("parseDiversityPolicy() unexpected error: %v", err)
+	}
+	if len(policy) != 3 || policy["names"] != 2 || policy["ipv6"] != 1 || policy["asns"] != 2 {
+		t.Errorf("parseDiversityPolicy() = %v", policy)
+	}
+	for _, bad := range []string{"names", "servers=2", "names=-1", "names=x"} {
+		if _, err := parseDiversityPolicy(bad); err == nil {
+			t.Errorf("parseDiversityPolicy(%q) expected error", bad)
+		}
+	}
+}
+
+func TestCheckDiversity(t *testing.T) {
+	request := func(name, ip string) *Request {
+		return &Request{nsname: name, nsip: net.ParseIP(ip)}
+	}
+	requests := []*Request{
+		request("ns1.example.com.", "192.0.2.1"),
+		request("ns1.example.com.", "2001:db8:1::1"),
+		request("ns2.example.com.", "192.0.2.2"),
+		request("ns3.example.net.", "198.51.100.1"),
+		request("ns3.example.net.", "2001:db8:1::3"),
+	}
+	asns := ASNTable{
+		{prefix: netip.MustParsePrefix("192.0.2.0/24"), asn: 64500},
+		{prefix: netip.MustParsePrefix("2001:db8::/32"), asn: 64500},
+	}
+
+	tests := []struct {
+		name   string
+		asns   ASNTable
+		policy map[string]int
+		failed []string
+	}{
+		{"no policy", nil, nil, nil},
+		{"policy met", asns, map[string]int{"names": 3, "ipv6": 2, "prefixes": 3, "asns": 1}, nil},
+		{"policy not met", asns, map[string]int{"addresses": 6, "prefixes": 4, "asns": 2},
+			[]string{"addresses 5 < 6", "prefixes 3 < 4", "asns 1 < 2"}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			d := checkDiversity(requests, tt.asns, tt.policy)
+			if d.Names != 3 || d.Addresses != 5 || d.IPv4 != 3 || d.IPv6 != 2 || d.IPv6Names != 2 {
+				t.Errorf("checkDiversity() counts = %+v", d)
+			}
+			// 192.0.2.1 and .2 share a /24, the IPv6 addresses a /48
+			if d.Prefixes != 3 || d.SharedPrefix != 4 {
+				t.Errorf("Prefixes = %d, SharedPrefix = %d, want 3 and 4", d.Prefixes, d.SharedPrefix)
+			}
+			if tt.asns != nil && (!slices.Equal(d.ASNs, []uint32{64500}) || d.NoASN != 1) {
+				t.Errorf("ASNs = %v, NoASN = %d, want [64500] and 1", d.ASNs, d.NoASN)
+			}
+			if !slices.Equal(d.Failed, tt.failed) {
+				t.Errorf("Failed = %v, want %v", d.Failed, tt.failed)
+			}
+			if want := map[bool]int{false: 0, true: 7}[tt.failed != nil]; d.status() != want {
+				t.Errorf("status() = %d, want %d", d.status(), want)
+			}
+		})
+	}
+}
+
+func TestCheckDiversitySharedAddress(t *testing.T) {
+	// ns2 shares its only IPv6 address with ns1, but still has one
+	requests := []*Request{
+		{nsname: "ns1.example.com.", nsip: net.ParseIP("2001:db8:1::1")},
+		{nsname: "ns2.example.com.", nsip: net.ParseIP("2001:db8:1::1")},
+		{nsname: "ns2.example.com.", nsip: net.ParseIP("192.0.2.2")},
+	}
+	d := checkDiversity(requests, nil, map[string]int{"ipv6": 2})
+	if d.Names != 2 || d.Addresses != 2 || d.IPv6 != 1 || d.IPv6Names != 2 {
+		t.Errorf("checkDiversity() counts = %+v", d)
+	}
+	if d.Failed != nil {
+		t.Errorf("Failed = %v, want none", d.Failed)
+	}
+}
+
+func TestRunDiversity(t *testing.T) {
+	serials := map[string]uint32{"example.com.": 2024010100}
+
+	tests := []struct {
+		name   string
+		policy map[string]int
+		status int
+	}{
+		{"report only", nil, 0},
+		{"addresses in one /24", map[string]int{"prefixes": 2}, 7},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			port := newLoopbackServers(t, serials, 0)
+
+			rn := NewRunner()
+			opts := Options{
+				noqueryns:  true,
+				additional: "127.0.0.1,127.0.0.2",
+				json:       true,
+				diversity:  true,
+				divpolicy:  tt.policy,
+				Qopts: QueryOptions{
+					timeout: 2 * time.Second,
+					retries: 1,
+					bufsize: defaultBufsize,
+					port:    port,
+				},
+			}
+			status, message := rn.run(context.Background(), "example.com.", opts)
+			if status != tt.status {
+				t.Errorf("run() status = %d, want %d; message = %q", status, tt.status, message)
+			}
+			d := rn.output.Diversity
+			if d == nil || d.Addresses != 2 || d.Prefixes != 1 {
+				t.Errorf("run() diversity = %+v, want 2 addresses in 1 prefix", d)
+			}
+		})
+	}
+}
+
+func TestDiversityRequests(t *testing.T) {
+	var count atomic.Int32
+	server := newMockDNSServer(t, addressMockHandler(&count))
+	defer server.close()
+	<-server.ready
+	host, port, _ := net.SplitHostPort(server.udpAddr)
+
+	opts := &Options{
+		resolvers: NewResolverConfig(Resolver{ip: net.ParseIP(host)}),
+		V4Only:    true,
+		Qopts: QueryOptions{
+			timeout: 2 * time.Second,
+			retries: 1,
+			bufsize: defaultBufsize,
+			port:    port,
+		},
+	}
+	nsNames := []string{"ns1.example.com."}
+	requests := getRequests(context.Background(), nsNames, opts)
+	if len(requests) != 1 {
+		t.Fatalf("getRequests() with -4 returned %d requests, want 1", len(requests))
+	}
+
+	d := checkDiversity(diversityRequests(context.Background(), nsNames, requests, opts),
+		nil, map[string]int{"ipv6": 1})
+	if d.Addresses != 2 || d.IPv6 != 1 || d.IPv6Names != 1 || d.Failed != nil {
+		t.Errorf("checkDiversity() with -4 = %+v, want both families counted", d)
+	}
+	if !opts.V4Only {
+		t.Error("diversityRequests() changed the query filter")
+	}
+}
+
+func TestRunDiversityOutranksRTT(t *testing.T) {
+	_, port := newMockDNSServerSamePort(t, slowHandler(soaMockHandler(2024010100), 5*time.Millisecond))
+
+	rn := NewRunner()
+	opts := Options{
+		noqueryns:  true,
+		additional: "127.0.0.1",
+		json:       true,
+		diversity:  true,
+		divpolicy:  map[string]int{"names": 2},
+		rttwarn:    1,
+		Qopts: QueryOptions{
+			timeout: 2 * time.Second,
+			retries: 1,
+			bufsize: defaultBufsize,
+			port:    port,
+		},
+	}
+	status, message := rn.run(context.Background(), "example.com.", opts)
+	if status != 7 {
+		t.Errorf("run() status = %d, want 7; message = %q", status, message)
+	}
+}
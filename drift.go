@@ -0,0 +1,160 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"net"
+	"net/netip"
+	"os"
+	"strconv"
+	"strings"
+
+	"github.com/miekg/dns"
+)
+
+// DriftRule - an allowed serial drift for a nameserver name, address or
+// address prefix
+type DriftRule struct {
+	name   string
+	prefix netip.Prefix
+	drift  int
+	text   string
+}
+
+// DriftOverrides - per server allowed drift rules, in file order
+type DriftOverrides []DriftRule
+
+// LoadDriftOverrides reads per server allowed drift rules from a file.
+// Each line has a nameserver name, IP address or CIDR prefix, and the
+// allowed drift for it. Blank lines and lines starting with '#' are
+// ignored.
+func LoadDriftOverrides(filename string) (DriftOverrides, error) {
+
+	var overrides DriftOverrides
+
+	f, err := os.Open(filename)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	scanner := bufio.NewScanner(f)
+	lineno := 0
+	for scanner.Scan() {
+		lineno++
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		rule, err := parseDriftRule(strings.Fields(line))
+		if err != nil {
+			return nil, fmt.Errorf("%s:%d: %s", filename, lineno, err.Error())
+		}
+		overrides = append(overrides, rule)
+	}
+	return overrides, scanner.Err()
+}
+
+// parseDriftRule parses the fields of a drift rule: the server
+// specification, and the allowed drift.
+func parseDriftRule(fields []string) (DriftRule, error) {
+
+	var rule DriftRule
+	var err error
+
+	if len(fields) != 2 {
+		return rule, fmt.Errorf("want <name|address|prefix> <drift>")
+	}
+	rule.text = fields[0]
+	rule.drift, err = strconv.Atoi(fields[1])
+	if err != nil || rule.drift < 0 {
+		return rule, fmt.Errorf("invalid drift %q", fields[1])
+	}
+
+	if strings.Contains(fields[0], "/") {
+		rule.prefix, err = netip.ParsePrefix(fields[0])
+		if err != nil {
+			return rule, fmt.Errorf("invalid prefix %q", fields[0])
+		}
+		rule.prefix = rule.prefix.Masked()
+	} else if addr, err := netip.ParseAddr(fields[0]); err == nil {
+		rule.prefix = netip.PrefixFrom(addr, addr.BitLen())
+	} else {
+		rule.name = dns.CanonicalName(fields[0])
+	}
+	return rule, nil
+}
+
+// lookup returns the first rule matching the nameserver name or address
+func (d DriftOverrides) lookup(nsname string, ip net.IP) (DriftRule, bool) {
+
+	addr, _ := netip.AddrFromSlice(ip)
+	addr = addr.Unmap()
+
+	for _, rule := range d {
+		if rule.name != "" {
+			if rule.name == dns.CanonicalName(nsname) {
+				return rule, true
+			}
+		} else if addr.IsValid() && rule.prefix.Contains(addr) {
+			return rule, true
+		}
+	}
+	return DriftRule{}, false
+}
+
+// tolerance returns the allowed serial drift for a server, and the
+// override rule that set it, if any; otherwise, the -d drift applies.
+func (opts *Options) tolerance(nsname string, ip net.IP) (int, string) {
+	if rule, ok := opts.driftOverrides.lookup(nsname, ip); ok {
+		return rule.drift, rule.text
+	}
+	return opts.delta, ""
+}
+
+// withinTolerance reports whether all the serials are within the allowed
+// drift of the reference serial.
+func withinTolerance(reference uint32, serials []uint32, drift int) bool {
+	for _, s := range serials {
+		if serialDistance(reference, s) > uint32(drift) {
+			return false
+		}
+	}
+	return true
+}
+
+// serials returns the serials seen at a server: that of its response,
+// and those of its anycast instances, if probed.
+func (r *Response) serials() []uint32 {
+	serials := []uint32{r.Serial}
+	if r.Anycast != nil {
+		serials = append(serials, r.Anycast.serials()...)
+	}
+	if r.Reach != nil {
+		serials = append(serials, r.Reach.serials()...)
+	}
+	return serials
+}
+
+// driftExceeded reports whether the serials differ by more than allowed.
+// The serials of servers without an override (and the master's) must be
+// within the -d drift of each other, as before; those of servers with an
+// override must be within its drift of the reference serial: the
+// master's, or if there is no master, the most recent serial seen.
+func (rn *Runner) driftExceeded(defaultSerials []uint32, overridden []*Response, opts *Options) bool {
+
+	if maxSerialDrift(defaultSerials) > uint32(opts.delta) {
+		return true
+	}
+
+	reference := currentSerial(rn.serialList)
+	if opts.masterIP != nil {
+		reference = opts.masterSerial
+	}
+	for _, r := range overridden {
+		if !withinTolerance(reference, r.serials(), r.Tolerance) {
+			return true
+		}
+	}
+	return false
+}
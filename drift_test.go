@@ -0,0 +1,124 @@
+package main
+
+import (
+	"context"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestLoadDriftOverrides(t *testing.T) {
+	dir := t.TempDir()
+	fname := filepath.Join(dir, "drift")
+	content := `# slow third party provider
+NS1.ThirdParty.NET   10
+192.0.2.53           5
+
+2001:db8::/32        20
+198.51.100.7/24      30
+`
+	if err := os.WriteFile(fname, []byte(content), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	overrides, err := LoadDriftOverrides(fname)
+	if err != nil {
+		t.Fatalf("LoadDriftOverrides() unexpected error: %v", err)
+	}
+	if len(overrides) != 4 {
+		t.Fatalf("LoadDriftOverrides() got %d rules, want 4", len(overrides))
+	}
+
+	tests := []struct {
+		name      string
+		nsname    string
+		ip        string
+		wantDrift int
+		wantRule  string
+		wantMatch bool
+	}{
+		{"name ignores case", "ns1.thirdparty.net.", "203.0.113.1", 10, "NS1.ThirdParty.NET", true},
+		{"address", "ns2.example.com.", "192.0.2.53", 5, "192.0.2.53", true},
+		{"other address", "ns2.example.com.", "192.0.2.54", 0, "", false},
+		{"IPv6 prefix", "ns3.example.com.", "2001:db8::53", 20, "2001:db8::/32", true},
+		{"masked IPv4 prefix", "ns4.example.com.", "198.51.100.200", 30, "198.51.100.7/24", true},
+		{"IPv4-mapped address", "ns5.example.com.", "::ffff:192.0.2.53", 5, "192.0.2.53", true},
+		{"no match", "ns6.example.com.", "203.0.113.1", 0, "", false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			rule, ok := overrides.lookup(tt.nsname, net.ParseIP(tt.ip))
+			if ok != tt.wantMatch || rule.drift != tt.wantDrift || rule.text != tt.wantRule {
+				t.Errorf("lookup(%s, %s) = %d %q %v, want %d %q %v", tt.nsname, tt.ip,
+					rule.drift, rule.text, ok, tt.wantDrift, tt.wantRule, tt.wantMatch)
+			}
+		})
+	}
+
+	for _, bad := range []string{"ns1.example.com.\n", "ns1.example.com. x\n",
+		"ns1.example.com. -1\n", "192.0.2.0/33 5\n"} {
+		if err := os.WriteFile(fname, []byte(bad), 0644); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := LoadDriftOverrides(fname); err == nil {
+			t.Errorf("LoadDriftOverrides() expected error for %q", bad)
+		}
+	}
+}
+
+func TestRunDriftOverrides(t *testing.T) {
+	serials := map[string]uint32{"example.com.": 2024010110}
+
+	tests := []struct {
+		name  string
+		rules [][]string
+		want  int
+		drift int
+	}{
+		{"no overrides", nil, 1, 0},
+		{"lagging server allowed", [][]string{{"127.0.0.2", "10"}}, 0, 10},
+		{"lagging server allowed by prefix", [][]string{{"127.0.0.2/31", "5"}}, 0, 5},
+		{"lagging server not allowed enough", [][]string{{"127.0.0.2", "3"}}, 1, 3},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			port := newLoopbackServers(t, serials, 5)
+
+			var overrides DriftOverrides
+			for _, fields := range tt.rules {
+				rule, err := parseDriftRule(fields)
+				if err != nil {
+					t.Fatalf("parseDriftRule(%v) unexpected error: %v", fields, err)
+				}
+				overrides = append(overrides, rule)
+			}
+
+			rn := NewRunner()
+			opts := Options{
+				noqueryns:      true,
+				additional:     "127.0.0.1,127.0.0.2",
+				json:           true,
+				driftOverrides: overrides,
+				Qopts: QueryOptions{
+					timeout: 2 * time.Second,
+					retries: 1,
+					bufsize: defaultBufsize,
+					port:    port,
+				},
+			}
+			status, message := rn.run(context.Background(), "example.com.", opts)
+			if status != tt.want {
+				t.Errorf("run() status = %d, want %d; message = %q", status, tt.want, message)
+			}
+			for _, r := range rn.output.Responses {
+				if r.Nsip == "127.0.0.2" && r.Tolerance != tt.drift {
+					t.Errorf("127.0.0.2 tolerance = %d, want %d", r.Tolerance, tt.drift)
+				}
+			}
+		})
+	}
+}
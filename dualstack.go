@@ -0,0 +1,146 @@
+package main
+
+import (
+	"fmt"
+	"slices"
+	"strings"
+)
+
+// DualStack - the comparison of the IPv4 and IPv6 addresses of a
+// nameserver name: the serials and the NSIDs and identities returned
+// over each address family, and the differences between them
+type DualStack struct {
+	Name        string   `json:"name"`
+	IPv4Serials []uint32 `json:"ipv4_serials,omitempty"`
+	IPv6Serials []uint32 `json:"ipv6_serials,omitempty"`
+	Problems    []string `json:"problems,omitempty"`
+}
+
+// familyResponses - what the addresses of one family of a name returned
+type familyResponses struct {
+	serials    []uint32
+	nsids      []string
+	identities []string
+	answered   bool
+	failed     bool
+}
+
+// add records a response in the family's results, keeping the serials,
+// NSIDs and identities sorted and without duplicates.
+func (f *familyResponses) add(r Response) {
+	if r.err != nil {
+		f.failed = true
+		return
+	}
+	f.answered = true
+	f.serials = sortedInsert(f.serials, r.Serial)
+	if r.Nsid != "" {
+		f.nsids = sortedInsert(f.nsids, r.Nsid)
+	}
+	if r.Identity != "" {
+		f.identities = sortedInsert(f.identities, r.Identity)
+	}
+}
+
+func sortedInsert[T string | uint32](list []T, v T) []T {
+	i, found := slices.BinarySearch(list, v)
+	if found {
+		return list
+	}
+	return slices.Insert(list, i, v)
+}
+
+// checkDualStack compares the responses from the IPv4 and the IPv6
+// addresses of the nameserver name, and returns nil if the name doesn't
+// have addresses of both families. The families differ if they return
+// different serials, NSIDs or identities, or if the addresses of one
+// family fail while those of the other all answer.
+func checkDualStack(name string, responses []Response) *DualStack {
+
+	var v4, v6 familyResponses
+
+	for _, r := range responses {
+		if r.ip == nil {
+			continue
+		}
+		if r.ip.To4() != nil {
+			v4.add(r)
+		} else {
+			v6.add(r)
+		}
+	}
+	if !(v4.answered || v4.failed) || !(v6.answered || v6.failed) {
+		return nil
+	}
+
+	ds := &DualStack{
+		Name:        name,
+		IPv4Serials: v4.serials,
+		IPv6Serials: v6.serials,
+	}
+	if v4.answered && v6.answered {
+		if !slices.Equal(v4.serials, v6.serials) {
+			ds.Problems = append(ds.Problems, "serial")
+		}
+		if v4.nsids != nil && v6.nsids != nil && !slices.Equal(v4.nsids, v6.nsids) {
+			ds.Problems = append(ds.Problems, "nsid")
+		}
+		if v4.identities != nil && v6.identities != nil &&
+			!slices.Equal(v4.identities, v6.identities) {
+			ds.Problems = append(ds.Problems, "identity")
+		}
+	}
+	if v4.failed && !v6.failed {
+		ds.Problems = append(ds.Problems, "ipv4_failed")
+	}
+	if v6.failed && !v4.failed {
+		ds.Problems = append(ds.Problems, "ipv6_failed")
+	}
+	return ds
+}
+
+// String returns a summary of the differences between the families,
+// or "ok" if there are none.
+func (ds *DualStack) String() string {
+
+	var s []string
+
+	for _, p := range ds.Problems {
+		switch p {
+		case "serial":
+			s = append(s, fmt.Sprintf("serial differs (ipv4 %s, ipv6 %s)",
+				joinSerials(ds.IPv4Serials), joinSerials(ds.IPv6Serials)))
+		case "nsid":
+			s = append(s, "nsid differs")
+		case "identity":
+			s = append(s, "identity differs")
+		case "ipv4_failed":
+			s = append(s, "ipv4 failed")
+		case "ipv6_failed":
+			s = append(s, "ipv6 failed")
+		}
+	}
+	if s == nil {
+		return "ok"
+	}
+	return strings.Join(s, "; ")
+}
+
+func joinSerials(serials []uint32) string {
+	if serials == nil {
+		return "none"
+	}
+	s := make([]string, len(serials))
+	for i, serial := range serials {
+		s[i] = fmt.Sprint(serial)
+	}
+	return strings.Join(s, ",")
+}
+
+func printDualStack(ds *DualStack, opts *Options) {
+
+	if opts.json || ds == nil {
+		return
+	}
+	fmt.Printf("%15s   dualstack %s: %s\n", "", ds.Name, ds.String())
+}
@@ -0,0 +1,63 @@
+package main
+
+import (
+	"errors"
+	"net"
+	"slices"
+	"testing"
+)
+
+func TestCheckDualStack(t *testing.T) {
+	v4 := func(serial uint32, nsid string) Response {
+		return Response{ip: net.ParseIP("192.0.2.1"), Serial: serial, Nsid: nsid}
+	}
+	v6 := func(serial uint32, nsid string) Response {
+		return Response{ip: net.ParseIP("2001:db8::1"), Serial: serial, Nsid: nsid}
+	}
+	failed := func(r Response) Response {
+		r.err = errors.New("timeout")
+		return r
+	}
+
+	tests := []struct {
+		name      string
+		responses []Response
+		problems  []string
+		summary   string
+	}{
+		{"ipv4 only", []Response{v4(100, ""), v4(100, "")}, nil, ""},
+		{"same serial", []Response{v4(100, "a"), v6(100, "a")}, nil, "ok"},
+		{"serial differs", []Response{v4(101, ""), v6(100, "")}, []string{"serial"},
+			"serial differs (ipv4 101, ipv6 100)"},
+		{"nsid differs", []Response{v4(100, "a"), v6(100, "b")}, []string{"nsid"}, "nsid differs"},
+		{"nsid on one family", []Response{v4(100, "a"), v6(100, "")}, nil, "ok"},
+		{"identity differs", []Response{{ip: net.ParseIP("192.0.2.1"), Serial: 100, Identity: "x"},
+			{ip: net.ParseIP("2001:db8::1"), Serial: 100, Identity: "y"}}, []string{"identity"},
+			"identity differs"},
+		{"ipv6 failed", []Response{v4(100, ""), failed(v6(0, ""))}, []string{"ipv6_failed"}, "ipv6 failed"},
+		{"ipv4 partly failed", []Response{v4(100, ""), failed(v4(0, "")), v6(100, "")},
+			[]string{"ipv4_failed"}, "ipv4 failed"},
+		{"both failed", []Response{failed(v4(0, "")), failed(v6(0, ""))}, nil, "ok"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ds := checkDualStack("ns1.example.com.", tt.responses)
+			if tt.summary == "" {
+				if ds != nil {
+					t.Errorf("checkDualStack() = %+v, want nil", ds)
+				}
+				return
+			}
+			if ds == nil {
+				t.Fatal("checkDualStack() returned nil")
+			}
+			if !slices.Equal(ds.Problems, tt.problems) {
+				t.Errorf("Problems = %v, want %v", ds.Problems, tt.problems)
+			}
+			if s := ds.String(); s != tt.summary {
+				t.Errorf("String() = %q, want %q", s, tt.summary)
+			}
+		})
+	}
+}
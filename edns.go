@@ -0,0 +1,195 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"strings"
+
+	"github.com/miekg/dns"
+)
+
+// ednsUnknownOption and ednsUnknownFlag are an unassigned EDNS option
+// code and an unassigned EDNS flag, which servers must ignore and not
+// echo back (RFC 6891, Sections 6.1.2 and 6.1.4)
+const (
+	ednsUnknownOption = 100
+	ednsUnknownFlag   = 0x0080
+)
+
+// ednsProbe - an EDNS compliance test query, after the ISC EDNS
+// compliance tests
+type ednsProbe struct {
+	name    string
+	edns    bool
+	version uint8
+	option  bool   // include an unknown option
+	flag    bool   // set an unknown EDNS flag
+	do      bool   // set the DO flag
+	bufsize uint16 // advertised UDP buffer size
+}
+
+// ednsProbes are the EDNS compliance tests sent to each server
+var ednsProbes = []ednsProbe{
+	{name: "dns"},
+	{name: "edns", edns: true, bufsize: 1232},
+	{name: "edns1", edns: true, version: 1, bufsize: 1232},
+	{name: "edns@512", edns: true, bufsize: 512},
+	{name: "edns@4096", edns: true, bufsize: 4096},
+	{name: "ednsopt", edns: true, option: true, bufsize: 1232},
+	{name: "edns1opt", edns: true, version: 1, option: true, bufsize: 1232},
+	{name: "do", edns: true, do: true, bufsize: 1232},
+	{name: "ednsflags", edns: true, flag: true, bufsize: 1232},
+}
+
+// EDNSTest - the outcome of an EDNS compliance test: "ok", or the
+// problems seen, such as "timeout", "noopt" or "badversion"
+type EDNSTest struct {
+	Name   string `json:"name"`
+	Result string `json:"result"`
+}
+
+// EDNSReport - the outcome of the EDNS compliance tests of a server
+type EDNSReport struct {
+	Tests  []EDNSTest `json:"tests"`
+	Failed int        `json:"failed"`
+}
+
+// query returns the SOA query for zone with the probe's EDNS settings.
+func (p ednsProbe) query(zone string, qopts QueryOptions) *dns.Msg {
+
+	qopts.tsig = nil
+	qopts.bufsize = p.bufsize
+	m := MakeQuery(zone, dns.TypeSOA, qopts)
+	if !p.edns {
+		m.Extra = nil
+		return m
+	}
+
+	opt := m.IsEdns0()
+	opt.SetVersion(p.version)
+	opt.SetDo(p.do)
+	if p.flag {
+		opt.SetZ(ednsUnknownFlag)
+	}
+	if p.option {
+		opt.Option = append(opt.Option, &dns.EDNS0_LOCAL{Code: ednsUnknownOption})
+	}
+	return m
+}
+
+// check returns the problems with a response to the probe, according
+// to RFC 6891, or "ok" if there are none.
+func (p ednsProbe) check(response *dns.Msg) string {
+
+	var problems []string
+
+	wantRcode := dns.RcodeSuccess
+	if p.version > 0 {
+		wantRcode = dns.RcodeBadVers
+	}
+	if response.Rcode != wantRcode {
+		problems = append(problems, strings.ToLower(dns.RcodeToString[response.Rcode]))
+	}
+
+	hasSOA := false
+	for _, rr := range response.Answer {
+		if rr.Header().Rrtype == dns.TypeSOA {
+			hasSOA = true
+		}
+	}
+	if wantRcode == dns.RcodeSuccess && !hasSOA && !response.Truncated {
+		problems = append(problems, "nosoa")
+	}
+	if p.version > 0 && hasSOA {
+		problems = append(problems, "soa")
+	}
+
+	opt := response.IsEdns0()
+	switch {
+	case !p.edns && opt != nil:
+		problems = append(problems, "opt")
+	case p.edns && opt == nil:
+		problems = append(problems, "noopt")
+	case p.edns:
+		if opt.Version() != 0 {
+			problems = append(problems, "badversion")
+		}
+		if p.flag && opt.Z()&ednsUnknownFlag != 0 {
+			problems = append(problems, "flag")
+		}
+		if p.do && !opt.Do() {
+			problems = append(problems, "nodo")
+		}
+		for _, o := range opt.Option {
+			if o.Option() == ednsUnknownOption {
+				problems = append(problems, "echoed")
+			}
+		}
+	}
+
+	if size := response.Len(); p.edns && size > int(max(p.bufsize, 512)) {
+		problems = append(problems, "toolarge")
+	} else if !p.edns && size > 512 {
+		problems = append(problems, "toolarge")
+	}
+
+	if problems == nil {
+		return "ok"
+	}
+	return strings.Join(problems, ",")
+}
+
+// checkEDNS sends the EDNS compliance test queries for zone to the
+// server address ip over UDP, each sent once, and reports the outcome.
+func (rn *Runner) checkEDNS(ctx context.Context, zone string, ip net.IP, opts Options) *EDNSReport {
+
+	report := new(EDNSReport)
+	qopts := Endpoint{transport: "udp"}.queryOptions(opts.Qopts)
+	qopts.retries = 1
+
+	for _, p := range ednsProbes {
+		test := EDNSTest{Name: p.name}
+		response, err := sendQueryUDP(ctx, p.query(zone, qopts), []net.IP{ip}, qopts, new(QueryInfo))
+
+		switch err := classifyError(err); {
+		case err != nil:
+			test.Result = errorCode(err)
+		case response == nil:
+			test.Result = "noresponse"
+		default:
+			test.Result = p.check(response)
+		}
+		if test.Result != "ok" {
+			report.Failed++
+		}
+		report.Tests = append(report.Tests, test)
+	}
+	return report
+}
+
+// String returns the test outcomes as name=result pairs.
+func (r *EDNSReport) String() string {
+	var results []string
+	for _, t := range r.Tests {
+		results = append(results, t.Name+"="+t.Result)
+	}
+	return strings.Join(results, " ")
+}
+
+// note returns a note on the server's EDNS compliance for the text
+// output, or an empty string if it passed all the tests.
+func (r *EDNSReport) note() string {
+	if r == nil || r.Failed == 0 {
+		return ""
+	}
+	return fmt.Sprintf("[EDNS: %d of %d tests failed]", r.Failed, len(r.Tests))
+}
+
+func printEDNS(r *EDNSReport, opts *Options) {
+
+	if opts.json || r == nil {
+		return
+	}
+	fmt.Printf("%15s   edns: %s\n", "", r.String())
+}
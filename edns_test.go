@@ -0,0 +1,127 @@
+package main
+
+import (
+	"context"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+// ednsHandler answers SOA queries for example.com. as an EDNS compliant
+// server does, unless drop is set, when it drops queries with EDNS, or
+// echo is set, when it copies the OPT record of the query, unknown
+// version, options and flags included, into a NOERROR response.
+func ednsHandler(drop, echo bool) dns.Handler {
+	return dns.HandlerFunc(func(w dns.ResponseWriter, r *dns.Msg) {
+		qopt := r.IsEdns0()
+		if qopt != nil && drop {
+			return
+		}
+		m := new(dns.Msg)
+		m.SetReply(r)
+		soa := &dns.SOA{Hdr: dns.RR_Header{Name: r.Question[0].Name, Rrtype: dns.TypeSOA,
+			Class: dns.ClassINET, Ttl: 3600}, Ns: "ns1.example.com.",
+			Mbox: "admin.example.com.", Serial: 2024010100}
+
+		switch {
+		case qopt == nil:
+			m.Answer = []dns.RR{soa}
+		case echo:
+			m.Answer = []dns.RR{soa}
+			m.Extra = []dns.RR{qopt}
+		default:
+			opt := new(dns.OPT)
+			opt.Hdr.Name = "."
+			opt.Hdr.Rrtype = dns.TypeOPT
+			opt.SetUDPSize(1232)
+			opt.SetDo(qopt.Do())
+			m.Extra = []dns.RR{opt}
+			if qopt.Version() != 0 {
+				m.Rcode = dns.RcodeBadVers
+			} else {
+				m.Answer = []dns.RR{soa}
+			}
+		}
+		w.WriteMsg(m)
+	})
+}
+
+func TestCheckEDNS(t *testing.T) {
+	tests := []struct {
+		name     string
+		drop     bool
+		echo     bool
+		failed   int
+		expected map[string]string
+	}{
+		{"compliant", false, false, 0, map[string]string{
+			"dns": "ok", "edns": "ok", "edns1": "ok", "ednsopt": "ok",
+			"edns1opt": "ok", "do": "ok", "ednsflags": "ok"}},
+		{"drops EDNS queries", true, false, len(ednsProbes) - 1, map[string]string{
+			"dns": "ok", "edns": "timeout", "edns1": "timeout"}},
+		{"echoes OPT", false, true, 4, map[string]string{
+			"edns": "ok", "edns1": "noerror,soa,badversion", "ednsopt": "echoed",
+			"edns1opt": "noerror,soa,badversion,echoed", "ednsflags": "flag"}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			server := newMockDNSServer(t, ednsHandler(tt.drop, tt.echo))
+			defer server.close()
+			<-server.ready
+			host, port, _ := net.SplitHostPort(server.udpAddr)
+
+			rn := NewRunner()
+			opts := Options{
+				Qopts: QueryOptions{
+					timeout: 100 * time.Millisecond,
+					retries: 3,
+					bufsize: defaultBufsize,
+					port:    port,
+				},
+			}
+			report := rn.checkEDNS(context.Background(), "example.com.", net.ParseIP(host), opts)
+
+			if len(report.Tests) != len(ednsProbes) {
+				t.Fatalf("checkEDNS() ran %d tests, want %d", len(report.Tests), len(ednsProbes))
+			}
+			results := make(map[string]string)
+			for _, test := range report.Tests {
+				results[test.Name] = test.Result
+			}
+			for name, want := range tt.expected {
+				if results[name] != want {
+					t.Errorf("test %s = %q, want %q", name, results[name], want)
+				}
+			}
+			if report.Failed != tt.failed {
+				t.Errorf("Failed = %d, want %d (%s)", report.Failed, tt.failed, report)
+			}
+			if (report.note() == "") != (tt.failed == 0) {
+				t.Errorf("note() = %q with %d failed tests", report.note(), tt.failed)
+			}
+		})
+	}
+}
+
+func TestEDNSProbeQuery(t *testing.T) {
+	qopts := QueryOptions{bufsize: defaultBufsize, tsig: &TSIGKey{}}
+
+	m := ednsProbe{name: "dns"}.query("example.com.", qopts)
+	if m.IsEdns0() != nil || len(m.Extra) != 0 {
+		t.Errorf("dns probe query has EDNS: %v", m.Extra)
+	}
+
+	p := ednsProbe{name: "edns1opt", edns: true, version: 1, option: true, flag: true, do: true, bufsize: 512}
+	opt := p.query("example.com.", qopts).IsEdns0()
+	if opt == nil {
+		t.Fatal("edns1opt probe query has no OPT record")
+	}
+	if opt.Version() != 1 || opt.UDPSize() != 512 || !opt.Do() ||
+		opt.Z()&ednsUnknownFlag == 0 || len(opt.Option) != 1 ||
+		opt.Option[0].Option() != ednsUnknownOption {
+		t.Errorf("edns1opt probe OPT = %s", opt)
+	}
+}
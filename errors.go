@@ -0,0 +1,209 @@
+package main
+
+import (
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"syscall"
+
+	"github.com/miekg/dns"
+)
+
+// Error classes for failed queries. Errors from getSerial and SendQuery
+// wrap one of these, so they can be tested with errors.Is, and the class
+// name is reported as the error_code in the json output.
+var (
+	errTimeout     = errors.New("timeout")
+	errRefused     = errors.New("refused")
+	errServfail    = errors.New("servfail")
+	errNXDomain    = errors.New("nxdomain")
+	errLame        = errors.New("lame")
+	errNoSOA       = errors.New("no-soa")
+	errUnreachable = errors.New("network-unreachable")
+	errTSIG        = errors.New("tsig-failure")
+	errTLS         = errors.New("tls-failure")
+)
+
+// errorClasses - all error classes, including errCancelled
+var errorClasses = []error{
+	errTimeout, errRefused, errServfail, errNXDomain, errLame, errNoSOA,
+	errUnreachable, errTSIG, errTLS, errCancelled,
+}
+
+// errOther is the error code of errors that fit none of the classes
+const errOther = "other"
+
+// QueryError - an error of a known class. The message is that of the
+// underlying error.
+type QueryError struct {
+	class error
+	err   error
+}
+
+func (e *QueryError) Error() string {
+	return e.err.Error()
+}
+
+// Unwrap returns both the class and the underlying error, so that
+// errors.Is and errors.As match either.
+func (e *QueryError) Unwrap() []error {
+	return []error{e.class, e.err}
+}
+
+// newQueryError returns err as an error of the given class
+func newQueryError(class error, err error) error {
+	return &QueryError{class: class, err: err}
+}
+
+// classifyError assigns a class to an error from a DNS exchange, if it
+// doesn't have one yet and its class can be recognized.
+func classifyError(err error) error {
+
+	if err == nil || errorCode(err) != errOther {
+		return err
+	}
+
+	var netErr net.Error
+	var alertErr tls.AlertError
+	var recordErr tls.RecordHeaderError
+	var certErr *tls.CertificateVerificationError
+
+	switch {
+	case errors.Is(err, os.ErrDeadlineExceeded):
+		return newQueryError(errTimeout, err)
+	case errors.As(err, &netErr) && netErr.Timeout():
+		return newQueryError(errTimeout, err)
+	case errors.Is(err, syscall.ENETUNREACH), errors.Is(err, syscall.EHOSTUNREACH),
+		errors.Is(err, syscall.ECONNREFUSED):
+		return newQueryError(errUnreachable, err)
+	case errors.As(err, &alertErr), errors.As(err, &recordErr), errors.As(err, &certErr):
+		return newQueryError(errTLS, err)
+	case errors.Is(err, dns.ErrSig), errors.Is(err, dns.ErrTime),
+		errors.Is(err, dns.ErrKey), errors.Is(err, dns.ErrSecret),
+		errors.Is(err, dns.ErrAuth), errors.Is(err, dns.ErrNoSig):
+		return newQueryError(errTSIG, err)
+	}
+	return err
+}
+
+// rcodeError returns the error for a response with a failure rcode
+func rcodeError(rcode int, zone string) error {
+
+	switch rcode {
+	case dns.RcodeNameError:
+		return newQueryError(errNXDomain,
+			fmt.Errorf("NXDOMAIN: %s: name doesn't exist", zone))
+	case dns.RcodeRefused:
+		return newQueryError(errRefused,
+			fmt.Errorf("response code: %s", dns.RcodeToString[rcode]))
+	case dns.RcodeServerFailure:
+		return newQueryError(errServfail,
+			fmt.Errorf("response code: %s", dns.RcodeToString[rcode]))
+	case dns.RcodeBadSig, dns.RcodeBadKey, dns.RcodeBadTime:
+		return newQueryError(errTSIG,
+			fmt.Errorf("response code: %s", dns.RcodeToString[rcode]))
+	}
+	return fmt.Errorf("response code: %s", dns.RcodeToString[rcode])
+}
+
+// errorCode returns the error class name of err, or "other"
+func errorCode(err error) string {
+	for _, class := range errorClasses {
+		if errors.Is(err, class) {
+			return class.Error()
+		}
+	}
+	return errOther
+}
+
+// parseErrorStatus parses an exit status policy of the form
+// "class=N,class=N,...", mapping error classes to the exit status that
+// servers failing with them cause.
+func parseErrorStatus(s string) (map[string]int, error) {
+
+	policy := make(map[string]int)
+	if s == "" {
+		return policy, nil
+	}
+
+	valid := map[string]bool{errOther: true}
+	for _, class := range errorClasses {
+		valid[class.Error()] = true
+	}
+
+	for _, item := range strings.Split(s, ",") {
+		class, value, ok := strings.Cut(strings.TrimSpace(item), "=")
+		if !ok {
+			return nil, fmt.Errorf("invalid error status %q: want class=N", item)
+		}
+		if !valid[class] {
+			names := make([]string, 0, len(valid))
+			for name := range valid {
+				names = append(names, name)
+			}
+			sort.Strings(names)
+			return nil, fmt.Errorf("unknown error class %q: want one of %s",
+				class, strings.Join(names, ", "))
+		}
+		status, err := strconv.Atoi(value)
+		if err != nil || status < 0 || status > 3 {
+			return nil, fmt.Errorf("invalid exit status for %s: %q: want 0-3", class, value)
+		}
+		policy[class] = status
+	}
+	return policy, nil
+}
+
+// errorStatus returns the exit status for a server that failed with err,
+// according to the -errstatus policy; 2 by default.
+func (opts *Options) errorStatus(err error) int {
+	if status, ok := opts.errstatus[errorCode(err)]; ok {
+		return status
+	}
+	return 2
+}
+
+// EDE - an Extended DNS Error (RFC 8914) attached to a response
+type EDE struct {
+	Code uint16 `json:"code"`
+	Name string `json:"name,omitempty"`
+	Text string `json:"text,omitempty"`
+}
+
+func newEDE(o *dns.EDNS0_EDE) EDE {
+	return EDE{
+		Code: o.InfoCode,
+		Name: dns.ExtendedErrorCodeToString[o.InfoCode],
+		Text: o.ExtraText,
+	}
+}
+
+func (e EDE) String() string {
+	s := fmt.Sprintf("EDE %d", e.Code)
+	if e.Name != "" {
+		s += " " + e.Name
+	}
+	if e.Text != "" {
+		s += ": " + e.Text
+	}
+	return s
+}
+
+// edeString formats a list of extended errors for the text output,
+// preceded by prefix, or returns an empty string if there are none.
+func edeString(edes []EDE, prefix string) string {
+
+	if len(edes) == 0 {
+		return ""
+	}
+	var parts []string
+	for _, e := range edes {
+		parts = append(parts, "["+e.String()+"]")
+	}
+	return prefix + strings.Join(parts, " ")
+}
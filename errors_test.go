@@ -0,0 +1,283 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+func TestErrorCode(t *testing.T) {
+	tests := []struct {
+		name string
+		err  error
+		want string
+	}{
+		{"query error", newQueryError(errRefused, errors.New("response code: REFUSED")), "refused"},
+		{"wrapped query error", fmt.Errorf("ns1: %w", newQueryError(errLame, errors.New("lame"))), "lame"},
+		{"cancelled", fmt.Errorf("%w: deadline", errCancelled), "cancelled"},
+		{"unclassified", errors.New("something else"), "other"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := errorCode(tt.err); got != tt.want {
+				t.Errorf("errorCode() = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestClassifyError(t *testing.T) {
+	tests := []struct {
+		name  string
+		err   error
+		class error
+	}{
+		{"deadline exceeded", fmt.Errorf("read udp: %w", os.ErrDeadlineExceeded), errTimeout},
+		{"network unreachable", &net.OpError{Op: "dial", Err: syscall.ENETUNREACH}, errUnreachable},
+		{"connection refused", &net.OpError{Op: "read", Err: syscall.ECONNREFUSED}, errUnreachable},
+		{"bad TSIG signature", dns.ErrSig, errTSIG},
+		{"already classified", newQueryError(errNoSOA, errors.New("no SOA")), errNoSOA},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := classifyError(tt.err)
+			if !errors.Is(err, tt.class) {
+				t.Errorf("classifyError(%v) is not %v", tt.err, tt.class)
+			}
+			if err.Error() != tt.err.Error() {
+				t.Errorf("classifyError() message = %q, want %q", err.Error(), tt.err.Error())
+			}
+		})
+	}
+
+	if classifyError(nil) != nil {
+		t.Error("classifyError(nil) should be nil")
+	}
+	other := errors.New("something else")
+	if classifyError(other) != other {
+		t.Error("classifyError() should leave unrecognized errors alone")
+	}
+}
+
+// classHandler answers SOA queries with the given rcode and AA flag,
+// including the SOA record if withSOA is set, and doesn't answer at all
+// if drop is set.
+func classHandler(rcode int, aa, withSOA, drop bool) dns.Handler {
+	return dns.HandlerFunc(func(w dns.ResponseWriter, r *dns.Msg) {
+		if drop {
+			return
+		}
+		m := new(dns.Msg)
+		m.SetRcode(r, rcode)
+		m.Authoritative = aa
+		if withSOA {
+			m.Answer = []dns.RR{
+				&dns.SOA{
+					Hdr: dns.RR_Header{
+						Name:   r.Question[0].Name,
+						Rrtype: dns.TypeSOA,
+						Class:  dns.ClassINET,
+						Ttl:    3600,
+					},
+					Ns:     "ns1.example.com.",
+					Mbox:   "admin.example.com.",
+					Serial: 2024010100,
+				},
+			}
+		}
+		w.WriteMsg(m)
+	})
+}
+
+func TestGetSerialErrorClasses(t *testing.T) {
+	tests := []struct {
+		name    string
+		handler dns.Handler
+		class   error
+	}{
+		{"refused", classHandler(dns.RcodeRefused, false, false, false), errRefused},
+		{"servfail", classHandler(dns.RcodeServerFailure, false, false, false), errServfail},
+		{"nxdomain", classHandler(dns.RcodeNameError, true, false, false), errNXDomain},
+		{"lame", classHandler(dns.RcodeSuccess, false, false, false), errLame},
+		{"no SOA", classHandler(dns.RcodeSuccess, true, false, false), errNoSOA},
+		{"timeout", classHandler(dns.RcodeSuccess, true, true, true), errTimeout},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			server := newMockDNSServer(t, tt.handler)
+			defer server.close()
+			host, port, _ := net.SplitHostPort(server.udpAddr)
+
+			opts := Options{
+				Qopts: QueryOptions{
+					timeout: 200 * time.Millisecond,
+					retries: 1,
+					bufsize: defaultBufsize,
+					port:    port,
+				},
+			}
+			_, err := getSerial(context.Background(), "example.com.", net.ParseIP(host), opts)
+			if !errors.Is(err, tt.class) {
+				t.Errorf("getSerial() error = %v, want class %v", err, tt.class)
+			}
+			if errorCode(err) != tt.class.Error() {
+				t.Errorf("errorCode() = %q, want %q", errorCode(err), tt.class.Error())
+			}
+		})
+	}
+}
+
+func TestParseErrorStatus(t *testing.T) {
+	tests := []struct {
+		name    string
+		input   string
+		want    map[string]int
+		wantErr bool
+	}{
+		{"empty", "", map[string]int{}, false},
+		{"single", "timeout=1", map[string]int{"timeout": 1}, false},
+		{"several", "lame=3, refused=0,other=1", map[string]int{"lame": 3, "refused": 0, "other": 1}, false},
+		{"unknown class", "bogus=1", nil, true},
+		{"missing status", "timeout", nil, true},
+		{"bad status", "timeout=x", nil, true},
+		{"status out of range", "timeout=4", nil, true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := parseErrorStatus(tt.input)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("parseErrorStatus(%q) error = %v, wantErr %v", tt.input, err, tt.wantErr)
+			}
+			if tt.wantErr {
+				return
+			}
+			if len(got) != len(tt.want) {
+				t.Fatalf("parseErrorStatus(%q) = %v, want %v", tt.input, got, tt.want)
+			}
+			for class, status := range tt.want {
+				if got[class] != status {
+					t.Errorf("parseErrorStatus(%q)[%s] = %d, want %d", tt.input, class, got[class], status)
+				}
+			}
+		})
+	}
+}
+
+func TestRunErrorStatusPolicy(t *testing.T) {
+	s1 := newMockDNSServerAt(t, classHandler(dns.RcodeSuccess, true, true, false),
+		"127.0.0.1:0", "127.0.0.1:0")
+	t.Cleanup(s1.close)
+	_, port, _ := net.SplitHostPort(s1.udpAddr)
+	s2 := newMockDNSServerAt(t, classHandler(dns.RcodeRefused, false, false, false),
+		"127.0.0.2:"+port, "127.0.0.2:"+port)
+	t.Cleanup(s2.close)
+
+	tests := []struct {
+		name      string
+		errstatus map[string]int
+		want      int
+	}{
+		{"default", nil, 2},
+		{"class ignored", map[string]int{"refused": 0}, 0},
+		{"class raised", map[string]int{"refused": 3}, 3},
+		{"other class", map[string]int{"timeout": 0}, 2},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			rn := NewRunner()
+			opts := Options{
+				noqueryns:  true,
+				additional: "127.0.0.1,127.0.0.2",
+				errstatus:  tt.errstatus,
+				Qopts: QueryOptions{
+					timeout: 2 * time.Second,
+					retries: 1,
+					bufsize: defaultBufsize,
+					port:    port,
+				},
+			}
+			status, _ := rn.run(context.Background(), "example.com.", opts)
+			if status != tt.want {
+				t.Errorf("run() status = %d, want %d", status, tt.want)
+			}
+			responses := rn.ResponseByName["127.0.0.2"]
+			if len(responses) != 1 || responses[0].ErrCode != "refused" {
+				t.Errorf("127.0.0.2 responses = %+v, want error_code refused", responses)
+			}
+		})
+	}
+}
+
+func TestEDEString(t *testing.T) {
+	tests := []struct {
+		name   string
+		edes   []EDE
+		prefix string
+		want   string
+	}{
+		{"none", nil, " ", ""},
+		{"code only", []EDE{{Code: 20, Name: "Not Authoritative"}}, "", "[EDE 20 Not Authoritative]"},
+		{"with text", []EDE{{Code: 3, Name: "Stale Answer", Text: "upstream down"}}, " ",
+			" [EDE 3 Stale Answer: upstream down]"},
+		{"unknown code", []EDE{{Code: 4242}}, "", "[EDE 4242]"},
+		{"several", []EDE{{Code: 6, Name: "DNSSEC Bogus"}, {Code: 9, Name: "DNSKEY Missing"}}, "",
+			"[EDE 6 DNSSEC Bogus] [EDE 9 DNSKEY Missing]"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := edeString(tt.edes, tt.prefix); got != tt.want {
+				t.Errorf("edeString() = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestGetSerialEDE(t *testing.T) {
+	handler := dns.HandlerFunc(func(w dns.ResponseWriter, r *dns.Msg) {
+		m := new(dns.Msg)
+		m.SetRcode(r, dns.RcodeRefused)
+		m.SetEdns0(1232, false)
+		opt := m.IsEdns0()
+		opt.Option = append(opt.Option, &dns.EDNS0_EDE{
+			InfoCode:  dns.ExtendedErrorCodeNotAuthoritative,
+			ExtraText: "zone not configured",
+		})
+		w.WriteMsg(m)
+	})
+	server := newMockDNSServer(t, handler)
+	defer server.close()
+	host, port, _ := net.SplitHostPort(server.udpAddr)
+
+	opts := Options{
+		Qopts: QueryOptions{
+			timeout: 2 * time.Second,
+			retries: 1,
+			bufsize: defaultBufsize,
+			port:    port,
+		},
+	}
+	result, err := getSerial(context.Background(), "example.com.", net.ParseIP(host), opts)
+	if !errors.Is(err, errRefused) {
+		t.Errorf("getSerial() error = %v, want refused", err)
+	}
+	if len(result.ede) != 1 {
+		t.Fatalf("getSerial() ede = %+v, want 1 entry", result.ede)
+	}
+	want := EDE{Code: 20, Name: "Not Authoritative", Text: "zone not configured"}
+	if result.ede[0] != want {
+		t.Errorf("getSerial() ede = %+v, want %+v", result.ede[0], want)
+	}
+}
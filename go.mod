@@ -4,7 +4,10 @@ go 1.24.0
 
 toolchain go1.24.3
 
-require github.com/miekg/dns v1.1.72
+require (
+	github.com/BurntSushi/toml v1.5.0
+	github.com/miekg/dns v1.1.72
+)
 
 require (
 	golang.org/x/mod v0.31.0 // indirect
@@ -1,16 +1,20 @@
 package main
 
 import (
+	"context"
 	"encoding/hex"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"log"
 	"net"
 	"os"
+	"os/signal"
 	"path"
 	"sort"
 	"strings"
 	"sync"
+	"syscall"
 	"time"
 
 	"github.com/miekg/dns"
@@ -27,48 +31,119 @@ var StatusCode = map[int]string{
 	2: "server issues",
 	3: "master server error",
 	4: "program invocation error",
+	5: "response time warning",
+	6: "response time critical",
+	7: "nameserver diversity below policy",
+	8: "security audit findings",
 }
 
-// Concurrency limit
-const numParallel = 20
+// errCancelled is the error reported for servers whose queries were
+// cancelled or never sent, because the run was interrupted or its
+// deadline (-deadline) was reached.
+var errCancelled = errors.New("cancelled")
+
+// cancelled reports whether the context is done, or about to be because
+// its deadline has passed: a query bounded by the deadline can fail just
+// before the context itself expires.
+func cancelled(ctx context.Context) bool {
+	if ctx.Err() != nil {
+		return true
+	}
+	deadline, ok := ctx.Deadline()
+	return ok && !time.Now().Before(deadline)
+}
+
+// cancelledError returns errCancelled annotated with the reason the
+// context was cancelled.
+func cancelledError(ctx context.Context) error {
+	cause := context.Cause(ctx)
+	if cause == nil {
+		cause = context.DeadlineExceeded
+	}
+	return fmt.Errorf("%w: %s", errCancelled, cause.Error())
+}
 
 // Request - request parameters
 type Request struct {
 	nsname string
 	nsip   net.IP
+	Endpoint
 }
 
 // Response
 type Response struct {
-	Nsname   string `json:"name"`
-	ip       net.IP
-	Nsip     string `json:"ip"`
-	Serial   uint32 `json:"serial"`
-	Delta    *int   `json:"delta,omitempty"`
-	resptime time.Duration
-	Resptime float64 `json:"resptime"`
-	Nsid     string  `json:"nsid,omitempty"`
-	err      error
-	Err      string `json:"error,omitempty"`
+	Nsname    string `json:"name"`
+	ip        net.IP
+	Nsip      string `json:"ip"`
+	endpoint  Endpoint
+	Port      string `json:"port,omitempty"`
+	Transport string `json:"transport,omitempty"`
+	Source    string `json:"source,omitempty"`
+	Serial    uint32 `json:"serial"`
+	Delta     *int   `json:"delta,omitempty"`
+	resptime  time.Duration
+	Resptime  float64 `json:"resptime"`
+	Nsid      string  `json:"nsid,omitempty"`
+	err       error
+	Err       string `json:"error,omitempty"`
+	ErrCode   string `json:"error_code,omitempty"`
+
+	Truncated   bool   `json:"truncated,omitempty"`
+	TCPFallback bool   `json:"tcp_fallback,omitempty"`
+	Retries     int    `json:"retries,omitempty"`
+	Loss        string `json:"udp_loss,omitempty"`
+	RRL         string `json:"rrl_suspected,omitempty"`
+	EDE         []EDE  `json:"ede,omitempty"`
+	Identity    string `json:"identity,omitempty"`
+	Version     string `json:"version,omitempty"`
+	RTTStatus   string `json:"rtt_status,omitempty"`
+
+	Tolerance     int    `json:"tolerance"`
+	ToleranceRule string `json:"tolerance_rule,omitempty"`
+
+	Stats       *ProbeStats    `json:"stats,omitempty"`
+	Anycast     *AnycastResult `json:"anycast,omitempty"`
+	Reach       *Reachability  `json:"reachability,omitempty"`
+	EDNS        *EDNSReport    `json:"edns_compliance,omitempty"`
+	Cookie      *CookieInfo    `json:"cookie,omitempty"`
+	Audit       *AuditReport   `json:"audit,omitempty"`
+	Transfer    *ZoneTransfer  `json:"transfer,omitempty"`
+	Diagnostics *Diagnostics   `json:"diagnostics,omitempty"`
 }
 
 // Master Server
 type Master struct {
-	Name     string  `json:"name"`
-	IP       string  `json:"ip"`
-	Serial   uint32  `json:"serial"`
-	Resptime float64 `json:"resptime"`
-	Err      string  `json:"error,omitempty"`
+	Name      string  `json:"name"`
+	IP        string  `json:"ip"`
+	Port      string  `json:"port,omitempty"`
+	Transport string  `json:"transport,omitempty"`
+	Source    string  `json:"source,omitempty"`
+	Serial    uint32  `json:"serial"`
+	Resptime  float64 `json:"resptime"`
+	Err       string  `json:"error,omitempty"`
+	ErrCode   string  `json:"error_code,omitempty"`
+	EDE       []EDE   `json:"ede,omitempty"`
+
+	Transfer    *ZoneTransfer `json:"transfer,omitempty"`
+	Diagnostics *Diagnostics  `json:"diagnostics,omitempty"`
 }
 
 // Output
 type Output struct {
-	Status    int        `json:"status"`
-	Error     string     `json:"error,omitempty"`
-	Zone      string     `json:"zone"`
-	Timestamp string     `json:"timestamp"`
-	Master    *Master    `json:"master,omitempty"`
-	Responses []Response `json:"responses"`
+	Status    int              `json:"status"`
+	Severity  string           `json:"severity"`
+	Error     string           `json:"error,omitempty"`
+	Zone      string           `json:"zone"`
+	Source    string           `json:"source,omitempty"`
+	Timestamp string           `json:"timestamp"`
+	Master    *Master          `json:"master,omitempty"`
+	Responses []Response       `json:"responses"`
+	Discovery []DiscoveryQuery `json:"discovery,omitempty"`
+	DualStack []DualStack      `json:"dualstack,omitempty"`
+	Diversity *Diversity       `json:"diversity,omitempty"`
+
+	RTTMedian       float64 `json:"rtt_median,omitempty"`
+	RTTMedianStatus string  `json:"rtt_median_status,omitempty"`
 }
 
 // Runner holds all mutable state for a single program execution
@@ -79,17 +154,30 @@ type Runner struct {
 	output         Output
 	serialList     []uint32
 	ResponseByName map[string][]Response
+	matrix         MatrixOutput
 }
 
 // NewRunner creates a Runner with initialized channels and maps
 func NewRunner() *Runner {
 	return &Runner{
-		tokens:         make(chan struct{}, numParallel),
+		tokens:         make(chan struct{}, defaultParallel),
 		results:        make(chan *Response),
 		ResponseByName: make(map[string][]Response),
 	}
 }
 
+// configure applies the concurrency limit (-p) and the per destination
+// limits (-qps, -maxq) of the options to the Runner, before dispatch.
+func (rn *Runner) configure(opts *Options) {
+	if opts.parallel > 0 {
+		rn.tokens = make(chan struct{}, opts.parallel)
+	}
+	opts.Qopts.limiter = NewDestLimiter(opts.qps, opts.maxq)
+	if opts.cookie {
+		opts.Qopts.cookies = NewCookieJar()
+	}
+}
+
 // serialDistance returns the unsigned distance between two serial numbers
 // accounting for RFC 1982 serial number arithmetic (wrap at 2^32).
 func serialDistance(s1, s2 uint32) uint32 {
@@ -128,21 +216,29 @@ func maxSerialDrift(serials []uint32) uint32 {
 	return maxDist
 }
 
-func getIPAddresses(hostname string, rrtype uint16, opts Options) ([]net.IP, error) {
+func getIPAddresses(ctx context.Context, hostname string, rrtype uint16, opts Options) ([]net.IP, error) {
 
 	var ipList []net.IP
 
 	opts.Qopts.rdflag = true
+	opts.Qopts.tsig = nil
 
 	switch rrtype {
 	case dns.TypeAAAA, dns.TypeA:
-		response, err := SendQuery(hostname, rrtype, opts.resolvers, opts.Qopts)
+		if addrs, ok := opts.cache.Get(hostname, rrtype); ok {
+			for _, addr := range addrs {
+				ipList = append(ipList, net.ParseIP(addr))
+			}
+			return ipList, nil
+		}
+		response, err := opts.resolvers.Query(ctx, hostname, rrtype, opts.Qopts)
 		if err != nil {
 			return nil, err
 		}
 		if response == nil {
 			return nil, fmt.Errorf("no response for %s %s", hostname, dns.TypeToString[rrtype])
 		}
+		addrs := []string{}
 		for _, rr := range response.Answer {
 			if rr.Header().Rrtype == rrtype {
 				if rrtype == dns.TypeAAAA {
@@ -150,8 +246,12 @@ func getIPAddresses(hostname string, rrtype uint16, opts Options) ([]net.IP, err
 				} else if rrtype == dns.TypeA {
 					ipList = append(ipList, rr.(*dns.A).A)
 				}
+				addrs = append(addrs, ipList[len(ipList)-1].String())
 			}
 		}
+		if response.MsgHdr.Rcode == dns.RcodeSuccess {
+			opts.cache.Put(hostname, rrtype, addrs, responseTTL(response, rrtype))
+		}
 	default:
 		return nil, fmt.Errorf("getIPAddresses: %d: invalid rrtype", rrtype)
 	}
@@ -159,89 +259,242 @@ func getIPAddresses(hostname string, rrtype uint16, opts Options) ([]net.IP, err
 	return ipList, nil
 }
 
-func getSerial(zone string, ip net.IP, opts Options) (serial uint32, took time.Duration, nsid string, err error) {
+// SerialResult - outcome of a SOA query to a server
+type SerialResult struct {
+	serial uint32
+	took   time.Duration
+	nsid   string
+	info   QueryInfo
+	rrl    string
+	diag   *Diagnostics
+	ede    []EDE
+	cookie *CookieInfo
+}
+
+func getSerial(ctx context.Context, zone string, ip net.IP, opts Options) (result SerialResult, err error) {
 
 	var response *dns.Msg
+	var info *QueryInfo
 
 	opts.Qopts.rdflag = false
 
+	jar := opts.Qopts.cookies
+	if jar != nil {
+		opts.Qopts.cookie = jar.cookie(ip)
+	}
+
 	t0 := time.Now()
-	response, err = SendQuery(zone, dns.TypeSOA, []net.IP{ip}, opts.Qopts)
-	took = time.Since(t0)
+	response, info, err = SendQueryInfo(ctx, zone, dns.TypeSOA, []net.IP{ip}, opts.Qopts)
+	if jar != nil && err == nil && response != nil {
+		result.cookie = jar.update(ip, response)
+		if response.Rcode == dns.RcodeBadCookie && result.cookie.Valid {
+			// Retry once with the server cookie (RFC 7873, Section 5.3)
+			opts.Qopts.cookie = jar.cookie(ip)
+			response, info, err = SendQueryInfo(ctx, zone, dns.TypeSOA, []net.IP{ip}, opts.Qopts)
+			if err == nil && response != nil {
+				result.cookie = jar.update(ip, response)
+			}
+			result.cookie.Retried = true
+		}
+	}
+	result.took = time.Since(t0)
+	result.info = *info
+	result.diag = newDiagnostics(info, response)
 
 	if err != nil {
-		return serial, took, nsid, err
+		if cancelled(ctx) {
+			err = cancelledError(ctx)
+		}
+		return result, err
 	}
 	if response == nil {
-		return serial, took, nsid, fmt.Errorf("no response from %s", ip.String())
-	}
-	switch response.MsgHdr.Rcode {
-	case dns.RcodeSuccess:
-		break
-	case dns.RcodeNameError:
-		return serial, took, nsid, fmt.Errorf("NXDOMAIN: %s: name doesn't exist", zone)
-	default:
-		return serial, took, nsid, fmt.Errorf("response code: %s",
-			dns.RcodeToString[response.MsgHdr.Rcode])
+		return result, fmt.Errorf("no response from %s", ip.String())
 	}
+	result.rrl = info.rrlSuspected(response, opts.Qopts.bufsize)
 
 	ednsopt := response.IsEdns0()
 	if ednsopt != nil {
 		for _, o := range ednsopt.Option {
-			switch o.(type) {
+			switch o := o.(type) {
 			case *dns.EDNS0_NSID:
 				h, err := hex.DecodeString(o.String())
 				if err != nil {
-					nsid = o.String()
+					result.nsid = o.String()
 				} else {
-					nsid = string(h)
+					result.nsid = string(h)
 				}
+			case *dns.EDNS0_EDE:
+				result.ede = append(result.ede, newEDE(o))
 			}
 		}
 	}
 
+	if response.MsgHdr.Rcode != dns.RcodeSuccess {
+		return result, rcodeError(response.MsgHdr.Rcode, zone)
+	}
+
 	for _, rr := range response.Answer {
 		if rr.Header().Rrtype == dns.TypeSOA {
-			return rr.(*dns.SOA).Serial, took, nsid, nil
+			result.serial = rr.(*dns.SOA).Serial
+			return result, nil
 		}
 	}
 
-	return serial, took, nsid, fmt.Errorf("SOA record not found at %s",
-		ip.String())
+	if !response.MsgHdr.Authoritative {
+		return result, newQueryError(errLame,
+			fmt.Errorf("SOA record not found at %s: server is not authoritative",
+				ip.String()))
+	}
+	return result, newQueryError(errNoSOA,
+		fmt.Errorf("SOA record not found at %s", ip.String()))
 }
 
-func (rn *Runner) getSerialAsync(zone string, ip net.IP, nsName string, opts Options) {
+func (rn *Runner) getSerialAsync(ctx context.Context, zone string, req *Request, opts Options) {
 
 	defer rn.wg.Done()
 
-	serial, resptime, nsid, err := getSerial(zone, ip, opts)
+	ip, nsName := req.nsip, req.nsname
+	opts.Qopts = req.queryOptions(opts.Qopts)
+
+	var chaos ChaosInfo
+	var chaoswg sync.WaitGroup
+	if opts.chaos {
+		chaoswg.Add(1)
+		go func() {
+			defer chaoswg.Done()
+			chaos = rn.getChaosInfo(ctx, ip, opts)
+		}()
+	}
+
+	var result SerialResult
+	var stats *ProbeStats
+	var err error
+	if opts.count > 1 {
+		result, stats, err = rn.queryRepeated(ctx, zone, ip, opts)
+	} else {
+		result, err = getSerial(ctx, zone, ip, opts)
+	}
+	var anycast *AnycastResult
+	if opts.anycast > 0 && err == nil {
+		anycast = rn.probeAnycast(ctx, zone, ip, opts)
+	}
+	if result.cookie != nil && result.cookie.Valid && err == nil {
+		rn.checkCookie(ctx, zone, ip, opts, result.cookie)
+	}
+	var reach *Reachability
+	if opts.reach {
+		reach = rn.checkReachability(ctx, zone, ip, opts)
+	}
+	var edns *EDNSReport
+	if opts.edns {
+		edns = rn.checkEDNS(ctx, zone, ip, opts)
+	}
+	var audit *AuditReport
+	if opts.audit {
+		audit = rn.checkAudit(ctx, zone, ip, opts)
+	}
+	var transfer *ZoneTransfer
+	if opts.xfr && err == nil {
+		transfer = rn.checkTransfer(ctx, zone, ip, opts.Qopts)
+	}
+	chaoswg.Wait()
 	<-rn.tokens // Release token
 
-	r := new(Response)
-	r.ip = ip
-	r.Nsip = ip.String()
-	r.Nsname = nsName
-	r.Serial = serial
-	r.Nsid = nsid
-	r.resptime = resptime
-	r.Resptime = MilliSeconds(resptime)
+	r := newResponse(req)
+	r.Source = opts.Qopts.sourceString(ip)
+	r.Serial = result.serial
+	r.Nsid = result.nsid
+	r.resptime = result.took
+	r.Resptime = MilliSeconds(result.took)
+	r.Truncated = result.info.truncated
+	r.TCPFallback = result.info.tcpFallback
+	r.Retries = result.info.retries()
+	r.Loss = result.info.udpLoss()
+	r.RRL = result.rrl
+	r.Diagnostics = result.diag
+	r.EDE = result.ede
+	r.Identity = chaos.identity
+	r.Version = chaos.version
+	r.Anycast = anycast
+	r.Reach = reach
+	r.EDNS = edns
+	r.Cookie = result.cookie
+	r.Audit = audit
+	r.Transfer = transfer
+	r.Stats = stats
+	r.Tolerance, r.ToleranceRule = opts.tolerance(nsName, ip)
+	if err == nil {
+		r.RTTStatus = opts.rttStatus(r.rtt())
+	}
 	if opts.masterIP != nil {
-		delta := serialDelta(opts.masterSerial, serial)
+		delta := serialDelta(opts.masterSerial, result.serial)
 		r.Delta = &delta
 	}
 	r.err = err
 	if err != nil {
 		r.Err = err.Error()
+		r.ErrCode = errorCode(err)
 	}
 	rn.results <- r
 }
 
-func getNSnames(zone string, opts *Options) ([]string, error) {
+// newResponse returns a Response for the server of req
+func newResponse(req *Request) *Response {
+	return &Response{
+		Nsname:    req.nsname,
+		ip:        req.nsip,
+		Nsip:      req.nsip.String(),
+		endpoint:  req.Endpoint,
+		Port:      req.port,
+		Transport: req.transport,
+	}
+}
+
+// address returns the server address, with the port and transport it
+// was queried at if they were given for the server.
+func (r *Response) address() string {
+	return r.endpoint.format(r.Nsip)
+}
+
+// acquireToken waits for a concurrency token, and returns false without
+// one if the context is cancelled first.
+func (rn *Runner) acquireToken(ctx context.Context) bool {
+	if ctx.Err() != nil {
+		return false
+	}
+	select {
+	case rn.tokens <- struct{}{}:
+		return true
+	case <-ctx.Done():
+		return false
+	}
+}
+
+// cancelSerialAsync reports a server whose query was never sent because
+// the run was cancelled before a concurrency token became available.
+func (rn *Runner) cancelSerialAsync(ctx context.Context, req *Request) {
+
+	defer rn.wg.Done()
+
+	err := cancelledError(ctx)
+	r := newResponse(req)
+	r.err = err
+	r.Err = err.Error()
+	r.ErrCode = errorCode(err)
+	rn.results <- r
+}
+
+func getNSnames(ctx context.Context, zone string, opts *Options) ([]string, error) {
 
 	var nsNameList []string
 
+	if nsNames, ok := opts.cache.Get(zone, dns.TypeNS); ok && len(nsNames) > 0 {
+		return append(nsNameList, nsNames...), nil
+	}
+
 	opts.Qopts.rdflag = true
-	response, err := SendQuery(zone, dns.TypeNS, opts.resolvers, opts.Qopts)
+	opts.Qopts.tsig = nil
+	response, err := opts.resolvers.Query(ctx, zone, dns.TypeNS, opts.Qopts)
 	if err != nil {
 		return nil, err
 	}
@@ -256,47 +509,87 @@ func getNSnames(zone string, opts *Options) ([]string, error) {
 	if nsNameList == nil {
 		return nil, fmt.Errorf("%s no nameserver records found", zone)
 	}
+	opts.cache.Put(zone, dns.TypeNS, nsNameList, responseTTL(response, dns.TypeNS))
 
 	return nsNameList, nil
 }
 
-func getRequests(nsNameList []string, opts *Options) []*Request {
+// lookupAddresses returns the addresses of type rrtype for a nameserver
+// name, printing a warning if the lookup fails. The lookup waits for a
+// token from tokens, to bound the number of concurrent lookups.
+func lookupAddresses(ctx context.Context, nsName string, rrtype uint16, opts *Options, tokens chan struct{}) []net.IP {
+
+	tokens <- struct{}{}
+	ips, err := getIPAddresses(ctx, nsName, rrtype, *opts)
+	<-tokens
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Warning: %s %s lookup failed: %s\n",
+			nsName, dns.TypeToString[rrtype], err)
+	}
+	return ips
+}
 
-	var ip net.IP
-	var aList []net.IP
+func getRequests(ctx context.Context, nsNameList []string, opts *Options) []*Request {
+
+	var wg sync.WaitGroup
 	var requests []*Request
 	var r *Request
 
-	sort.Strings(nsNameList)
+	servers := getServers(nsNameList)
+	sort.SliceStable(servers, func(i, j int) bool {
+		if servers[i].name != servers[j].name {
+			return servers[i].name < servers[j].name
+		}
+		return servers[i].String() < servers[j].String()
+	})
+
+	// Look up the IPv6 and IPv4 addresses of all the names concurrently,
+	// keeping them in the order of the names, IPv6 first.
+	parallel := opts.parallel
+	if parallel <= 0 {
+		parallel = defaultParallel
+	}
+	tokens := make(chan struct{}, parallel)
+	v6Lists := make([][]net.IP, len(servers))
+	v4Lists := make([][]net.IP, len(servers))
+
+	for i, server := range servers {
+		nsName := server.name
+		if net.ParseIP(nsName) != nil {
+			continue
+		}
+		if !opts.V4Only {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				v6Lists[i] = lookupAddresses(ctx, nsName, dns.TypeAAAA, opts, tokens)
+			}()
+		}
+		if !opts.V6Only {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				v4Lists[i] = lookupAddresses(ctx, nsName, dns.TypeA, opts, tokens)
+			}()
+		}
+	}
+	wg.Wait()
 
-	for _, nsName := range nsNameList {
-		ip = net.ParseIP(nsName)
+	for i, server := range servers {
+		ip := net.ParseIP(server.name)
 		if ip != nil {
 			r = new(Request)
-			r.nsname = nsName
+			r.nsname = server.name
 			r.nsip = ip
+			r.Endpoint = server.Endpoint
 			requests = append(requests, r)
 			continue
 		}
-		aList = make([]net.IP, 0)
-		if !opts.V4Only {
-			ips, err := getIPAddresses(nsName, dns.TypeAAAA, *opts)
-			if err != nil {
-				fmt.Fprintf(os.Stderr, "Warning: %s AAAA lookup failed: %s\n", nsName, err)
-			}
-			aList = append(aList, ips...)
-		}
-		if !opts.V6Only {
-			ips, err := getIPAddresses(nsName, dns.TypeA, *opts)
-			if err != nil {
-				fmt.Fprintf(os.Stderr, "Warning: %s A lookup failed: %s\n", nsName, err)
-			}
-			aList = append(aList, ips...)
-		}
-		for _, ip := range aList {
+		for _, ip := range append(v6Lists[i], v4Lists[i]...) {
 			r = new(Request)
-			r.nsname = nsName
+			r.nsname = server.name
 			r.nsip = ip
+			r.Endpoint = server.Endpoint
 			requests = append(requests, r)
 		}
 	}
@@ -308,34 +601,36 @@ func MilliSeconds(duration time.Duration) float64 {
 	return float64(duration.Microseconds()) / 1000.0
 }
 
-func printSerialLine(isMaster bool, serial uint32, nsname string, nsip net.IP, elapsed time.Duration, nsid string, opts *Options) {
+func printSerialLine(isMaster bool, serial uint32, nsname string, nsaddr string, elapsed time.Duration, nsid string, notes string, opts *Options) {
 	if opts.json {
 		return
 	}
 
 	if isMaster {
 		fmt.Printf("%15d [%8s] %s %s %.2fms", serial, "MASTER",
-			nsname, nsip, MilliSeconds(elapsed))
+			nsname, nsaddr, MilliSeconds(elapsed))
 	} else {
 		if opts.masterIP == nil {
-			fmt.Printf("%15d %s %s %.2fms", serial, nsname, nsip, MilliSeconds(elapsed))
+			fmt.Printf("%15d %s %s %.2fms", serial, nsname, nsaddr, MilliSeconds(elapsed))
 		} else {
 			delta := serialDelta(opts.masterSerial, serial)
-			fmt.Printf("%15d [%8d] %s %s %.2fms", serial, delta, nsname, nsip, MilliSeconds(elapsed))
+			fmt.Printf("%15d [%8d] %s %s %.2fms", serial, delta, nsname, nsaddr, MilliSeconds(elapsed))
 		}
 	}
 
 	if opts.Qopts.nsid && nsid != "" {
-		fmt.Printf(" %s\n", nsid)
-	} else {
-		fmt.Printf("\n")
+		fmt.Printf(" %s", nsid)
+	}
+	if notes != "" {
+		fmt.Printf(" %s", notes)
 	}
+	fmt.Printf("\n")
 }
 
-func getMasterAddress(name string, opts *Options) net.IP {
+func getMasterAddress(ctx context.Context, name string, opts *Options) net.IP {
 	// Try IPv6 if IPv4-only is not specified
 	if !opts.V4Only {
-		ipv6list, _ := getIPAddresses(name, dns.TypeAAAA, *opts)
+		ipv6list, _ := getIPAddresses(ctx, name, dns.TypeAAAA, *opts)
 		if len(ipv6list) > 0 {
 			return ipv6list[0]
 		}
@@ -343,7 +638,7 @@ func getMasterAddress(name string, opts *Options) net.IP {
 
 	// Try IPv4 if IPv6-only is not specified
 	if !opts.V6Only {
-		ipv4list, _ := getIPAddresses(name, dns.TypeA, *opts)
+		ipv4list, _ := getIPAddresses(ctx, name, dns.TypeA, *opts)
 		if len(ipv4list) > 0 {
 			return ipv4list[0]
 		}
@@ -352,18 +647,19 @@ func getMasterAddress(name string, opts *Options) net.IP {
 	return nil
 }
 
-func (rn *Runner) getMasterSerial(zone string, opts *Options) error {
+func (rn *Runner) getMasterSerial(ctx context.Context, zone string, opts *Options) error {
 
 	var err error
-	var took time.Duration
-	var nsid string
+	var result SerialResult
 	var master = new(Master)
 
 	rn.output.Master = master
+	master.Port = opts.masterEndpoint.port
+	master.Transport = opts.masterEndpoint.transport
 
 	if opts.masterIP == nil {
 		master.Name = opts.masterName
-		opts.masterIP = getMasterAddress(master.Name, opts)
+		opts.masterIP = getMasterAddress(ctx, master.Name, opts)
 		if opts.masterIP == nil {
 			return fmt.Errorf("couldn't resolve master name: %s", master.Name)
 		}
@@ -373,44 +669,110 @@ func (rn *Runner) getMasterSerial(zone string, opts *Options) error {
 		master.IP = opts.masterName
 	}
 
-	opts.masterSerial, took, nsid, err = getSerial(zone, opts.masterIP, *opts)
+	mopts := *opts
+	mopts.Qopts = opts.masterEndpoint.queryOptions(opts.Qopts)
+	master.Source = mopts.Qopts.sourceString(opts.masterIP)
+	result, err = getSerial(ctx, zone, opts.masterIP, mopts)
+	opts.masterSerial = result.serial
+	master.Diagnostics = result.diag
+	master.EDE = result.ede
 
 	if err != nil {
 		master.Err = err.Error()
-		return fmt.Errorf("%s %s: couldn't obtain serial: %s",
-			opts.masterName, opts.masterIP, err.Error())
+		master.ErrCode = errorCode(err)
+		return fmt.Errorf("%s %s: couldn't obtain serial: %s%s",
+			opts.masterName, opts.masterEndpoint.format(master.IP), err.Error(),
+			edeString(result.ede, " "))
 	}
 
 	master.Serial = opts.masterSerial
-	master.Resptime = MilliSeconds(took)
+	master.Resptime = MilliSeconds(result.took)
 	rn.serialList = append(rn.serialList, opts.masterSerial)
-	printSerialLine(true, opts.masterSerial, opts.masterName, opts.masterIP, took, nsid, opts)
+	printSerialLine(true, opts.masterSerial, opts.masterName,
+		opts.masterEndpoint.format(master.IP), result.took, result.nsid, "", opts)
+	if opts.xfr {
+		master.Transfer = rn.checkTransfer(ctx, zone, opts.masterIP, mopts.Qopts)
+		printTransfer(master.Transfer, opts)
+	}
 	return nil
 }
 
 func printResult(r *Response, opts *Options) {
 
 	if r.err != nil {
-		fmt.Fprintf(os.Stderr, "Error: %s %s: couldn't obtain serial: %s\n", r.Nsname, r.ip, r.err.Error())
+		fmt.Fprintf(os.Stderr, "Error: %s %s: couldn't obtain serial: %s%s\n",
+			r.Nsname, r.address(), r.err.Error(), edeString(r.EDE, " "))
+		printReachability(r.Reach, opts)
+		printEDNS(r.EDNS, opts)
+		printAudit(r.Audit, opts)
 		return
 	}
-	printSerialLine(false, r.Serial, r.Nsname, r.ip, r.resptime, r.Nsid, opts)
+	printSerialLine(false, r.Serial, r.Nsname, r.address(), r.resptime, r.Nsid, r.notes(), opts)
+	printProbeStats(r.Stats, opts)
+	printAnycast(r.Anycast, opts)
+	printReachability(r.Reach, opts)
+	printEDNS(r.EDNS, opts)
+	printAudit(r.Audit, opts)
+	printTransfer(r.Transfer, opts)
+}
+
+// notes returns the transport anomalies seen while querying the server,
+// for the text output
+func (r *Response) notes() string {
+
+	var notes []string
+
+	if r.Truncated {
+		notes = append(notes, "[TC->TCP]")
+	}
+	if r.Retries > 0 {
+		notes = append(notes, fmt.Sprintf("[retries %d]", r.Retries))
+	}
+	if r.Loss != "" {
+		notes = append(notes, fmt.Sprintf("[loss? %s]", r.Loss))
+	}
+	if r.RRL != "" {
+		notes = append(notes, fmt.Sprintf("[RRL? %s]", r.RRL))
+	}
+	if len(r.EDE) > 0 {
+		notes = append(notes, edeString(r.EDE, ""))
+	}
+	if r.ToleranceRule != "" {
+		notes = append(notes, fmt.Sprintf("[drift %d: %s]", r.Tolerance, r.ToleranceRule))
+	}
+	if r.RTTStatus != "" {
+		notes = append(notes, fmt.Sprintf("[RTT %s]", strings.ToUpper(r.RTTStatus)))
+	}
+	if r.Identity != "" {
+		notes = append(notes, fmt.Sprintf("[id: %s]", r.Identity))
+	}
+	if r.Version != "" {
+		notes = append(notes, fmt.Sprintf("[version: %s]", r.Version))
+	}
+	if note := r.Reach.note(); note != "" {
+		notes = append(notes, note)
+	}
+	if note := r.EDNS.note(); note != "" {
+		notes = append(notes, note)
+	}
+	if note := r.Cookie.note(); note != "" {
+		notes = append(notes, note)
+	}
+	if note := r.Audit.note(); note != "" {
+		notes = append(notes, note)
+	}
+	if note := r.Transfer.note(); note != "" {
+		notes = append(notes, note)
+	}
+	return strings.Join(notes, " ")
 }
 
 func getAdditionalServers(opts *Options) []string {
 
 	var s []string
-	var ip net.IP
-
-	s0 := strings.Split(opts.additional, ",")
 
-	for _, x := range s0 {
-		ip = net.ParseIP(x)
-		if ip != nil {
-			s = append(s, x)
-		} else {
-			s = append(s, dns.Fqdn(x))
-		}
+	for _, server := range getServers(strings.Split(opts.additional, ",")) {
+		s = append(s, server.String())
 	}
 
 	return s
@@ -419,6 +781,7 @@ func getAdditionalServers(opts *Options) []string {
 func (rn *Runner) formatOutput(status int, message string, opts Options) {
 
 	rn.output.Status = status
+	rn.output.Severity = severity(status)
 	if status != 0 && message == "" {
 		message = StatusCode[status]
 	}
@@ -437,14 +800,16 @@ func (rn *Runner) formatOutput(status int, message string, opts Options) {
 	}
 }
 
-func (rn *Runner) run(zone string, opts Options) (int, string) {
+func (rn *Runner) run(ctx context.Context, zone string, opts Options) (int, string) {
 
 	var err error
 	var rc int
 	var nsNameList []string
 	var requests []*Request
 
-	opts.resolvers, err = GetResolver(opts.resolvconf)
+	rn.configure(&opts)
+
+	err = opts.setupResolvers()
 	if err != nil {
 		return 2, fmt.Sprintf("Error getting resolver: %s", err.Error())
 	}
@@ -453,13 +818,20 @@ func (rn *Runner) run(zone string, opts Options) (int, string) {
 		nsNameList = getAdditionalServers(&opts)
 	}
 	if !opts.noqueryns {
-		nsNames, err := getNSnames(zone, &opts)
+		nsNames, err := getNSnames(ctx, zone, &opts)
 		if err != nil {
+			if cancelled(ctx) {
+				return 2, fmt.Sprintf("nameserver discovery: %s", cancelledError(ctx))
+			}
 			return 1, err.Error()
 		}
 		nsNameList = append(nsNameList, nsNames...)
 	}
-	requests = getRequests(nsNameList, &opts)
+	requests = getRequests(ctx, nsNameList, &opts)
+	if opts.diversity {
+		rn.output.Diversity = checkDiversity(diversityRequests(ctx, nsNameList, requests, &opts),
+			opts.asns, opts.divpolicy)
+	}
 
 	opts.Qopts.rdflag = false
 
@@ -467,12 +839,20 @@ func (rn *Runner) run(zone string, opts Options) (int, string) {
 	if opts.json {
 		rn.output.Zone = zone
 		rn.output.Timestamp = timestamp
+		rn.output.Source = opts.source
+		rn.output.Discovery = opts.resolvers.Discovery()
 	} else {
 		fmt.Printf("## %s %s\n", zone, timestamp)
+		if opts.source != "" {
+			fmt.Printf("## source %s\n", opts.source)
+		}
+		if opts.showresolver {
+			printDiscovery(opts.resolvers.Discovery())
+		}
 	}
 
 	if opts.masterIP != nil || opts.masterName != "" {
-		if err := rn.getMasterSerial(zone, &opts); err != nil {
+		if err := rn.getMasterSerial(ctx, zone, &opts); err != nil {
 			return 3, err.Error()
 		}
 	}
@@ -480,26 +860,46 @@ func (rn *Runner) run(zone string, opts Options) (int, string) {
 	go func() {
 		for _, x := range requests {
 			rn.wg.Add(1)
-			rn.tokens <- struct{}{}
-			go rn.getSerialAsync(zone, x.nsip, x.nsname, opts)
+			if rn.acquireToken(ctx) {
+				go rn.getSerialAsync(ctx, zone, x, opts)
+			} else {
+				go rn.cancelSerialAsync(ctx, x)
+			}
 		}
 		rn.wg.Wait()
 		close(rn.results)
 	}()
 
+	defaultSerials := append([]uint32(nil), rn.serialList...)
+	var overridden []*Response
+	var auditStatus int
+
 	for r := range rn.results {
 		rn.ResponseByName[r.Nsname] = append(rn.ResponseByName[r.Nsname], *r)
-		if !opts.sortresponse && !opts.json {
+		if !opts.grouped() {
 			printResult(r, &opts)
 		}
+		auditStatus = max(auditStatus, r.Audit.status())
+		if r.Reach != nil {
+			if err := r.Reach.err(); err != nil {
+				rc = max(rc, opts.errorStatus(err))
+			}
+		}
 		if r.err != nil {
-			rc = 2
+			rc = max(rc, opts.errorStatus(r.err))
 		} else {
-			rn.serialList = append(rn.serialList, r.Serial)
+			rn.serialList = append(rn.serialList, r.serials()...)
+			if r.ToleranceRule != "" {
+				overridden = append(overridden, r)
+			} else {
+				defaultSerials = append(defaultSerials, r.serials()...)
+			}
 		}
 	}
 
-	if opts.sortresponse || opts.json {
+	contentMismatch := opts.xfr && rn.compareTransfers(opts.xfrdiff)
+
+	if opts.grouped() {
 		nsnameList := make([]string, 0, len(rn.ResponseByName))
 
 		rn.output.Responses = make([]Response, 0, len(rn.ResponseByName))
@@ -518,28 +918,94 @@ func (rn *Runner) run(zone string, opts Options) (int, string) {
 					rn.output.Responses = append(rn.output.Responses, r)
 				}
 			}
+			if opts.dualstack {
+				ds := checkDualStack(nsname, responses)
+				if ds != nil {
+					rn.output.DualStack = append(rn.output.DualStack, *ds)
+				}
+				printDualStack(ds, &opts)
+			}
 		}
 	}
 
+	printDiversity(rn.output.Diversity, opts.asns, &opts)
+
 	if rn.serialList == nil {
 		return 2, "ERROR: no SOA serials obtained."
 	}
 
-	if rc != 2 {
-		if maxSerialDrift(rn.serialList) > uint32(opts.delta) {
+	if rc == 0 {
+		if rn.driftExceeded(defaultSerials, overridden, &opts) {
 			rc = 1
 		}
 	}
+	if rc == 0 && contentMismatch {
+		return 1, "zone content differs at the same serial"
+	}
+	if rc == 0 {
+		rc = rn.checkResponseTimes(&opts)
+		rc = moreSevere(rc, rn.output.Diversity.status())
+		rc = moreSevere(rc, auditStatus)
+	}
 	return rc, ""
 }
 
+// runOnce does one run of the check, or of the matrix, with a new
+// Runner, prints its output, and returns its exit status.
+func runOnce(ctx context.Context, zone string, opts Options) int {
+
+	var status int
+	var message string
+
+	rn := NewRunner()
+	if opts.matrix {
+		status, message = rn.runMatrix(ctx, opts.zones, opts)
+		rn.formatMatrixOutput(status, message, opts)
+	} else {
+		status, message = rn.run(ctx, zone, opts)
+		rn.formatOutput(status, message, opts)
+	}
+	return status
+}
+
 func main() {
 	zone, opts, err := doFlags()
 	if err != nil {
 		os.Exit(4)
 	}
-	rn := NewRunner()
-	status, message := rn.run(zone, opts)
-	rn.formatOutput(status, message, opts)
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+	if opts.deadline > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeoutCause(ctx, opts.deadline,
+			fmt.Errorf("run deadline of %s exceeded", opts.deadline))
+		defer cancel()
+	}
+
+	if opts.cachefile != "" {
+		opts.cache, err = LoadDiscoveryCache(opts.cachefile)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Warning: ignoring cache file %s: %s\n", opts.cachefile, err)
+		}
+	} else {
+		opts.cache = NewDiscoveryCache()
+	}
+
+	var status int
+	runs := []Options{opts}
+	if opts.sources != nil {
+		runs = nil
+		for _, set := range opts.sources {
+			runs = append(runs, opts.withSource(set))
+		}
+	}
+	for _, ropts := range runs {
+		status = moreSevere(status, runOnce(ctx, zone, ropts))
+	}
+
+	if err := opts.cache.Save(); err != nil {
+		fmt.Fprintf(os.Stderr, "Warning: couldn't save cache file: %s\n", err)
+	}
 	os.Exit(status)
 }
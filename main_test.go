@@ -1,6 +1,8 @@
 package main
 
 import (
+	"context"
+	"errors"
 	"net"
 	"sync"
 	"testing"
@@ -113,6 +115,11 @@ func TestGetAdditionalServers(t *testing.T) {
 			"ns1.example.com.",
 			[]string{"ns1.example.com."},
 		},
+		{
+			"ports and transports",
+			"ns1.example.com@5353,[2001:db8::1]:5353,tls://ns2.example.com",
+			[]string{"ns1.example.com.@5353", "2001:db8::1@5353", "tls://ns2.example.com."},
+		},
 	}
 
 	for _, tt := range tests {
@@ -164,7 +171,7 @@ func TestGetRequests(t *testing.T) {
 	for _, tt := range tests {
 		t.Run(tt.name, func(t *testing.T) {
 			opts := &Options{}
-			result := getRequests(tt.nsNameList, opts)
+			result := getRequests(context.Background(), tt.nsNameList, opts)
 			if len(result) != tt.expected {
 				t.Errorf("getRequests() returned %d requests, want %d",
 					len(result), tt.expected)
@@ -323,7 +330,7 @@ func TestGetSerial(t *testing.T) {
 				},
 			}
 
-			serial, _, _, err := getSerial("example.com.", ip, opts)
+			result, err := getSerial(context.Background(), "example.com.", ip, opts)
 			if tt.wantErr {
 				if err == nil {
 					t.Error("getSerial() expected error, got nil")
@@ -337,9 +344,9 @@ func TestGetSerial(t *testing.T) {
 				if err != nil {
 					t.Errorf("getSerial() unexpected error: %v", err)
 				}
-				if serial != tt.wantSerial {
+				if result.serial != tt.wantSerial {
 					t.Errorf("getSerial() serial = %d, want %d",
-						serial, tt.wantSerial)
+						result.serial, tt.wantSerial)
 				}
 			}
 		})
@@ -367,7 +374,7 @@ func TestGetMasterSerial(t *testing.T) {
 			},
 		}
 
-		err := rn.getMasterSerial("example.com.", &opts)
+		err := rn.getMasterSerial(context.Background(), "example.com.", &opts)
 		if err != nil {
 			t.Fatalf("getMasterSerial() unexpected error: %v", err)
 		}
@@ -399,7 +406,7 @@ func TestGetMasterSerial(t *testing.T) {
 			},
 		}
 
-		err := rn.getMasterSerial("example.com.", &opts)
+		err := rn.getMasterSerial(context.Background(), "example.com.", &opts)
 		if err == nil {
 			t.Error("getMasterSerial() expected error, got nil")
 		}
@@ -415,10 +422,10 @@ func TestGetMasterSerial(t *testing.T) {
 				retries: 1,
 				bufsize: defaultBufsize,
 			},
-			resolvers: []net.IP{net.ParseIP("127.0.0.1")},
+			resolvers: NewResolverConfig(Resolver{ip: net.ParseIP("127.0.0.1")}),
 		}
 
-		err := rn.getMasterSerial("example.com.", &opts)
+		err := rn.getMasterSerial(context.Background(), "example.com.", &opts)
 		if err == nil {
 			t.Error("getMasterSerial() expected error, got nil")
 		}
@@ -502,7 +509,7 @@ func TestRun(t *testing.T) {
 			},
 		}
 
-		status, message := rn.run("example.com.", opts)
+		status, message := rn.run(context.Background(), "example.com.", opts)
 		if status != 0 {
 			t.Errorf("run() status = %d, want 0; message = %q", status, message)
 		}
@@ -525,7 +532,7 @@ func TestRun(t *testing.T) {
 			},
 		}
 
-		status, message := rn.run("example.com.", opts)
+		status, message := rn.run(context.Background(), "example.com.", opts)
 		if status != 0 {
 			t.Errorf("run() status = %d, want 0; message = %q", status, message)
 		}
@@ -558,7 +565,7 @@ func TestRun(t *testing.T) {
 			},
 		}
 
-		status, _ := rn.run("example.com.", opts)
+		status, _ := rn.run(context.Background(), "example.com.", opts)
 		if status != 1 {
 			t.Errorf("run() status = %d, want 1", status)
 		}
@@ -584,7 +591,7 @@ func TestRun(t *testing.T) {
 			},
 		}
 
-		status, message := rn.run("example.com.", opts)
+		status, message := rn.run(context.Background(), "example.com.", opts)
 		if status != 0 {
 			t.Errorf("run() status = %d, want 0; message = %q", status, message)
 		}
@@ -604,7 +611,7 @@ func TestRun(t *testing.T) {
 			},
 		}
 
-		status, _ := rn.run("example.com.", opts)
+		status, _ := rn.run(context.Background(), "example.com.", opts)
 		if status != 3 {
 			t.Errorf("run() status = %d, want 3", status)
 		}
@@ -621,10 +628,72 @@ func TestRun(t *testing.T) {
 			},
 		}
 
-		status, message := rn.run("example.com.", opts)
+		status, message := rn.run(context.Background(), "example.com.", opts)
 		if status != 2 {
 			t.Errorf("run() status = %d, want 2; message = %q", status, message)
 		}
 	})
-}
+	t.Run("deadline cancels pending servers", func(t *testing.T) {
+		silent := dns.HandlerFunc(func(w dns.ResponseWriter, r *dns.Msg) {})
+		server := newMockDNSServer(t, silent)
+		defer server.close()
+		<-server.ready
+		host, port, _ := net.SplitHostPort(server.udpAddr)
+
+		rn := NewRunner()
+		opts := Options{
+			noqueryns:  true,
+			json:       true,
+			additional: host,
+			Qopts: QueryOptions{
+				timeout: 5 * time.Second,
+				retries: 3,
+				bufsize: defaultBufsize,
+				port:    port,
+			},
+		}
 
+		ctx, cancel := context.WithTimeout(context.Background(), 200*time.Millisecond)
+		defer cancel()
+		t0 := time.Now()
+		status, _ := rn.run(ctx, "example.com.", opts)
+		if elapsed := time.Since(t0); elapsed > 2*time.Second {
+			t.Errorf("run() took %v, want it bounded by the deadline", elapsed)
+		}
+		if status != 2 {
+			t.Errorf("run() status = %d, want 2", status)
+		}
+		if len(rn.output.Responses) != 1 {
+			t.Fatalf("got %d responses, want 1", len(rn.output.Responses))
+		}
+		if !errors.Is(rn.output.Responses[0].err, errCancelled) {
+			t.Errorf("response error = %v, want cancelled", rn.output.Responses[0].err)
+		}
+	})
+
+	t.Run("cancelled run reports unsent queries", func(t *testing.T) {
+		rn := NewRunner()
+		opts := Options{
+			noqueryns:  true,
+			json:       true,
+			additional: "192.0.2.1,192.0.2.2",
+			Qopts: QueryOptions{
+				timeout: 2 * time.Second,
+				retries: 1,
+				bufsize: defaultBufsize,
+			},
+		}
+
+		ctx, cancel := context.WithCancel(context.Background())
+		cancel()
+		status, _ := rn.run(ctx, "example.com.", opts)
+		if status != 2 {
+			t.Errorf("run() status = %d, want 2", status)
+		}
+		for _, r := range rn.output.Responses {
+			if !contains(r.Err, "cancelled") {
+				t.Errorf("response %s error = %q, want cancelled", r.Nsip, r.Err)
+			}
+		}
+	})
+}
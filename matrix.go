@@ -0,0 +1,373 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net"
+	"os"
+	"strings"
+	"time"
+)
+
+// MatrixCell - result of a SOA query for one zone at one server
+type MatrixCell struct {
+	Name     string  `json:"name"`
+	IP       string  `json:"ip"`
+	Serial   uint32  `json:"serial"`
+	Delta    *int    `json:"delta,omitempty"`
+	Resptime float64 `json:"resptime"`
+	Err      string  `json:"error,omitempty"`
+	ErrCode  string  `json:"error_code,omitempty"`
+	RRL      string  `json:"rrl_suspected,omitempty"`
+	EDE      []EDE   `json:"ede,omitempty"`
+	err      error
+}
+
+// MatrixZone - one zone (row) of the serving matrix
+type MatrixZone struct {
+	Zone    string       `json:"zone"`
+	Serial  uint32       `json:"serial"`
+	Master  *Master      `json:"master,omitempty"`
+	Cells   []MatrixCell `json:"cells"`
+	Current int          `json:"current"`
+	Stale   int          `json:"stale"`
+	Errors  int          `json:"errors"`
+}
+
+// MatrixServer - one server (column) of the serving matrix
+type MatrixServer struct {
+	Name      string `json:"name"`
+	IP        string `json:"ip"`
+	Port      string `json:"port,omitempty"`
+	Transport string `json:"transport,omitempty"`
+	Current   int    `json:"current"`
+	Stale     int    `json:"stale"`
+	Errors    int    `json:"errors"`
+}
+
+// MatrixOutput
+type MatrixOutput struct {
+	Status    int            `json:"status"`
+	Error     string         `json:"error,omitempty"`
+	Timestamp string         `json:"timestamp"`
+	Source    string         `json:"source,omitempty"`
+	Servers   []MatrixServer `json:"servers"`
+	Zones     []MatrixZone   `json:"zones"`
+}
+
+// readZoneList reads zone names from a file, one per line. Blank lines
+// and lines starting with '#' are ignored.
+func readZoneList(filename string) ([]string, error) {
+
+	var zones []string
+
+	f, err := os.Open(filename)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		zones = append(zones, strings.Fields(line)[0])
+	}
+	return zones, scanner.Err()
+}
+
+// currentSerial returns the most recent serial number in the list,
+// using RFC 1982 arithmetic.
+func currentSerial(serials []uint32) uint32 {
+	var current uint32
+	for i, s := range serials {
+		if i == 0 || serialDelta(s, current) > 0 {
+			current = s
+		}
+	}
+	return current
+}
+
+func (rn *Runner) getCellAsync(ctx context.Context, cell *MatrixCell, zone string, req *Request, opts Options) {
+
+	defer rn.wg.Done()
+
+	opts.Qopts = req.queryOptions(opts.Qopts)
+	result, err := getSerial(ctx, zone, req.nsip, opts)
+	<-rn.tokens // Release token
+
+	cell.Name = req.nsname
+	cell.IP = req.nsip.String()
+	cell.Serial = result.serial
+	cell.Resptime = MilliSeconds(result.took)
+	cell.RRL = result.rrl
+	cell.EDE = result.ede
+	cell.err = err
+	if err != nil {
+		cell.Err = err.Error()
+		cell.ErrCode = errorCode(err)
+	}
+}
+
+func (rn *Runner) getMatrixMasterAsync(ctx context.Context, master *Master, zone string, opts Options) {
+
+	defer rn.wg.Done()
+
+	opts.Qopts = opts.masterEndpoint.queryOptions(opts.Qopts)
+	result, err := getSerial(ctx, zone, opts.masterIP, opts)
+	<-rn.tokens // Release token
+
+	master.Name = opts.masterName
+	master.IP = opts.masterIP.String()
+	master.Port = opts.masterEndpoint.port
+	master.Transport = opts.masterEndpoint.transport
+	master.Source = opts.Qopts.sourceString(opts.masterIP)
+	master.Serial = result.serial
+	master.Resptime = MilliSeconds(result.took)
+	master.EDE = result.ede
+	if err != nil {
+		master.Err = err.Error()
+		master.ErrCode = errorCode(err)
+	}
+}
+
+// cancelMatrixCell fills in a cell whose query was never sent because
+// the run was cancelled.
+func cancelMatrixCell(ctx context.Context, cell *MatrixCell, req *Request) {
+	cell.Name = req.nsname
+	cell.IP = req.nsip.String()
+	cell.err = cancelledError(ctx)
+	cell.Err = cell.err.Error()
+	cell.ErrCode = errorCode(cell.err)
+}
+
+// cancelMatrixMaster fills in a master whose query was never sent because
+// the run was cancelled.
+func cancelMatrixMaster(ctx context.Context, master *Master, opts Options) {
+	master.Name = opts.masterName
+	master.IP = opts.masterIP.String()
+	master.Err = cancelledError(ctx).Error()
+	master.ErrCode = errorCode(errCancelled)
+}
+
+// evaluateMatrixZone computes the reference serial for a zone, the delta
+// of each cell from it, and the per zone and per server counts. If the
+// master failed, there is no reference serial, and only the cells that
+// failed are counted.
+func evaluateMatrixZone(row *MatrixZone, servers []MatrixServer, opts *Options) {
+
+	var serials []uint32
+
+	masterFailed := row.Master != nil && row.Master.Err != ""
+	if row.Master != nil {
+		if !masterFailed {
+			row.Serial = row.Master.Serial
+		}
+	} else {
+		for _, cell := range row.Cells {
+			if cell.err == nil {
+				serials = append(serials, cell.Serial)
+			}
+		}
+		row.Serial = currentSerial(serials)
+	}
+
+	for i := range row.Cells {
+		cell := &row.Cells[i]
+		if cell.err != nil {
+			row.Errors++
+			servers[i].Errors++
+			continue
+		}
+		if masterFailed {
+			continue
+		}
+		delta := serialDelta(row.Serial, cell.Serial)
+		cell.Delta = &delta
+		drift, _ := opts.tolerance(cell.Name, net.ParseIP(cell.IP))
+		if serialDistance(row.Serial, cell.Serial) > uint32(drift) {
+			row.Stale++
+			servers[i].Stale++
+		} else {
+			row.Current++
+			servers[i].Current++
+		}
+	}
+}
+
+func printMatrix(m *MatrixOutput) {
+
+	width := len("zone")
+	for _, row := range m.Zones {
+		if len(row.Zone) > width {
+			width = len(row.Zone)
+		}
+	}
+
+	fmt.Printf("## servers:\n")
+	for i, s := range m.Servers {
+		address := Endpoint{port: s.Port, transport: s.Transport}.format(s.IP)
+		fmt.Printf("##  [%d] %s %s\n", i+1, s.Name, address)
+	}
+
+	fmt.Printf("%-*s %10s", width, "zone", "serial")
+	for i := range m.Servers {
+		fmt.Printf(" %6s", fmt.Sprintf("[%d]", i+1))
+	}
+	fmt.Printf(" %7s %5s %6s\n", "current", "stale", "errors")
+
+	for _, row := range m.Zones {
+		if row.Master != nil && row.Master.Err != "" {
+			fmt.Fprintf(os.Stderr, "Error: %s %s %s: couldn't obtain master serial: %s%s\n",
+				row.Zone, row.Master.Name, row.Master.IP, row.Master.Err,
+				edeString(row.Master.EDE, " "))
+			fmt.Printf("%-*s %10s\n", width, row.Zone, "MASTER-ERR")
+			continue
+		}
+		fmt.Printf("%-*s %10d", width, row.Zone, row.Serial)
+		for _, cell := range row.Cells {
+			if cell.err != nil {
+				fmt.Printf(" %6s", "ERR")
+			} else {
+				fmt.Printf(" %6d", *cell.Delta)
+			}
+		}
+		fmt.Printf(" %7d %5d %6d\n", row.Current, row.Stale, row.Errors)
+		for _, cell := range row.Cells {
+			if cell.err != nil {
+				fmt.Fprintf(os.Stderr, "Error: %s %s %s: couldn't obtain serial: %s%s\n",
+					row.Zone, cell.Name, cell.IP, cell.Err, edeString(cell.EDE, " "))
+			}
+		}
+	}
+
+	fmt.Printf("## server summary:\n")
+	for i, s := range m.Servers {
+		fmt.Printf("##  [%d] current %d stale %d errors %d\n",
+			i+1, s.Current, s.Stale, s.Errors)
+	}
+}
+
+// runMatrix queries every zone at every server given with -a, bypassing
+// nameserver discovery, and returns the status and error message.
+func (rn *Runner) runMatrix(ctx context.Context, zones []string, opts Options) (int, string) {
+
+	var err error
+	var rc int
+
+	rn.configure(&opts)
+
+	err = opts.setupResolvers()
+	if err != nil {
+		return 2, fmt.Sprintf("Error getting resolver: %s", err.Error())
+	}
+
+	requests := getRequests(ctx, getAdditionalServers(&opts), &opts)
+	if len(requests) == 0 {
+		return 2, "ERROR: no server addresses to query."
+	}
+
+	if opts.masterIP == nil && opts.masterName != "" {
+		opts.masterIP = getMasterAddress(ctx, opts.masterName, &opts)
+		if opts.masterIP == nil {
+			return 3, fmt.Sprintf("couldn't resolve master name: %s", opts.masterName)
+		}
+	} else if opts.masterIP != nil {
+		opts.masterName = opts.masterIP.String()
+	}
+
+	opts.Qopts.rdflag = false
+	opts.Qopts.conns = NewConnManager()
+	defer opts.Qopts.conns.Close()
+
+	timestamp := time.Now().Format("2006-01-02T15:04:05MST")
+	rn.matrix.Timestamp = timestamp
+	rn.matrix.Source = opts.source
+	if !opts.json {
+		fmt.Printf("## matrix %d zones %d servers %s\n", len(zones), len(requests), timestamp)
+		if opts.source != "" {
+			fmt.Printf("## source %s\n", opts.source)
+		}
+	}
+
+	rn.matrix.Servers = make([]MatrixServer, len(requests))
+	for i, req := range requests {
+		rn.matrix.Servers[i].Name = req.nsname
+		rn.matrix.Servers[i].IP = req.nsip.String()
+		rn.matrix.Servers[i].Port = req.port
+		rn.matrix.Servers[i].Transport = req.transport
+	}
+
+	rn.matrix.Zones = make([]MatrixZone, len(zones))
+	for i, zone := range zones {
+		row := &rn.matrix.Zones[i]
+		row.Zone = zone
+		row.Cells = make([]MatrixCell, len(requests))
+		if opts.masterIP != nil {
+			row.Master = new(Master)
+			if !rn.acquireToken(ctx) {
+				cancelMatrixMaster(ctx, row.Master, opts)
+			} else {
+				rn.wg.Add(1)
+				go rn.getMatrixMasterAsync(ctx, row.Master, zone, opts)
+			}
+		}
+		for j, req := range requests {
+			if !rn.acquireToken(ctx) {
+				cancelMatrixCell(ctx, &row.Cells[j], req)
+				continue
+			}
+			rn.wg.Add(1)
+			go rn.getCellAsync(ctx, &row.Cells[j], zone, req, opts)
+		}
+	}
+	rn.wg.Wait()
+
+	for i := range rn.matrix.Zones {
+		row := &rn.matrix.Zones[i]
+		evaluateMatrixZone(row, rn.matrix.Servers, &opts)
+		if row.Master != nil && row.Master.Err != "" {
+			rc = 3
+			continue
+		}
+		for _, cell := range row.Cells {
+			if cell.err != nil {
+				rc = max(rc, opts.errorStatus(cell.err))
+			}
+		}
+		if row.Stale > 0 {
+			rc = max(rc, 1)
+		}
+	}
+
+	if !opts.json {
+		printMatrix(&rn.matrix)
+	}
+	return rc, ""
+}
+
+func (rn *Runner) formatMatrixOutput(status int, message string, opts Options) {
+
+	rn.matrix.Status = status
+	if status != 0 && message == "" {
+		message = StatusCode[status]
+	}
+	rn.matrix.Error = message
+
+	if opts.json {
+		b, err := json.Marshal(rn.matrix)
+		if err != nil {
+			log.Fatal("error:", err)
+		}
+		fmt.Printf("%s\n", b)
+	} else {
+		if message != "" {
+			fmt.Fprintf(os.Stderr, "Error: %s\n", message)
+		}
+	}
+}
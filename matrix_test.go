@@ -0,0 +1,305 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+func TestReadZoneList(t *testing.T) {
+	dir := t.TempDir()
+	fname := filepath.Join(dir, "zones")
+	content := "# zones to check\nexample.com\n\n  example.net.  \nexample.org trailing words\n"
+	if err := os.WriteFile(fname, []byte(content), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	zones, err := readZoneList(fname)
+	if err != nil {
+		t.Fatalf("readZoneList() unexpected error: %v", err)
+	}
+	expected := []string{"example.com", "example.net.", "example.org"}
+	if len(zones) != len(expected) {
+		t.Fatalf("readZoneList() returned %v, want %v", zones, expected)
+	}
+	for i := range expected {
+		if zones[i] != expected[i] {
+			t.Errorf("readZoneList()[%d] = %q, want %q", i, zones[i], expected[i])
+		}
+	}
+
+	if _, err := readZoneList(filepath.Join(dir, "missing")); err == nil {
+		t.Error("readZoneList() expected error for missing file")
+	}
+}
+
+func TestCurrentSerial(t *testing.T) {
+	tests := []struct {
+		name     string
+		serials  []uint32
+		expected uint32
+	}{
+		{"empty", nil, 0},
+		{"single", []uint32{42}, 42},
+		{"highest wins", []uint32{100, 105, 103}, 105},
+		{"wraparound", []uint32{4294967290, 5, 4294967295}, 5},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			result := currentSerial(tt.serials)
+			if result != tt.expected {
+				t.Errorf("currentSerial(%v) = %d, want %d",
+					tt.serials, result, tt.expected)
+			}
+		})
+	}
+}
+
+func TestEvaluateMatrixZone(t *testing.T) {
+	t.Run("reference is most recent serial", func(t *testing.T) {
+		row := MatrixZone{
+			Zone: "example.com.",
+			Cells: []MatrixCell{
+				{Serial: 105},
+				{Serial: 103},
+				{err: errors.New("timeout")},
+			},
+		}
+		servers := make([]MatrixServer, 3)
+		evaluateMatrixZone(&row, servers, &Options{delta: 1})
+
+		if row.Serial != 105 {
+			t.Errorf("row.Serial = %d, want 105", row.Serial)
+		}
+		if row.Current != 1 || row.Stale != 1 || row.Errors != 1 {
+			t.Errorf("row counts = %d/%d/%d, want 1/1/1",
+				row.Current, row.Stale, row.Errors)
+		}
+		if row.Cells[1].Delta == nil || *row.Cells[1].Delta != 2 {
+			t.Errorf("cell 1 delta = %v, want 2", row.Cells[1].Delta)
+		}
+		if row.Cells[2].Delta != nil {
+			t.Errorf("cell 2 delta = %d, want nil", *row.Cells[2].Delta)
+		}
+		if servers[0].Current != 1 || servers[1].Stale != 1 || servers[2].Errors != 1 {
+			t.Errorf("server counts = %+v", servers)
+		}
+	})
+
+	t.Run("reference is master serial", func(t *testing.T) {
+		row := MatrixZone{
+			Zone:   "example.com.",
+			Master: &Master{Serial: 100},
+			Cells:  []MatrixCell{{Serial: 100}, {Serial: 102}},
+		}
+		servers := make([]MatrixServer, 2)
+		evaluateMatrixZone(&row, servers, &Options{})
+
+		if row.Serial != 100 {
+			t.Errorf("row.Serial = %d, want 100", row.Serial)
+		}
+		if row.Current != 1 || row.Stale != 1 {
+			t.Errorf("row counts = %d/%d, want 1/1", row.Current, row.Stale)
+		}
+		if *row.Cells[1].Delta != -2 {
+			t.Errorf("cell 1 delta = %d, want -2", *row.Cells[1].Delta)
+		}
+	})
+
+	t.Run("master failed", func(t *testing.T) {
+		row := MatrixZone{
+			Zone:   "example.com.",
+			Master: &Master{Err: "timeout"},
+			Cells:  []MatrixCell{{Serial: 100}, {err: errors.New("timeout")}},
+		}
+		servers := make([]MatrixServer, 2)
+		evaluateMatrixZone(&row, servers, &Options{})
+
+		if row.Serial != 0 || row.Cells[0].Delta != nil {
+			t.Errorf("row.Serial = %d, cell 0 delta = %v, want no reference",
+				row.Serial, row.Cells[0].Delta)
+		}
+		if row.Current != 0 || row.Stale != 0 || row.Errors != 1 {
+			t.Errorf("row counts = %d/%d/%d, want 0/0/1",
+				row.Current, row.Stale, row.Errors)
+		}
+		if servers[0].Errors != 0 || servers[1].Errors != 1 {
+			t.Errorf("server counts = %+v", servers)
+		}
+	})
+}
+
+// zoneSOAHandler returns a handler that answers SOA queries with the
+// serial configured for the zone, less lag, and refuses other zones.
+func zoneSOAHandler(serials map[string]uint32, lag uint32) dns.Handler {
+	return dns.HandlerFunc(func(w dns.ResponseWriter, r *dns.Msg) {
+		serial, ok := serials[r.Question[0].Name]
+		if !ok {
+			m := new(dns.Msg)
+			m.SetRcode(r, dns.RcodeRefused)
+			w.WriteMsg(m)
+			return
+		}
+		serial -= lag
+		m := new(dns.Msg)
+		m.SetReply(r)
+		m.Answer = []dns.RR{
+			&dns.SOA{
+				Hdr: dns.RR_Header{
+					Name:   r.Question[0].Name,
+					Rrtype: dns.TypeSOA,
+					Class:  dns.ClassINET,
+					Ttl:    3600,
+				},
+				Ns:     "ns1.example.com.",
+				Mbox:   "admin.example.com.",
+				Serial: serial,
+			},
+		}
+		w.WriteMsg(m)
+	})
+}
+
+// newLoopbackServers starts two mock servers on 127.0.0.1 and 127.0.0.2
+// sharing the same port, the second one lagging by lag serials, and
+// returns the port.
+func newLoopbackServers(t *testing.T, serials map[string]uint32, lag uint32) string {
+	s1 := newMockDNSServerAt(t, zoneSOAHandler(serials, 0), "127.0.0.1:0", "127.0.0.1:0")
+	t.Cleanup(s1.close)
+	_, port, _ := net.SplitHostPort(s1.udpAddr)
+	s1.close()
+	s1 = newMockDNSServerAt(t, zoneSOAHandler(serials, 0),
+		"127.0.0.1:"+port, "127.0.0.1:"+port)
+	t.Cleanup(s1.close)
+	s2 := newMockDNSServerAt(t, zoneSOAHandler(serials, lag),
+		"127.0.0.2:"+port, "127.0.0.2:"+port)
+	t.Cleanup(s2.close)
+	return port
+}
+
+func TestRunMatrix(t *testing.T) {
+	serials := map[string]uint32{
+		"example.com.": 2024010100,
+		"example.net.": 2024020200,
+	}
+
+	newOpts := func(port string) Options {
+		return Options{
+			matrix:     true,
+			noqueryns:  true,
+			json:       true,
+			additional: "127.0.0.1,127.0.0.2",
+			Qopts: QueryOptions{
+				timeout: 2 * time.Second,
+				retries: 1,
+				bufsize: defaultBufsize,
+				port:    port,
+			},
+		}
+	}
+
+	t.Run("all current returns 0", func(t *testing.T) {
+		port := newLoopbackServers(t, serials, 0)
+
+		rn := NewRunner()
+		status, message := rn.runMatrix(context.Background(), []string{"example.com.", "example.net."}, newOpts(port))
+		if status != 0 {
+			t.Fatalf("runMatrix() status = %d, want 0; message = %q", status, message)
+		}
+		if len(rn.matrix.Zones) != 2 || len(rn.matrix.Servers) != 2 {
+			t.Fatalf("matrix is %d zones x %d servers, want 2 x 2",
+				len(rn.matrix.Zones), len(rn.matrix.Servers))
+		}
+		if rn.matrix.Zones[1].Serial != 2024020200 {
+			t.Errorf("example.net. serial = %d, want 2024020200",
+				rn.matrix.Zones[1].Serial)
+		}
+		for _, s := range rn.matrix.Servers {
+			if s.Current != 2 {
+				t.Errorf("server %s current = %d, want 2", s.IP, s.Current)
+			}
+		}
+	})
+
+	t.Run("lagging server returns 1", func(t *testing.T) {
+		port := newLoopbackServers(t, serials, 1)
+
+		rn := NewRunner()
+		status, _ := rn.runMatrix(context.Background(), []string{"example.com.", "example.net."}, newOpts(port))
+		if status != 1 {
+			t.Errorf("runMatrix() status = %d, want 1", status)
+		}
+		if rn.matrix.Servers[1].Stale != 2 {
+			t.Errorf("lagging server stale = %d, want 2", rn.matrix.Servers[1].Stale)
+		}
+		if rn.matrix.Zones[0].Stale != 1 || rn.matrix.Zones[0].Current != 1 {
+			t.Errorf("example.com. counts current %d stale %d, want 1/1",
+				rn.matrix.Zones[0].Current, rn.matrix.Zones[0].Stale)
+		}
+	})
+
+	t.Run("unserved zone returns 2", func(t *testing.T) {
+		port := newLoopbackServers(t, serials, 0)
+
+		rn := NewRunner()
+		status, _ := rn.runMatrix(context.Background(), []string{"example.com.", "example.org."}, newOpts(port))
+		if status != 2 {
+			t.Errorf("runMatrix() status = %d, want 2", status)
+		}
+		if rn.matrix.Zones[1].Errors != 2 {
+			t.Errorf("example.org. errors = %d, want 2", rn.matrix.Zones[1].Errors)
+		}
+	})
+
+	t.Run("per server limits are applied", func(t *testing.T) {
+		port := newLoopbackServers(t, serials, 0)
+
+		rn := NewRunner()
+		opts := newOpts(port)
+		opts.parallel = 1
+		opts.qps = 20
+		opts.maxq = 1
+		zones := []string{"example.com.", "example.net.", "example.com.", "example.net."}
+		t0 := time.Now()
+		status, message := rn.runMatrix(context.Background(), zones, opts)
+		if status != 0 {
+			t.Fatalf("runMatrix() status = %d, want 0; message = %q", status, message)
+		}
+		// 4 queries per server at 20 qps take at least 150ms
+		if elapsed := time.Since(t0); elapsed < 140*time.Millisecond {
+			t.Errorf("runMatrix() took %v, want at least 150ms", elapsed)
+		}
+		if cap(rn.tokens) != 1 {
+			t.Errorf("concurrency limit = %d, want 1", cap(rn.tokens))
+		}
+	})
+
+	t.Run("master failure returns 3", func(t *testing.T) {
+		port := newLoopbackServers(t, serials, 0)
+
+		rn := NewRunner()
+		opts := newOpts(port)
+		opts.masterIP = net.ParseIP("127.0.0.1")
+		status, _ := rn.runMatrix(context.Background(), []string{"example.com.", "example.org."}, opts)
+		if status != 3 {
+			t.Errorf("runMatrix() status = %d, want 3", status)
+		}
+		// The servers' failures for the zone the master failed for
+		// are still counted
+		if rn.matrix.Zones[1].Errors != 2 {
+			t.Errorf("example.org. errors = %d, want 2", rn.matrix.Zones[1].Errors)
+		}
+		for _, s := range rn.matrix.Servers {
+			if s.Current != 1 || s.Errors != 1 {
+				t.Errorf("server %s current %d errors %d, want 1/1", s.IP, s.Current, s.Errors)
+			}
+		}
+	})
+}
@@ -12,19 +12,54 @@ import (
 
 // Options - main options
 type Options struct {
-	Qopts        QueryOptions
-	V6Only       bool
-	V4Only       bool
-	sortresponse bool
-	json         bool
-	resolvconf   string
-	resolvers    []net.IP
-	masterIP     net.IP
-	masterName   string
-	additional   string
-	noqueryns    bool
-	masterSerial uint32
-	delta        int
+	Qopts          QueryOptions
+	V6Only         bool
+	V4Only         bool
+	sortresponse   bool
+	json           bool
+	resolvconf     string
+	resolvers      *ResolverConfig
+	resolverList   []Resolver
+	showresolver   bool
+	masterIP       net.IP
+	masterName     string
+	masterEndpoint Endpoint
+	additional     string
+	noqueryns      bool
+	masterSerial   uint32
+	delta          int
+	matrix         bool
+	zonefile       string
+	zones          []string
+	deadline       time.Duration
+	cachefile      string
+	cache          *DiscoveryCache
+	parallel       int
+	qps            float64
+	maxq           int
+	errstatus      map[string]int
+	chaos          bool
+	anycast        int
+	reach          bool
+	edns           bool
+	cookie         bool
+	dualstack      bool
+	audit          bool
+	xfr            bool
+	xfrdiff        bool
+	diversity      bool
+	asnfile        string
+	asns           ASNTable
+	divpolicy      map[string]int
+	count          int
+	interval       time.Duration
+	rttwarn        int
+	rttcrit        int
+	rttmedian      bool
+	driftfile      string
+	driftOverrides DriftOverrides
+	sources        []SourceSet
+	source         string
 }
 
 // QueryOptions - query options
@@ -35,9 +70,19 @@ type QueryOptions struct {
 	timeout time.Duration
 	retries int
 	tcp     bool
+	tls     bool
+	udpOnly bool
 	bufsize uint16
 	nsid    bool
+	qclass  uint16
+	tsig    *TSIGKey
 	port    string
+	source4 net.IP
+	source6 net.IP
+	cookie  string
+	cookies *CookieJar
+	conns   *ConnManager
+	limiter *DestLimiter
 }
 
 // Defaults
@@ -46,6 +91,8 @@ var (
 	defaultRetries     = 3
 	defaultSerialDelta = 0
 	defaultBufsize     = uint16(1400)
+	defaultParallel    = 20
+	defaultInterval    = 1000
 )
 
 func doFlags() (string, Options, error) {
@@ -57,45 +104,161 @@ func doFlags() (string, Options, error) {
 	flag.BoolVar(&opts.sortresponse, "s", false, "sort responses")
 	flag.BoolVar(&opts.json, "j", false, "output json")
 	flag.BoolVar(&opts.Qopts.tcp, "c", false, "use TCP for queries")
+	flag.BoolVar(&opts.Qopts.tls, "tls", false, "use DNS over TLS for queries")
+	sources := flag.String("source", "", "source addresses or interfaces to bind queries to, one run each: s1,s2..")
 	flag.StringVar(&opts.resolvconf, "cf", "", "use alternate resolv.conf file")
+	resolver := flag.String("resolver", "", "resolvers for nameserver discovery: [tcp://|tls://|udp://]addr[:port],..")
+	flag.BoolVar(&opts.showresolver, "showresolver", false, "report which resolver answered each discovery query")
+	flag.StringVar(&opts.cachefile, "cache", "", "file to keep nameserver discovery cache in")
 	master := flag.String("m", "", "master server name or address")
 	flag.StringVar(&opts.additional, "a", "", "additional nameservers: n1,n2..")
 	flag.BoolVar(&opts.noqueryns, "n", false, "don't query advertised nameservers")
 	flag.IntVar(&opts.delta, "d", defaultSerialDelta, "allowed serial number drift")
+	flag.BoolVar(&opts.diversity, "diversity", false, "report the resilience and diversity of the nameserver set")
+	flag.StringVar(&opts.asnfile, "asnfile", "", "file with prefix to origin ASN mappings for -diversity")
+	divpolicy := flag.String("divpolicy", "", "minimum nameserver diversity: metric=N,..")
+	flag.StringVar(&opts.driftfile, "df", "", "file with allowed drift per server name, address or prefix")
+	flag.IntVar(&opts.parallel, "p", defaultParallel, "maximum number of concurrent queries")
+	flag.Float64Var(&opts.qps, "qps", 0, "maximum queries per second per server address")
+	flag.IntVar(&opts.maxq, "maxq", 0, "maximum concurrent queries per server address")
 	timeoutp := flag.Int("t", defaultTimeout, "query timeout in seconds")
+	deadlinep := flag.Int("deadline", 0, "deadline for the whole run in seconds")
 	flag.IntVar(&opts.Qopts.retries, "r", defaultRetries, "number of query retries")
 	var bufsize uint
 	flag.UintVar(&bufsize, "b", uint(defaultBufsize), "buffer size for DNS messages")
 	flag.BoolVar(&opts.Qopts.nsid, "nsid", false, "request NSID option in DNS queries")
+	flag.BoolVar(&opts.cookie, "cookie", false, "send DNS cookies in SOA queries and verify server cookies")
+	flag.BoolVar(&opts.chaos, "chaos", false, "query server identity and version (CHAOS TXT)")
+	flag.IntVar(&opts.anycast, "anycast", 0, "number of probes to find anycast instances")
+	flag.BoolVar(&opts.reach, "reach", false, "query each server over UDP and TCP (and TLS with -tls)")
+	flag.BoolVar(&opts.edns, "edns", false, "test the EDNS compliance of each server")
+	flag.BoolVar(&opts.xfr, "xfr", false, "transfer the zone from each server and compare the contents")
+	flag.BoolVar(&opts.xfrdiff, "xfrdiff", false, "with -xfr, list the RRsets that differ")
+	flag.BoolVar(&opts.audit, "audit", false, "audit each server for open recursion, zone transfers and version disclosure")
+	flag.BoolVar(&opts.dualstack, "dualstack", false, "compare the IPv4 and IPv6 addresses of each nameserver")
+	flag.IntVar(&opts.count, "count", 1, "number of times to query each server")
+	intervalp := flag.Int("interval", defaultInterval, "interval between repeated queries in milliseconds")
+	flag.IntVar(&opts.rttwarn, "rttwarn", 0, "response time warning threshold in milliseconds")
+	flag.IntVar(&opts.rttcrit, "rttcrit", 0, "response time critical threshold in milliseconds")
+	flag.BoolVar(&opts.rttmedian, "rttmedian", false, "also check median response time of all servers")
+	flag.BoolVar(&opts.matrix, "matrix", false, "query every zone at every -a server")
+	flag.StringVar(&opts.zonefile, "zf", "", "file with list of zones for -matrix")
+	errstatus := flag.String("errstatus", "", "exit status by error class: class=N,..")
+	tsigkey := flag.String("y", "", "TSIG key to sign SOA queries with: [alg:]name:secret")
+	configfile := flag.String("config", "", "configuration file with defaults and profiles")
+	profile := flag.String("profile", "", "configuration file profile to use")
 
 	flag.Usage = func() {
 		fmt.Fprintf(os.Stderr, `%s, version %s
 Usage: %s [Options] <zone>
+       %s [Options] -matrix -a ns1,.. <zone> [<zone> ...]
 
 	Options:
 	-h          Print this help string
+	-config file
+	            Read defaults and check profiles from configuration file
+	-profile name
+	            Use the named profile of the configuration file (default:
+	            the profile listing the zone, if any)
 	-4          Use IPv4 transport only
 	-6          Use IPv6 transport only
 	-cf file    Use alternate resolv.conf file
+	-resolver [tcp://|tls://|udp://]addr[:port],..
+	            Use the given resolvers for nameserver discovery, instead of
+	            those in resolv.conf (IPv6 addresses with a port in brackets)
+	-showresolver
+	            Report which resolver answered each discovery query
+	-cache file Keep nameserver names and addresses in a cache file
 	-s          Print responses sorted by domain name and IP version
 	-j          Produce json formatted output (implies -s)
 	-c          Use TCP for queries (default: UDP with TCP on truncation)
+	-tls        Use DNS over TLS (port 853, unauthenticated) for queries
+	-source s1,..
+	            Bind queries to the servers to the given source addresses,
+	            with a separate run for each; each s is an address, an IPv4
+	            and an IPv6 address joined with '+', or an interface name
 	-t N        Query timeout value in seconds (default %d)
+	-deadline N Deadline for the whole run in seconds (default: none)
 	-r N        Maximum # SOA query retries for each server (default %d)
 	-d N        Allowed SOA serial number drift (default %d)
+	-df file    Read allowed drift per server name, address or prefix from file
+	-diversity  Report the number of nameserver names and addresses, their
+	            IPv6 coverage, and how many distinct /24 and /48 prefixes
+	            (and origin ASNs, with -asnfile) they are in
+	-asnfile file
+	            Read prefix to origin ASN mappings for -diversity from file
+	-divpolicy metric=N,..
+	            Minimum names, addresses, ipv6 (names with IPv6), prefixes
+	            or asns for -diversity, failing the check (exit status 7)
+	-p N        Maximum number of concurrent queries (default %d)
+	-qps N      Maximum queries per second to each server address, counting
+	            retries and TCP fallbacks
+	-maxq N     Maximum concurrent queries to each server address
 	-b N        Buffer size for DNS messages (default %d)
+	-y [alg:]name:secret
+	            Sign SOA queries with TSIG key (default alg hmac-sha256)
+	-errstatus class=N,..
+	            Exit status for servers failing with the given error classes
+	            (default 2 for all)
 	-nsid       Request NSID option in DNS queries
+	-cookie     Send DNS cookies in SOA queries, and report whether each
+	            server returns a valid server cookie and accepts it back
+	-chaos      Query server identity and version with CHAOS class TXT
+	            queries (hostname.bind, id.server, version.bind, version.server)
+	-anycast N  Send N extra SOA queries with NSID to each server address, and
+	            report the serial of every distinct (anycast) instance seen
+	-reach      Also query each server address over UDP and TCP (and DNS over
+	            TLS with -tls), and flag servers that fail over one of them
+	            or return different serials
+	-edns       Test the EDNS compliance of each server address, with queries
+	            without EDNS, with an unknown EDNS version, option or flag,
+	            with DO, and with various buffer sizes
+	-xfr        Transfer the zone (AXFR, signed with the -y key if given) from
+	            the master and each server that allows it, and flag servers
+	            whose zone contents differ from others with the same serial
+	-xfrdiff    Like -xfr, and also list the RRsets that differ
+	-audit      Check whether each server address answers recursive queries
+	            for names outside the zone, allows zone transfers (AXFR) of
+	            the zone, or discloses its version (exit status 8 if so)
+	-dualstack  Compare the serials, NSIDs and identities returned by the
+	            IPv4 and IPv6 addresses of each nameserver name, and print
+	            the responses grouped by name with a summary for each
+	-count N    Query each server N times, and report RTT statistics and loss
+	-interval N Interval between repeated queries in milliseconds (default %d)
+	-rttwarn N  Response time warning threshold in milliseconds
+	-rttcrit N  Response time critical threshold in milliseconds
+	-rttmedian  Also apply the thresholds to the median response time
 	-m ns       Master server name/address to compare serial numbers with
 	-a ns1,..   Specify additional nameserver names/addresses to query
+	            (each ns may be given as [tcp://|tls://|udp://]ns[@port]
+	            or ns:port, with an IPv6 address in brackets, also for -m)
 	-n          Don't query advertised nameservers for the zone
-`, progname, Version, progname, defaultTimeout, defaultRetries, defaultSerialDelta, defaultBufsize)
+	-matrix     Query every zone at every -a server and print a matrix
+	-zf file    Read list of zones for -matrix from file
+`, progname, Version, progname, progname, defaultTimeout, defaultRetries, defaultSerialDelta, defaultParallel, defaultBufsize, defaultInterval)
 	}
 
 	flag.Parse()
+	if *configfile != "" {
+		zone := ""
+		if !opts.matrix && flag.NArg() == 1 {
+			zone = flag.Arg(0)
+		}
+		if err := applyConfig(*configfile, *profile, zone); err != nil {
+			return "", opts, fmt.Errorf("-config: %s", err.Error())
+		}
+	} else if *profile != "" {
+		return "", opts, fmt.Errorf("-profile requires -config")
+	}
 	opts.Qopts.timeout = time.Second * time.Duration(*timeoutp)
+	opts.deadline = time.Second * time.Duration(*deadlinep)
+	opts.interval = time.Millisecond * time.Duration(*intervalp)
 	opts.Qopts.bufsize = uint16(bufsize)
 
-	if opts.json {
+	if opts.xfrdiff {
+		opts.xfr = true
+	}
+	if opts.json || opts.dualstack || opts.xfr {
 		opts.sortresponse = true
 	}
 
@@ -105,28 +268,129 @@ Usage: %s [Options] <zone>
 	}
 
 	if *master != "" {
-		opts.masterIP = net.ParseIP(*master)
+		server, err := parseServer(*master)
+		if err != nil {
+			return "", opts, fmt.Errorf("-m: %s", err.Error())
+		}
+		opts.masterEndpoint = server.Endpoint
+		opts.masterIP = net.ParseIP(server.name)
 		if opts.masterIP == nil { // assume hostname
-			opts.masterName = dns.Fqdn(*master)
+			opts.masterName = server.name
+		}
+	}
+	if opts.additional != "" {
+		if _, err := parseServers(opts.additional); err != nil {
+			return "", opts, fmt.Errorf("-a: %s", err.Error())
 		}
 	}
 
 	if *timeoutp <= 0 {
 		return "", opts, fmt.Errorf("-t timeout must be a positive integer")
 	}
+	if *deadlinep < 0 {
+		return "", opts, fmt.Errorf("-deadline must be a non-negative integer")
+	}
 	if opts.Qopts.retries <= 0 {
 		return "", opts, fmt.Errorf("-r retries must be a positive integer")
 	}
 	if opts.delta < 0 {
 		return "", opts, fmt.Errorf("-d delta must be a non-negative integer")
 	}
+	if opts.parallel <= 0 {
+		return "", opts, fmt.Errorf("-p parallelism must be a positive integer")
+	}
+	if opts.qps < 0 {
+		return "", opts, fmt.Errorf("-qps must not be negative")
+	}
+	if opts.maxq < 0 {
+		return "", opts, fmt.Errorf("-maxq must be a non-negative integer")
+	}
+	if opts.anycast < 0 {
+		return "", opts, fmt.Errorf("-anycast must be a non-negative integer")
+	}
+	if opts.count <= 0 {
+		return "", opts, fmt.Errorf("-count must be a positive integer")
+	}
+	if *intervalp < 0 {
+		return "", opts, fmt.Errorf("-interval must be a non-negative integer")
+	}
+	if opts.rttwarn < 0 || opts.rttcrit < 0 {
+		return "", opts, fmt.Errorf("-rttwarn and -rttcrit must be non-negative integers")
+	}
+	if opts.rttwarn > 0 && opts.rttcrit > 0 && opts.rttcrit < opts.rttwarn {
+		return "", opts, fmt.Errorf("-rttcrit must not be lower than -rttwarn")
+	}
+	if opts.rttmedian && opts.rttwarn == 0 && opts.rttcrit == 0 {
+		return "", opts, fmt.Errorf("-rttmedian requires -rttwarn or -rttcrit")
+	}
 	if bufsize < 512 {
 		return "", opts, fmt.Errorf("-b buffer size must be at least 512")
 	}
 
+	var err error
+	opts.errstatus, err = parseErrorStatus(*errstatus)
+	if err != nil {
+		return "", opts, fmt.Errorf("-errstatus: %s", err.Error())
+	}
+	if *tsigkey != "" {
+		opts.Qopts.tsig, err = parseTSIGKey(*tsigkey)
+		if err != nil {
+			return "", opts, fmt.Errorf("-y: %s", err.Error())
+		}
+	}
+	if *sources != "" {
+		opts.sources, err = parseSources(*sources)
+		if err != nil {
+			return "", opts, fmt.Errorf("-source: %s", err.Error())
+		}
+		for _, set := range opts.sources {
+			if (opts.V4Only && set.v4 == nil) || (opts.V6Only && set.v6 == nil) {
+				return "", opts, fmt.Errorf("-source: %s: no address of the family given with -4 or -6", set.name)
+			}
+		}
+	}
+	if *resolver != "" {
+		opts.resolverList, err = parseResolvers(*resolver)
+		if err != nil {
+			return "", opts, fmt.Errorf("-resolver: %s", err.Error())
+		}
+	}
+	if opts.driftfile != "" {
+		opts.driftOverrides, err = LoadDriftOverrides(opts.driftfile)
+		if err != nil {
+			return "", opts, fmt.Errorf("-df: %s", err.Error())
+		}
+	}
+	opts.divpolicy, err = parseDiversityPolicy(*divpolicy)
+	if err != nil {
+		return "", opts, fmt.Errorf("-divpolicy: %s", err.Error())
+	}
+	if opts.asnfile != "" {
+		opts.asns, err = LoadASNTable(opts.asnfile)
+		if err != nil {
+			return "", opts, fmt.Errorf("-asnfile: %s", err.Error())
+		}
+	}
+	if opts.asnfile != "" || *divpolicy != "" {
+		opts.diversity = true
+	}
+	if _, ok := opts.divpolicy["asns"]; ok && opts.asnfile == "" {
+		return "", opts, fmt.Errorf("-divpolicy: asns requires -asnfile")
+	}
+
 	if opts.V4Only && opts.V6Only {
 		return "", opts, fmt.Errorf("cannot specify both -4 and -6")
 	}
+	if opts.dualstack && (opts.V4Only || opts.V6Only) {
+		return "", opts, fmt.Errorf("-dualstack cannot be used with -4 or -6")
+	}
+
+	if opts.matrix {
+		return doMatrixFlags(opts)
+	}
+	if opts.zonefile != "" {
+		return "", opts, fmt.Errorf("-zf requires -matrix")
+	}
 
 	if flag.NArg() != 1 {
 		flag.Usage()
@@ -135,3 +399,64 @@ Usage: %s [Options] <zone>
 	args := flag.Args()
 	return dns.Fqdn(args[0]), opts, nil
 }
+
+// grouped returns whether the responses are printed once they are all
+// in, grouped by nameserver name, rather than as they arrive.
+func (opts *Options) grouped() bool {
+	return opts.sortresponse || opts.json || opts.dualstack || opts.xfr
+}
+
+// doMatrixFlags validates the options for -matrix mode and collects
+// the list of zones from the arguments and the -zf zone list file.
+func doMatrixFlags(opts Options) (string, Options, error) {
+
+	if opts.additional == "" {
+		return "", opts, fmt.Errorf("-matrix requires a list of servers (-a)")
+	}
+	if opts.anycast > 0 {
+		return "", opts, fmt.Errorf("-anycast is not supported with -matrix")
+	}
+	if opts.count > 1 {
+		return "", opts, fmt.Errorf("-count is not supported with -matrix")
+	}
+	if opts.reach {
+		return "", opts, fmt.Errorf("-reach is not supported with -matrix")
+	}
+	if opts.edns {
+		return "", opts, fmt.Errorf("-edns is not supported with -matrix")
+	}
+	if opts.cookie {
+		return "", opts, fmt.Errorf("-cookie is not supported with -matrix")
+	}
+	if opts.dualstack {
+		return "", opts, fmt.Errorf("-dualstack is not supported with -matrix")
+	}
+	if opts.diversity {
+		return "", opts, fmt.Errorf("-diversity is not supported with -matrix")
+	}
+	if opts.audit {
+		return "", opts, fmt.Errorf("-audit is not supported with -matrix")
+	}
+	if opts.xfr {
+		return "", opts, fmt.Errorf("-xfr is not supported with -matrix")
+	}
+	opts.noqueryns = true
+
+	for _, arg := range flag.Args() {
+		opts.zones = append(opts.zones, dns.Fqdn(arg))
+	}
+	if opts.zonefile != "" {
+		zones, err := readZoneList(opts.zonefile)
+		if err != nil {
+			return "", opts, fmt.Errorf("-zf: %s", err.Error())
+		}
+		for _, zone := range zones {
+			opts.zones = append(opts.zones, dns.Fqdn(zone))
+		}
+	}
+	if len(opts.zones) == 0 {
+		flag.Usage()
+		return "", opts, fmt.Errorf("no zones specified")
+	}
+	return opts.zones[0], opts, nil
+}
@@ -265,3 +265,357 @@ func TestAdditionalNameservers(t *testing.T) {
 		t.Errorf("Expected additional nameservers 'ns1.example.com,ns2.example.com', got '%s'", opts.additional)
 	}
 }
+
+func TestMatrixOptions(t *testing.T) {
+	// Save original args and restore them after the test
+	origArgs := os.Args
+	defer func() { os.Args = origArgs }()
+
+	// Multiple zones are accepted in matrix mode
+	resetFlags()
+	os.Args = []string{"cmd", "-matrix", "-a", "ns1.example.net", "example.com", "example.org"}
+	zone, opts, err := doFlags()
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if zone != "example.com." {
+		t.Errorf("Expected zone 'example.com.', got '%s'", zone)
+	}
+	if len(opts.zones) != 2 || opts.zones[1] != "example.org." {
+		t.Errorf("Expected zones [example.com. example.org.], got %v", opts.zones)
+	}
+	if !opts.noqueryns {
+		t.Error("Expected -matrix to imply -n")
+	}
+
+	// Matrix mode requires a server list
+	resetFlags()
+	os.Args = []string{"cmd", "-matrix", "example.com"}
+	_, _, err = doFlags()
+	if err == nil {
+		t.Error("Expected error when -matrix is given without -a")
+	}
+
+	// Zone list file requires matrix mode
+	resetFlags()
+	os.Args = []string{"cmd", "-zf", "zones.txt", "example.com"}
+	_, _, err = doFlags()
+	if err == nil {
+		t.Error("Expected error when -zf is given without -matrix")
+	}
+}
+
+func TestDeadlineOption(t *testing.T) {
+	// Save original args and restore them after the test
+	origArgs := os.Args
+	defer func() { os.Args = origArgs }()
+
+	resetFlags()
+	os.Args = []string{"cmd", "example.com"}
+	_, opts, err := doFlags()
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if opts.deadline != 0 {
+		t.Errorf("Expected no deadline by default, got %v", opts.deadline)
+	}
+
+	resetFlags()
+	os.Args = []string{"cmd", "-deadline", "30", "example.com"}
+	_, opts, err = doFlags()
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if opts.deadline != 30*time.Second {
+		t.Errorf("Expected deadline 30s, got %v", opts.deadline)
+	}
+
+	resetFlags()
+	os.Args = []string{"cmd", "-deadline", "-1", "example.com"}
+	_, _, err = doFlags()
+	if err == nil {
+		t.Error("Expected error for negative -deadline")
+	}
+}
+
+func TestConcurrencyOptions(t *testing.T) {
+	// Save original args and restore them after the test
+	origArgs := os.Args
+	defer func() { os.Args = origArgs }()
+
+	resetFlags()
+	os.Args = []string{"cmd", "example.com"}
+	_, opts, err := doFlags()
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if opts.parallel != defaultParallel || opts.qps != 0 || opts.maxq != 0 {
+		t.Errorf("Expected defaults %d/0/0, got %d/%v/%d",
+			defaultParallel, opts.parallel, opts.qps, opts.maxq)
+	}
+
+	resetFlags()
+	os.Args = []string{"cmd", "-p", "100", "-qps", "2.5", "-maxq", "4", "example.com"}
+	_, opts, err = doFlags()
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if opts.parallel != 100 || opts.qps != 2.5 || opts.maxq != 4 {
+		t.Errorf("Expected 100/2.5/4, got %d/%v/%d", opts.parallel, opts.qps, opts.maxq)
+	}
+
+	for _, args := range [][]string{
+		{"cmd", "-p", "0", "example.com"},
+		{"cmd", "-qps", "-1", "example.com"},
+		{"cmd", "-maxq", "-1", "example.com"},
+	} {
+		resetFlags()
+		os.Args = args
+		if _, _, err := doFlags(); err == nil {
+			t.Errorf("Expected error for %v", args[1:3])
+		}
+	}
+}
+
+func TestErrorStatusOption(t *testing.T) {
+	// Save original args and restore them after the test
+	origArgs := os.Args
+	defer func() { os.Args = origArgs }()
+
+	resetFlags()
+	os.Args = []string{"cmd", "-errstatus", "timeout=1,lame=0", "example.com"}
+	_, opts, err := doFlags()
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if opts.errstatus["timeout"] != 1 || opts.errstatus["lame"] != 0 || len(opts.errstatus) != 2 {
+		t.Errorf("Expected timeout=1,lame=0, got %v", opts.errstatus)
+	}
+
+	resetFlags()
+	os.Args = []string{"cmd", "-errstatus", "bogus=1", "example.com"}
+	if _, _, err := doFlags(); err == nil {
+		t.Error("Expected error for unknown error class")
+	}
+}
+
+func TestAnycastOption(t *testing.T) {
+	// Save original args and restore them after the test
+	origArgs := os.Args
+	defer func() { os.Args = origArgs }()
+
+	resetFlags()
+	os.Args = []string{"cmd", "-anycast", "10", "example.com"}
+	_, opts, err := doFlags()
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if opts.anycast != 10 {
+		t.Errorf("Expected anycast 10, got %d", opts.anycast)
+	}
+
+	for _, args := range [][]string{
+		{"cmd", "-anycast", "-1", "example.com"},
+		{"cmd", "-anycast", "5", "-matrix", "-a", "ns1", "example.com"},
+	} {
+		resetFlags()
+		os.Args = args
+		if _, _, err := doFlags(); err == nil {
+			t.Errorf("Expected error for %v", args[1:])
+		}
+	}
+}
+
+func TestCountOptions(t *testing.T) {
+	// Save original args and restore them after the test
+	origArgs := os.Args
+	defer func() { os.Args = origArgs }()
+
+	resetFlags()
+	os.Args = []string{"cmd", "example.com"}
+	_, opts, err := doFlags()
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if opts.count != 1 || opts.interval != time.Second {
+		t.Errorf("Expected count 1 interval 1s, got %d %v", opts.count, opts.interval)
+	}
+
+	resetFlags()
+	os.Args = []string{"cmd", "-count", "10", "-interval", "250", "example.com"}
+	_, opts, err = doFlags()
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if opts.count != 10 || opts.interval != 250*time.Millisecond {
+		t.Errorf("Expected count 10 interval 250ms, got %d %v", opts.count, opts.interval)
+	}
+
+	for _, args := range [][]string{
+		{"cmd", "-count", "0", "example.com"},
+		{"cmd", "-interval", "-1", "example.com"},
+		{"cmd", "-count", "3", "-matrix", "-a", "ns1", "example.com"},
+	} {
+		resetFlags()
+		os.Args = args
+		if _, _, err := doFlags(); err == nil {
+			t.Errorf("Expected error for %v", args[1:])
+		}
+	}
+}
+
+func TestResolverOption(t *testing.T) {
+	// Save original args and restore them after the test
+	origArgs := os.Args
+	defer func() { os.Args = origArgs }()
+
+	resetFlags()
+	os.Args = []string{"cmd", "-resolver", "9.9.9.9,tls://[2001:db8::53]:8853", "example.com"}
+	_, opts, err := doFlags()
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if len(opts.resolverList) != 2 || opts.resolverList[1].transport != "tls" ||
+		opts.resolverList[1].port != "8853" {
+		t.Errorf("Expected 2 resolvers, the second over TLS at port 8853, got %+v",
+			opts.resolverList)
+	}
+
+	resetFlags()
+	os.Args = []string{"cmd", "-resolver", "resolver.example.net", "example.com"}
+	if _, _, err := doFlags(); err == nil {
+		t.Error("Expected error for resolver name")
+	}
+}
+
+func TestServerEndpointOptions(t *testing.T) {
+	// Save original args and restore them after the test
+	origArgs := os.Args
+	defer func() { os.Args = origArgs }()
+
+	resetFlags()
+	os.Args = []string{"cmd", "-m", "tls://ns0.example.com@8853", "-a", "192.0.2.1@5353", "example.com"}
+	_, opts, err := doFlags()
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if opts.masterName != "ns0.example.com." || opts.masterEndpoint.port != "8853" ||
+		opts.masterEndpoint.transport != "tls" {
+		t.Errorf("Expected master ns0.example.com. over TLS at port 8853, got %s %+v",
+			opts.masterName, opts.masterEndpoint)
+	}
+
+	resetFlags()
+	os.Args = []string{"cmd", "-a", "ns1.example.com@dns", "example.com"}
+	if _, _, err := doFlags(); err == nil {
+		t.Error("Expected error for invalid -a port")
+	}
+
+	resetFlags()
+	os.Args = []string{"cmd", "-m", "quic://192.0.2.1", "example.com"}
+	if _, _, err := doFlags(); err == nil {
+		t.Error("Expected error for unknown -m transport")
+	}
+}
+
+func TestSourceOption(t *testing.T) {
+	// Save original args and restore them after the test
+	origArgs := os.Args
+	defer func() { os.Args = origArgs }()
+
+	resetFlags()
+	os.Args = []string{"cmd", "-source", "192.0.2.10,192.0.2.11+2001:db8::11", "example.com"}
+	_, opts, err := doFlags()
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if len(opts.sources) != 2 {
+		t.Errorf("Expected 2 source sets, got %v", opts.sources)
+	}
+
+	resetFlags()
+	os.Args = []string{"cmd", "-6", "-source", "192.0.2.10", "example.com"}
+	if _, _, err := doFlags(); err == nil {
+		t.Error("Expected error for IPv4 only source with -6")
+	}
+}
+
+func TestDualStackOption(t *testing.T) {
+	// Save original args and restore them after the test
+	origArgs := os.Args
+	defer func() { os.Args = origArgs }()
+
+	resetFlags()
+	os.Args = []string{"cmd", "-dualstack", "example.com"}
+	_, opts, err := doFlags()
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if !opts.dualstack || !opts.sortresponse {
+		t.Errorf("Expected dualstack with sorted responses, got %v, %v", opts.dualstack, opts.sortresponse)
+	}
+
+	for _, args := range [][]string{
+		{"cmd", "-dualstack", "-4", "example.com"},
+		{"cmd", "-dualstack", "-6", "example.com"},
+		{"cmd", "-dualstack", "-matrix", "-a", "ns1", "example.com"},
+	} {
+		resetFlags()
+		os.Args = args
+		if _, _, err := doFlags(); err == nil {
+			t.Errorf("Expected error for %v", args[1:])
+		}
+	}
+}
+
+func TestDiversityOptions(t *testing.T) {
+	// Save original args and restore them after the test
+	origArgs := os.Args
+	defer func() { os.Args = origArgs }()
+
+	resetFlags()
+	os.Args = []string{"cmd", "-divpolicy", "names=2,prefixes=2", "example.com"}
+	_, opts, err := doFlags()
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if !opts.diversity || opts.divpolicy["names"] != 2 || opts.divpolicy["prefixes"] != 2 {
+		t.Errorf("Expected diversity with policy, got %v, %v", opts.diversity, opts.divpolicy)
+	}
+
+	for _, args := range [][]string{
+		{"cmd", "-divpolicy", "servers=2", "example.com"},
+		{"cmd", "-divpolicy", "asns=2", "example.com"},
+		{"cmd", "-asnfile", "/nonexistent/asn", "example.com"},
+		{"cmd", "-diversity", "-matrix", "-a", "ns1", "example.com"},
+	} {
+		resetFlags()
+		os.Args = args
+		if _, _, err := doFlags(); err == nil {
+			t.Errorf("Expected error for %v", args[1:])
+		}
+	}
+}
+
+func TestTransferOptions(t *testing.T) {
+	// Save original args and restore them after the test
+	origArgs := os.Args
+	defer func() { os.Args = origArgs }()
+
+	resetFlags()
+	os.Args = []string{"cmd", "-xfrdiff", "example.com"}
+	_, opts, err := doFlags()
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if !opts.xfr || !opts.xfrdiff || !opts.sortresponse {
+		t.Errorf("Expected xfr and xfrdiff with sorted responses, got %v, %v, %v",
+			opts.xfr, opts.xfrdiff, opts.sortresponse)
+	}
+
+	resetFlags()
+	os.Args = []string{"cmd", "-xfr", "-matrix", "-a", "ns1", "example.com"}
+	if _, _, err := doFlags(); err == nil {
+		t.Errorf("Expected error for -xfr with -matrix")
+	}
+}
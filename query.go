@@ -1,10 +1,13 @@
 package main
 
 import (
+	"context"
+	"crypto/tls"
 	"fmt"
 	"net"
 	"strconv"
 	"strings"
+	"time"
 
 	"github.com/miekg/dns"
 )
@@ -17,24 +20,6 @@ func AddressString(addr string, port int) string {
 	return "[" + addr + "]" + ":" + strconv.Itoa(port)
 }
 
-// GetResolver - obtains system resolver addresses
-func GetResolver(conffile string) (resolvers []net.IP, err error) {
-
-	if conffile == "" {
-		conffile = "/etc/resolv.conf"
-	}
-
-	config, err := dns.ClientConfigFromFile(conffile)
-	if err != nil {
-		return nil, err
-	}
-	for _, s := range config.Servers {
-		ip := net.ParseIP(s)
-		resolvers = append(resolvers, ip)
-	}
-	return resolvers, err
-}
-
 // makeOptRR() - construct OPT Pseudo RR structure
 func makeOptRR(qopts QueryOptions) *dns.OPT {
 
@@ -50,6 +35,13 @@ func makeOptRR(qopts QueryOptions) *dns.OPT {
 		opt.Option = append(opt.Option, e)
 	}
 
+	if qopts.cookie != "" {
+		e := new(dns.EDNS0_COOKIE)
+		e.Code = dns.EDNS0COOKIE
+		e.Cookie = qopts.cookie
+		opt.Option = append(opt.Option, e)
+	}
+
 	opt.SetVersion(0)
 	return opt
 }
@@ -63,13 +55,23 @@ func MakeQuery(qname string, qtype uint16, qopts QueryOptions) *dns.Msg {
 	m.CheckingDisabled = qopts.cdflag
 	m.Extra = append(m.Extra, makeOptRR(qopts))
 	m.Question = make([]dns.Question, 1)
-	m.Question[0] = dns.Question{Name: qname, Qtype: qtype, Qclass: dns.ClassINET}
+	qclass := qopts.qclass
+	if qclass == 0 {
+		qclass = dns.ClassINET
+	}
+	m.Question[0] = dns.Question{Name: qname, Qtype: qtype, Qclass: qclass}
+	if qopts.tsig != nil {
+		m.SetTsig(qopts.tsig.name, qopts.tsig.algorithm, tsigFudge, time.Now().Unix())
+	}
 	return m
 }
 
 // getDestination returns the destination address string with the appropriate port
 func getDestination(ipaddr net.IP, qopts QueryOptions) (string, error) {
 	port := 53
+	if qopts.tls {
+		port = 853
+	}
 	if qopts.port != "" {
 		var err error
 		port, err = strconv.Atoi(qopts.port)
@@ -80,46 +82,145 @@ func getDestination(ipaddr net.IP, qopts QueryOptions) (string, error) {
 	return AddressString(ipaddr.String(), port), nil
 }
 
+// QueryInfo - how a query was carried out by SendQueryInfo
+type QueryInfo struct {
+	transport   string // transport of the last attempt: udp, tcp or tls
+	attempts    int    // number of times the query was sent
+	timeouts    int    // number of UDP attempts that timed out
+	truncated   bool   // a UDP response was truncated (TC=1)
+	slip        bool   // the truncated UDP response had an empty answer
+	tcpFallback bool   // the query was retried over TCP after truncation
+}
+
+// rrlSuspected returns a description of the signs of response rate
+// limiting (RRL) at the server seen while obtaining response, or an
+// empty string if there were none. An RRL server "slips" by sending a
+// truncated, empty response that a legitimate small answer would not
+// need, and otherwise drops responses, so that retries are needed. A
+// single unanswered query is more likely packet loss (see udpLoss), so
+// only repeated timeouts before the answer count.
+func (info *QueryInfo) rrlSuspected(response *dns.Msg, bufsize uint16) string {
+
+	var signs []string
+
+	if info.truncated && (info.slip || response.Len() <= int(bufsize)) {
+		signs = append(signs, "truncated response to a query whose answer fits in UDP")
+	}
+	if info.timeouts > 1 && !info.tcpFallback {
+		signs = append(signs, fmt.Sprintf("%d of %d UDP queries unanswered",
+			info.timeouts, info.attempts))
+	}
+	return strings.Join(signs, "; ")
+}
+
+// retries returns the number of UDP queries resent after a timeout,
+// without the query retried over TCP after truncation.
+func (info *QueryInfo) retries() int {
+	n := info.attempts - 1
+	if info.tcpFallback {
+		n--
+	}
+	return max(n, 0)
+}
+
+// udpLoss returns a description of a single UDP query that went
+// unanswered before one succeeded, or an empty string if there was none.
+func (info *QueryInfo) udpLoss() string {
+	if info.timeouts != 1 || info.tcpFallback {
+		return ""
+	}
+	return fmt.Sprintf("1 of %d UDP queries lost", info.attempts)
+}
+
 // SendQueryUDP - send DNS query via UDP
-func SendQueryUDP(query *dns.Msg, ipaddrs []net.IP, qopts QueryOptions) (response *dns.Msg, err error) {
+func SendQueryUDP(ctx context.Context, query *dns.Msg, ipaddrs []net.IP, qopts QueryOptions) (response *dns.Msg, err error) {
+	return sendQueryUDP(ctx, query, ipaddrs, qopts, new(QueryInfo))
+}
+
+func sendQueryUDP(ctx context.Context, query *dns.Msg, ipaddrs []net.IP, qopts QueryOptions, info *QueryInfo) (response *dns.Msg, err error) {
 	var retries = qopts.retries
 
 	c := new(dns.Client)
 	c.Net = "udp"
 	c.Timeout = qopts.timeout
+	c.TsigSecret = qopts.tsig.secrets()
 
-	for retries > 0 {
+	for retries > 0 && ctx.Err() == nil {
 		for _, ipaddr := range ipaddrs {
-			destination, err := getDestination(ipaddr, qopts)
+			var destination string
+			destination, err = getDestination(ipaddr, qopts)
 			if err != nil {
 				return nil, err
 			}
-			response, _, err = c.Exchange(query, destination)
+			c.Dialer = qopts.dialer(c.Net, destination)
+			if qopts.limiter.Acquire(ctx, ipaddr) != nil {
+				return nil, cancelledError(ctx)
+			}
+			info.transport = "udp"
+			info.attempts++
+			response, _, err = c.ExchangeContext(ctx, query, destination)
+			qopts.limiter.Release(ipaddr)
 			if err == nil {
 				return response, err
 			}
 			if nerr, ok := err.(net.Error); ok && !nerr.Timeout() {
 				break
 			}
+			info.timeouts++
 		}
 		retries--
 	}
 
+	if response == nil && ctx.Err() != nil {
+		return nil, cancelledError(ctx)
+	}
 	return response, err
 }
 
-// SendQueryTCP - send DNS query via TCP
-func SendQueryTCP(query *dns.Msg, ipaddrs []net.IP, qopts QueryOptions) (response *dns.Msg, err error) {
+// SendQueryTCP - send DNS query via TCP (or TLS). If the query options
+// carry a connection manager, the query is pipelined over a reused
+// connection, with fallback to a fresh connection if that fails.
+func SendQueryTCP(ctx context.Context, query *dns.Msg, ipaddrs []net.IP, qopts QueryOptions) (response *dns.Msg, err error) {
+	return sendQueryTCP(ctx, query, ipaddrs, qopts, new(QueryInfo))
+}
+
+func sendQueryTCP(ctx context.Context, query *dns.Msg, ipaddrs []net.IP, qopts QueryOptions, info *QueryInfo) (response *dns.Msg, err error) {
 	c := new(dns.Client)
 	c.Net = "tcp"
 	c.Timeout = qopts.timeout
+	c.TsigSecret = qopts.tsig.secrets()
+	if qopts.tls {
+		c.Net = "tcp-tls"
+		c.TLSConfig = &tls.Config{InsecureSkipVerify: true}
+	}
 
 	for _, ipaddr := range ipaddrs {
-		destination, err := getDestination(ipaddr, qopts)
+		var destination string
+		destination, err = getDestination(ipaddr, qopts)
 		if err != nil {
 			return nil, err
 		}
-		response, _, err = c.Exchange(query, destination)
+		c.Dialer = qopts.dialer(c.Net, destination)
+		info.transport = "tcp"
+		if qopts.tls {
+			info.transport = "tls"
+		}
+		info.attempts++
+		if qopts.conns != nil && qopts.tsig == nil {
+			if qopts.limiter.Acquire(ctx, ipaddr) != nil {
+				return nil, cancelledError(ctx)
+			}
+			response, err = qopts.conns.Exchange(ctx, query, c.Net, destination, qopts)
+			qopts.limiter.Release(ipaddr)
+			if err == nil || ctx.Err() != nil {
+				return response, err
+			}
+		}
+		if qopts.limiter.Acquire(ctx, ipaddr) != nil {
+			return nil, cancelledError(ctx)
+		}
+		response, _, err = c.ExchangeContext(ctx, query, destination)
+		qopts.limiter.Release(ipaddr)
 		if err == nil {
 			return response, err
 		}
@@ -128,19 +229,34 @@ func SendQueryTCP(query *dns.Msg, ipaddrs []net.IP, qopts QueryOptions) (respons
 }
 
 // SendQuery - send DNS query via UDP with fallback to TCP upon truncation
-func SendQuery(qname string, qtype uint16, ipaddrs []net.IP, qopts QueryOptions) (*dns.Msg, error) {
+func SendQuery(ctx context.Context, qname string, qtype uint16, ipaddrs []net.IP, qopts QueryOptions) (*dns.Msg, error) {
+	response, _, err := SendQueryInfo(ctx, qname, qtype, ipaddrs, qopts)
+	return response, err
+}
+
+// SendQueryInfo - send DNS query like SendQuery, and also report how the
+// query was carried out. With udpOnly, a truncated UDP response is
+// returned as it is, without the fallback to TCP.
+func SendQueryInfo(ctx context.Context, qname string, qtype uint16, ipaddrs []net.IP, qopts QueryOptions) (*dns.Msg, *QueryInfo, error) {
 
+	info := new(QueryInfo)
 	query := MakeQuery(qname, qtype, qopts)
 
-	if qopts.tcp {
-		return SendQueryTCP(query, ipaddrs, qopts)
+	if qopts.tcp || qopts.tls {
+		response, err := sendQueryTCP(ctx, query, ipaddrs, qopts, info)
+		return response, info, checkTSIG(response, qopts, classifyError(err))
 	}
 
-	response, err := SendQueryUDP(query, ipaddrs, qopts)
+	response, err := sendQueryUDP(ctx, query, ipaddrs, qopts, info)
 	if err == nil && response != nil && response.MsgHdr.Truncated {
-		return SendQueryTCP(query, ipaddrs, qopts)
+		info.truncated = true
+		info.slip = len(response.Answer) == 0
+		if qopts.udpOnly {
+			return response, info, checkTSIG(response, qopts, nil)
+		}
+		info.tcpFallback = true
+		response, err = sendQueryTCP(ctx, query, ipaddrs, qopts, info)
 	}
 
-	return response, err
-
+	return response, info, checkTSIG(response, qopts, classifyError(err))
 }
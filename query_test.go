@@ -1,7 +1,10 @@
 package main
 
 import (
+	"context"
+	"errors"
 	"net"
+	"sync/atomic"
 	"testing"
 	"time"
 
@@ -166,17 +169,23 @@ type mockDNSServer struct {
 }
 
 func newMockDNSServer(t *testing.T, handler dns.Handler) *mockDNSServer {
+	return newMockDNSServerAt(t, handler, ":0", ":0")
+}
+
+// newMockDNSServerAt starts a mock DNS server listening on the given
+// UDP and TCP addresses
+func newMockDNSServerAt(t *testing.T, handler dns.Handler, udpAddr, tcpAddr string) *mockDNSServer {
 	udpReady := make(chan struct{})
 	tcpReady := make(chan struct{})
 
 	udpServer := &dns.Server{
-		Addr:              ":0",
+		Addr:              udpAddr,
 		Net:               "udp",
 		Handler:           handler,
 		NotifyStartedFunc: func() { close(udpReady) },
 	}
 	tcpServer := &dns.Server{
-		Addr:              ":0",
+		Addr:              tcpAddr,
 		Net:               "tcp",
 		Handler:           handler,
 		NotifyStartedFunc: func() { close(tcpReady) },
@@ -360,7 +369,7 @@ func TestSendQuery(t *testing.T) {
 			query := MakeQuery("example.com.", dns.TypeA, tt.qopts)
 
 			if !tt.qopts.tcp {
-				response, err := SendQueryUDP(query, ipaddrs, tt.qopts)
+				response, err := SendQueryUDP(context.Background(), query, ipaddrs, tt.qopts)
 				if tt.truncated {
 					if err != nil {
 						t.Errorf("SendQueryUDP() error = %v, want nil", err)
@@ -394,7 +403,7 @@ func TestSendQuery(t *testing.T) {
 				host, port, _ = net.SplitHostPort(server.tcpAddr)
 				ipaddrs = []net.IP{net.ParseIP(host)}
 				tt.qopts.port = port
-				response, err := SendQueryTCP(query, ipaddrs, tt.qopts)
+				response, err := SendQueryTCP(context.Background(), query, ipaddrs, tt.qopts)
 				if (err != nil) != tt.wantErr {
 					t.Errorf("SendQueryTCP() error = %v, wantErr %v", err, tt.wantErr)
 				}
@@ -411,3 +420,175 @@ func TestSendQuery(t *testing.T) {
 		})
 	}
 }
+
+// newMockDNSServerSamePort starts a mock DNS server on 127.0.0.1 with the
+// UDP and TCP listeners on the same port, and returns the server and port.
+func newMockDNSServerSamePort(t *testing.T, handler dns.Handler) (*mockDNSServer, string) {
+	s := newMockDNSServerAt(t, handler, "127.0.0.1:0", "127.0.0.1:0")
+	_, port, _ := net.SplitHostPort(s.udpAddr)
+	s.close()
+	s = newMockDNSServerAt(t, handler, "127.0.0.1:"+port, "127.0.0.1:"+port)
+	t.Cleanup(s.close)
+	return s, port
+}
+
+// rrlHandler answers SOA queries for example.com. Over UDP, it slips
+// (sends a truncated, empty response) if slip is set, and drops the
+// first drop queries.
+func rrlHandler(slip bool, drop int) dns.Handler {
+	var udpQueries atomic.Int32
+	return dns.HandlerFunc(func(w dns.ResponseWriter, r *dns.Msg) {
+		m := new(dns.Msg)
+		m.SetReply(r)
+		if w.LocalAddr().Network() == "udp" {
+			if int(udpQueries.Add(1)) <= drop {
+				return
+			}
+			if slip {
+				m.Truncated = true
+				w.WriteMsg(m)
+				return
+			}
+		}
+		m.Answer = []dns.RR{
+			&dns.SOA{
+				Hdr: dns.RR_Header{
+					Name:   r.Question[0].Name,
+					Rrtype: dns.TypeSOA,
+					Class:  dns.ClassINET,
+					Ttl:    3600,
+				},
+				Ns:     "ns1.example.com.",
+				Mbox:   "admin.example.com.",
+				Serial: 2024010100,
+			},
+		}
+		w.WriteMsg(m)
+	})
+}
+
+func TestSendQueryUDPCancelled(t *testing.T) {
+	server := newMockDNSServer(t, soaMockHandler(2024010100))
+	defer server.close()
+	<-server.ready
+	host, port, _ := net.SplitHostPort(server.udpAddr)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	qopts := QueryOptions{timeout: 2 * time.Second, retries: 3, port: port}
+	query := MakeQuery("example.com.", dns.TypeSOA, qopts)
+	response, err := SendQueryUDP(ctx, query, []net.IP{net.ParseIP(host)}, qopts)
+	if response != nil || !errors.Is(err, errCancelled) {
+		t.Errorf("SendQueryUDP() with cancelled context = %v, %v, want cancelled error", response, err)
+	}
+}
+
+func TestSendQueryInfo(t *testing.T) {
+	tests := []struct {
+		name        string
+		slip        bool
+		drop        int
+		want        QueryInfo
+		wantRetries int
+		wantRRL     string
+		wantLoss    string
+		noAnswer    bool
+	}{
+		{
+			name: "plain UDP answer",
+			want: QueryInfo{transport: "udp", attempts: 1},
+		},
+		{
+			name:    "slip falls back to TCP",
+			slip:    true,
+			want:    QueryInfo{transport: "tcp", attempts: 2, truncated: true, slip: true, tcpFallback: true},
+			wantRRL: "truncated response",
+		},
+		{
+			name:        "dropped query is retried",
+			drop:        1,
+			want:        QueryInfo{transport: "udp", attempts: 2, timeouts: 1},
+			wantRetries: 1,
+			wantLoss:    "1 of 2 UDP queries lost",
+		},
+		{
+			name:        "repeatedly dropped query is retried",
+			drop:        2,
+			want:        QueryInfo{transport: "udp", attempts: 3, timeouts: 2},
+			wantRetries: 2,
+			wantRRL:     "2 of 3 UDP queries unanswered",
+		},
+		{
+			name:        "slip after a dropped query",
+			slip:        true,
+			drop:        1,
+			want:        QueryInfo{transport: "tcp", attempts: 3, timeouts: 1, truncated: true, slip: true, tcpFallback: true},
+			wantRetries: 1,
+			wantRRL:     "truncated response",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, port := newMockDNSServerSamePort(t, rrlHandler(tt.slip, tt.drop))
+			qopts := QueryOptions{
+				timeout: 300 * time.Millisecond,
+				retries: 3,
+				bufsize: defaultBufsize,
+				port:    port,
+			}
+
+			response, info, err := SendQueryInfo(context.Background(), "example.com.",
+				dns.TypeSOA, []net.IP{net.ParseIP("127.0.0.1")}, qopts)
+			if err != nil {
+				t.Fatalf("SendQueryInfo() unexpected error: %v", err)
+			}
+			if len(response.Answer) != 1 {
+				t.Errorf("SendQueryInfo() got %d answers, want 1", len(response.Answer))
+			}
+			if *info != tt.want {
+				t.Errorf("SendQueryInfo() info = %+v, want %+v", *info, tt.want)
+			}
+			rrl := info.rrlSuspected(response, qopts.bufsize)
+			if tt.wantRRL == "" && rrl != "" {
+				t.Errorf("rrlSuspected() = %q, want none", rrl)
+			} else if !contains(rrl, tt.wantRRL) {
+				t.Errorf("rrlSuspected() = %q, want containing %q", rrl, tt.wantRRL)
+			}
+			if n := info.retries(); n != tt.wantRetries {
+				t.Errorf("retries() = %d, want %d", n, tt.wantRetries)
+			}
+			if loss := info.udpLoss(); loss != tt.wantLoss {
+				t.Errorf("udpLoss() = %q, want %q", loss, tt.wantLoss)
+			}
+		})
+	}
+}
+
+func TestRRLSuspected(t *testing.T) {
+	small := new(dns.Msg)
+	small.SetQuestion("example.com.", dns.TypeSOA)
+
+	tests := []struct {
+		name    string
+		info    QueryInfo
+		bufsize uint16
+		want    bool
+	}{
+		{"no anomalies", QueryInfo{attempts: 1}, 1232, false},
+		{"slip", QueryInfo{attempts: 2, truncated: true, slip: true, tcpFallback: true}, 1232, true},
+		{"truncated but fits", QueryInfo{attempts: 2, truncated: true, tcpFallback: true}, 1232, true},
+		{"truncated and too large", QueryInfo{attempts: 2, truncated: true, tcpFallback: true}, 10, false},
+		{"single timeout", QueryInfo{attempts: 2, timeouts: 1}, 1232, false},
+		{"retried after timeouts", QueryInfo{attempts: 3, timeouts: 2}, 1232, true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := tt.info.rrlSuspected(small, tt.bufsize) != ""
+			if got != tt.want {
+				t.Errorf("rrlSuspected() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
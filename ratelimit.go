@@ -0,0 +1,117 @@
+package main
+
+import (
+	"context"
+	"net"
+	"sync"
+	"time"
+)
+
+// DestLimiter - limits the rate (queries per second) and the number of
+// concurrent queries sent to each destination address, to avoid
+// triggering response rate limiting at the servers. A nil *DestLimiter
+// imposes no limits.
+type DestLimiter struct {
+	interval time.Duration
+	maxConc  int
+	mu       sync.Mutex
+	dests    map[string]*destState
+}
+
+// destState - limiter state for a single destination address
+type destState struct {
+	slots chan struct{} // concurrency slots, nil if unlimited
+	next  time.Time     // earliest start time of the next query
+}
+
+// NewDestLimiter creates a limiter allowing qps queries per second and
+// maxConc concurrent queries per destination; zero means unlimited. It
+// returns nil if neither limit is set.
+func NewDestLimiter(qps float64, maxConc int) *DestLimiter {
+
+	if qps <= 0 && maxConc <= 0 {
+		return nil
+	}
+
+	l := &DestLimiter{
+		maxConc: maxConc,
+		dests:   make(map[string]*destState),
+	}
+	if qps > 0 {
+		l.interval = time.Duration(float64(time.Second) / qps)
+	}
+	return l
+}
+
+func (l *DestLimiter) getState(ip net.IP) *destState {
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	key := ip.String()
+	ds, ok := l.dests[key]
+	if !ok {
+		ds = new(destState)
+		if l.maxConc > 0 {
+			ds.slots = make(chan struct{}, l.maxConc)
+		}
+		l.dests[key] = ds
+	}
+	return ds
+}
+
+// Acquire waits until a query may be sent to ip, or the context is done.
+// Each successful Acquire must be followed by a Release.
+func (l *DestLimiter) Acquire(ctx context.Context, ip net.IP) error {
+
+	if l == nil {
+		return nil
+	}
+
+	ds := l.getState(ip)
+
+	if ds.slots != nil {
+		select {
+		case ds.slots <- struct{}{}:
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+
+	if l.interval > 0 {
+		l.mu.Lock()
+		now := time.Now()
+		start := ds.next
+		if start.Before(now) {
+			start = now
+		}
+		ds.next = start.Add(l.interval)
+		l.mu.Unlock()
+
+		if wait := start.Sub(now); wait > 0 {
+			timer := time.NewTimer(wait)
+			defer timer.Stop()
+			select {
+			case <-timer.C:
+			case <-ctx.Done():
+				l.Release(ip)
+				return ctx.Err()
+			}
+		}
+	}
+
+	return nil
+}
+
+// Release gives back the concurrency slot taken by Acquire
+func (l *DestLimiter) Release(ip net.IP) {
+
+	if l == nil {
+		return
+	}
+
+	ds := l.getState(ip)
+	if ds.slots != nil {
+		<-ds.slots
+	}
+}
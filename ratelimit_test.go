@@ -0,0 +1,138 @@
+package main
+
+import (
+	"context"
+	"net"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+func TestNewDestLimiter(t *testing.T) {
+	if l := NewDestLimiter(0, 0); l != nil {
+		t.Error("NewDestLimiter(0, 0) should return nil")
+	}
+	l := NewDestLimiter(4, 0)
+	if l == nil || l.interval != 250*time.Millisecond {
+		t.Errorf("NewDestLimiter(4, 0) interval = %v, want 250ms", l.interval)
+	}
+
+	// A nil limiter never blocks
+	var nilLimiter *DestLimiter
+	if err := nilLimiter.Acquire(context.Background(), net.ParseIP("192.0.2.1")); err != nil {
+		t.Errorf("Acquire() on nil limiter returned error: %v", err)
+	}
+	nilLimiter.Release(net.ParseIP("192.0.2.1"))
+}
+
+func TestDestLimiterConcurrency(t *testing.T) {
+	l := NewDestLimiter(0, 2)
+	ip1, ip2 := net.ParseIP("192.0.2.1"), net.ParseIP("192.0.2.2")
+
+	var wg sync.WaitGroup
+	var inflight, peak atomic.Int32
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if err := l.Acquire(context.Background(), ip1); err != nil {
+				t.Error(err)
+				return
+			}
+			n := inflight.Add(1)
+			for {
+				p := peak.Load()
+				if n <= p || peak.CompareAndSwap(p, n) {
+					break
+				}
+			}
+			time.Sleep(10 * time.Millisecond)
+			inflight.Add(-1)
+			l.Release(ip1)
+		}()
+	}
+
+	// Other destinations are not held up
+	if err := l.Acquire(context.Background(), ip2); err != nil {
+		t.Errorf("Acquire() for other destination returned error: %v", err)
+	}
+	l.Release(ip2)
+
+	wg.Wait()
+	if p := peak.Load(); p > 2 {
+		t.Errorf("peak concurrency = %d, want at most 2", p)
+	}
+}
+
+func TestDestLimiterRate(t *testing.T) {
+	l := NewDestLimiter(50, 0)
+	ip := net.ParseIP("192.0.2.1")
+
+	t0 := time.Now()
+	for i := 0; i < 5; i++ {
+		if err := l.Acquire(context.Background(), ip); err != nil {
+			t.Fatal(err)
+		}
+		l.Release(ip)
+	}
+	// The first query starts at once, the next four 20ms apart
+	if elapsed := time.Since(t0); elapsed < 75*time.Millisecond {
+		t.Errorf("5 queries at 50 qps took %v, want at least 80ms", elapsed)
+	}
+}
+
+func TestDestLimiterCancel(t *testing.T) {
+	l := NewDestLimiter(0, 1)
+	ip := net.ParseIP("192.0.2.1")
+
+	if err := l.Acquire(context.Background(), ip); err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	if err := l.Acquire(ctx, ip); err == nil {
+		t.Error("Acquire() expected error when context expires while waiting")
+	}
+	l.Release(ip)
+}
+
+func TestDestLimiterRetries(t *testing.T) {
+	// The server drops the first query, so the retry is a second query
+	// that the rate limit applies to
+	var queries atomic.Int32
+	handler := dns.HandlerFunc(func(w dns.ResponseWriter, r *dns.Msg) {
+		if queries.Add(1) == 1 {
+			return
+		}
+		soaMockHandler(2024010100).ServeDNS(w, r)
+	})
+	server := newMockDNSServer(t, handler)
+	defer server.close()
+	<-server.ready
+	host, port, _ := net.SplitHostPort(server.udpAddr)
+
+	opts := Options{
+		Qopts: QueryOptions{
+			timeout: 50 * time.Millisecond,
+			retries: 3,
+			bufsize: defaultBufsize,
+			port:    port,
+			limiter: NewDestLimiter(4, 0),
+		},
+	}
+	t0 := time.Now()
+	result, err := getSerial(context.Background(), "example.com.", net.ParseIP(host), opts)
+	if err != nil {
+		t.Fatalf("getSerial() returned error: %v", err)
+	}
+	if result.info.attempts != 2 {
+		t.Errorf("getSerial() sent %d queries, want 2", result.info.attempts)
+	}
+	// At 4 qps, the retry is sent 250ms after the first query
+	if elapsed := time.Since(t0); elapsed < 240*time.Millisecond {
+		t.Errorf("getSerial() took %v, want at least 250ms", elapsed)
+	}
+}
@@ -0,0 +1,138 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"strings"
+)
+
+// TransportResult - the outcome of a SOA query over one transport. A
+// truncated UDP response is reported as such, without a serial.
+type TransportResult struct {
+	Transport string  `json:"transport"`
+	Serial    uint32  `json:"serial"`
+	Resptime  float64 `json:"resptime"`
+	Truncated bool    `json:"truncated,omitempty"`
+	err       error
+	Err       string `json:"error,omitempty"`
+	ErrCode   string `json:"error_code,omitempty"`
+}
+
+// Reachability - the outcome of querying a server address over each
+// transport: UDP and TCP, and DNS over TLS with -tls
+type Reachability struct {
+	Results  []TransportResult `json:"results"`
+	Failed   []string          `json:"failed,omitempty"`
+	Mismatch bool              `json:"serial_mismatch,omitempty"`
+}
+
+// reachTransports returns the transports to query servers over.
+func reachTransports(opts Options) []string {
+	if opts.Qopts.tls {
+		return []string{"udp", "tcp", "tls"}
+	}
+	return []string{"udp", "tcp"}
+}
+
+// checkReachability sends a SOA query to the server address ip over each
+// transport in turn, and notes the transports that fail and whether
+// they return different serials. RFC 7766 requires authoritative
+// servers to answer over TCP as well as UDP. The UDP query doesn't fall
+// back to TCP, so that a truncated response shows as such.
+func (rn *Runner) checkReachability(ctx context.Context, zone string, ip net.IP, opts Options) *Reachability {
+
+	reach := new(Reachability)
+	var serial uint32
+	var answered bool
+
+	for _, transport := range reachTransports(opts) {
+		topts := opts
+		topts.Qopts = Endpoint{transport: transport}.queryOptions(opts.Qopts)
+		topts.Qopts.udpOnly = transport == "udp"
+
+		result, err := getSerial(ctx, zone, ip, topts)
+		tr := TransportResult{Transport: transport, err: err}
+		if result.info.truncated {
+			tr.Truncated, tr.err = true, nil
+			tr.Resptime = MilliSeconds(result.took)
+		} else if err != nil {
+			tr.Err = err.Error()
+			tr.ErrCode = errorCode(err)
+			reach.Failed = append(reach.Failed, transport)
+		} else {
+			tr.Serial = result.serial
+			tr.Resptime = MilliSeconds(result.took)
+			if answered && result.serial != serial {
+				reach.Mismatch = true
+			}
+			serial, answered = result.serial, true
+		}
+		reach.Results = append(reach.Results, tr)
+	}
+	return reach
+}
+
+// err returns the error of the first transport that failed, if any.
+func (r *Reachability) err() error {
+	for _, tr := range r.Results {
+		if tr.err != nil {
+			return tr.err
+		}
+	}
+	return nil
+}
+
+// serials returns the serials returned over the transports that
+// answered without truncation.
+func (r *Reachability) serials() []uint32 {
+	var serials []uint32
+	for _, tr := range r.Results {
+		if tr.err == nil && !tr.Truncated {
+			serials = append(serials, tr.Serial)
+		}
+	}
+	return serials
+}
+
+// note returns a note on the transport problems of the server for the
+// text output, or an empty string if there were none.
+func (r *Reachability) note() string {
+
+	var notes []string
+
+	if r == nil {
+		return ""
+	}
+	if len(r.Failed) > 0 {
+		notes = append(notes, "[FAILED: "+strings.Join(r.Failed, ",")+"]")
+	}
+	for _, tr := range r.Results {
+		if tr.Truncated {
+			notes = append(notes, "[TRUNCATED: "+tr.Transport+"]")
+		}
+	}
+	if r.Mismatch {
+		notes = append(notes, "[SERIAL DIFFERS BY TRANSPORT]")
+	}
+	return strings.Join(notes, " ")
+}
+
+func printReachability(r *Reachability, opts *Options) {
+
+	if opts.json || r == nil {
+		return
+	}
+
+	for _, tr := range r.Results {
+		if tr.err != nil {
+			fmt.Printf("%15s   %-3s error: %s\n", "", tr.Transport, tr.Err)
+			continue
+		}
+		if tr.Truncated {
+			fmt.Printf("%15s   %-3s truncated %.2fms\n", "", tr.Transport, tr.Resptime)
+			continue
+		}
+		fmt.Printf("%15d   %-3s %.2fms\n", tr.Serial, tr.Transport, tr.Resptime)
+	}
+}
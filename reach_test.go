@@ -0,0 +1,138 @@
+package main
+
+import (
+	"context"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+// transportHandler answers SOA queries with udpSerial over UDP and
+// tcpSerial over TCP.
+func transportHandler(udpSerial, tcpSerial uint32) dns.Handler {
+	return dns.HandlerFunc(func(w dns.ResponseWriter, r *dns.Msg) {
+		serial := udpSerial
+		if w.RemoteAddr().Network() == "tcp" {
+			serial = tcpSerial
+		}
+		soaMockHandler(serial).ServeDNS(w, r)
+	})
+}
+
+func TestCheckReachability(t *testing.T) {
+	tests := []struct {
+		name      string
+		tcpServer bool
+		tcpSerial uint32
+		slip      bool
+		failed    []string
+		mismatch  bool
+		serials   int
+	}{
+		{"both transports", true, 2024010100, false, nil, false, 2},
+		{"serial differs over tcp", true, 2024010105, false, nil, true, 2},
+		{"tcp unreachable", false, 2024010100, false, []string{"tcp"}, false, 1},
+		{"udp truncated", true, 2024010100, true, nil, false, 1},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			handler := transportHandler(2024010100, tt.tcpSerial)
+			if tt.slip {
+				handler = rrlHandler(true, 0)
+			}
+			var port string
+			if tt.tcpServer {
+				_, port = newMockDNSServerSamePort(t, handler)
+			} else {
+				server := newMockDNSServer(t, handler)
+				t.Cleanup(server.close)
+				<-server.ready
+				_, port, _ = net.SplitHostPort(server.udpAddr)
+			}
+
+			rn := NewRunner()
+			opts := Options{
+				Qopts: QueryOptions{
+					timeout: time.Second,
+					retries: 1,
+					bufsize: defaultBufsize,
+					port:    port,
+				},
+			}
+			reach := rn.checkReachability(context.Background(), "example.com.",
+				net.ParseIP("127.0.0.1"), opts)
+
+			if len(reach.Results) != 2 || reach.Results[0].Transport != "udp" ||
+				reach.Results[1].Transport != "tcp" {
+				t.Fatalf("checkReachability() results = %+v, want udp and tcp", reach.Results)
+			}
+			if len(reach.Failed) != len(tt.failed) ||
+				(len(tt.failed) > 0 && reach.Failed[0] != tt.failed[0]) {
+				t.Errorf("Failed = %v, want %v", reach.Failed, tt.failed)
+			}
+			if reach.Mismatch != tt.mismatch {
+				t.Errorf("Mismatch = %v, want %v", reach.Mismatch, tt.mismatch)
+			}
+			if n := len(reach.serials()); n != tt.serials {
+				t.Errorf("serials() returned %d serials, want %d", n, tt.serials)
+			}
+			if reach.Results[0].Truncated != tt.slip {
+				t.Errorf("udp Truncated = %v, want %v", reach.Results[0].Truncated, tt.slip)
+			}
+			if (reach.err() != nil) != (len(tt.failed) > 0) {
+				t.Errorf("err() = %v, want error %v", reach.err(), len(tt.failed) > 0)
+			}
+		})
+	}
+}
+
+func TestReachTransports(t *testing.T) {
+	if n := len(reachTransports(Options{})); n != 2 {
+		t.Errorf("reachTransports() returned %d transports, want 2", n)
+	}
+	opts := Options{Qopts: QueryOptions{tls: true}}
+	if tr := reachTransports(opts); len(tr) != 3 || tr[2] != "tls" {
+		t.Errorf("reachTransports() with -tls = %v, want udp, tcp and tls", tr)
+	}
+}
+
+func TestRunReach(t *testing.T) {
+	tests := []struct {
+		name      string
+		tcpSerial uint32
+		status    int
+	}{
+		{"same serial", 2024010100, 0},
+		{"serial differs by transport", 2024010105, 1},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, port := newMockDNSServerSamePort(t, transportHandler(2024010100, tt.tcpSerial))
+
+			rn := NewRunner()
+			opts := Options{
+				noqueryns:  true,
+				additional: "127.0.0.1",
+				reach:      true,
+				json:       true,
+				Qopts: QueryOptions{
+					timeout: time.Second,
+					retries: 1,
+					bufsize: defaultBufsize,
+					port:    port,
+				},
+			}
+			status, message := rn.run(context.Background(), "example.com.", opts)
+			if status != tt.status {
+				t.Errorf("run() status = %d, want %d; message = %q", status, tt.status, message)
+			}
+			if len(rn.output.Responses) != 1 || rn.output.Responses[0].Reach == nil {
+				t.Fatalf("run() responses = %+v, want one with reachability", rn.output.Responses)
+			}
+		})
+	}
+}
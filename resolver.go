@@ -0,0 +1,298 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"net"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+// Resolver - a recursive resolver used for nameserver discovery, which
+// is queried over the transport of the query options (-c, -tls) unless
+// its endpoint names one
+type Resolver struct {
+	ip net.IP
+	Endpoint
+}
+
+// label returns the address and port the resolver is queried at with
+// qopts, prefixed with the transport unless it is udp.
+func (r Resolver) label(qopts QueryOptions) string {
+
+	qopts = r.queryOptions(qopts)
+	address, err := getDestination(r.ip, qopts)
+	if err != nil {
+		address = r.ip.String()
+	}
+	switch {
+	case qopts.tls:
+		return "tls://" + address
+	case qopts.tcp:
+		return "tcp://" + address
+	}
+	return address
+}
+
+// queryOptions returns qopts adjusted to query the resolver. A resolver
+// without a port of its own uses the port in qopts, if any.
+func (r Resolver) queryOptions(qopts QueryOptions) QueryOptions {
+
+	qopts = r.Endpoint.queryOptions(qopts)
+	qopts.conns = nil
+	qopts.limiter = nil
+	qopts.source4, qopts.source6 = nil, nil
+	return qopts
+}
+
+// parseResolver parses a resolver given as [transport://]addr[:port],
+// where an IPv6 address may be enclosed in brackets, as it must be
+// with a port.
+func parseResolver(s string) (Resolver, error) {
+
+	host, e, err := parseEndpoint(s)
+	if err != nil {
+		return Resolver{}, err
+	}
+	ip := net.ParseIP(host)
+	if ip == nil {
+		return Resolver{}, fmt.Errorf("%s: resolver must be an IP address", s)
+	}
+	return Resolver{ip: ip, Endpoint: e}, nil
+}
+
+// parseResolvers parses a comma separated list of resolvers.
+func parseResolvers(s string) ([]Resolver, error) {
+
+	var resolvers []Resolver
+
+	for _, item := range strings.Split(s, ",") {
+		item = strings.TrimSpace(item)
+		if item == "" {
+			continue
+		}
+		r, err := parseResolver(item)
+		if err != nil {
+			return nil, err
+		}
+		resolvers = append(resolvers, r)
+	}
+	if len(resolvers) == 0 {
+		return nil, fmt.Errorf("no resolvers given")
+	}
+	return resolvers, nil
+}
+
+// DiscoveryQuery - a nameserver discovery query and the resolver that
+// answered it
+type DiscoveryQuery struct {
+	Qname    string `json:"qname"`
+	Qtype    string `json:"qtype"`
+	Resolver string `json:"resolver"`
+	Rcode    string `json:"rcode,omitempty"`
+	Error    string `json:"error,omitempty"`
+}
+
+// ResolverConfig - the resolvers used for nameserver discovery, and the
+// resolv.conf(5) options for querying them. A zero timeout or attempts
+// means the -t and -r values apply.
+type ResolverConfig struct {
+	servers  []Resolver
+	timeout  time.Duration
+	attempts int
+	rotate   bool
+	next     atomic.Uint32
+	mu       sync.Mutex
+	log      []DiscoveryQuery
+}
+
+// NewResolverConfig - resolver configuration for the given resolvers
+func NewResolverConfig(servers ...Resolver) *ResolverConfig {
+	return &ResolverConfig{servers: servers}
+}
+
+// GetResolver - obtains system resolver addresses and the port, timeout,
+// attempts and rotate options from resolv.conf. Options not present in
+// the file are left for the command line flags to determine.
+func GetResolver(conffile string) (*ResolverConfig, error) {
+
+	if conffile == "" {
+		conffile = "/etc/resolv.conf"
+	}
+
+	config, err := dns.ClientConfigFromFile(conffile)
+	if err != nil {
+		return nil, err
+	}
+	present, err := resolvConfOptions(conffile)
+	if err != nil {
+		return nil, err
+	}
+
+	rc := new(ResolverConfig)
+	for _, s := range config.Servers {
+		ip := net.ParseIP(s)
+		if ip == nil {
+			return nil, fmt.Errorf("%s: invalid nameserver address: %s", conffile, s)
+		}
+		rc.servers = append(rc.servers, Resolver{ip: ip, Endpoint: Endpoint{port: config.Port}})
+	}
+	if len(rc.servers) == 0 {
+		return nil, fmt.Errorf("%s: no nameservers found", conffile)
+	}
+	if present["timeout"] {
+		rc.timeout = time.Duration(config.Timeout) * time.Second
+	}
+	if present["attempts"] {
+		rc.attempts = config.Attempts
+	}
+	rc.rotate = present["rotate"]
+	return rc, nil
+}
+
+// resolvConfOptions returns the names of the options given in a
+// resolv.conf file, which dns.ClientConfig does not tell apart from
+// its defaults.
+func resolvConfOptions(conffile string) (map[string]bool, error) {
+
+	file, err := os.Open(conffile)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	present := make(map[string]bool)
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) < 1 || fields[0] != "options" {
+			continue
+		}
+		for _, option := range fields[1:] {
+			name, _, _ := strings.Cut(option, ":")
+			present[name] = true
+		}
+	}
+	return present, scanner.Err()
+}
+
+// order returns the resolvers in the order to query them, which starts
+// at the next one in turn if the rotate option is set.
+func (rc *ResolverConfig) order() []Resolver {
+
+	if !rc.rotate || len(rc.servers) < 2 {
+		return rc.servers
+	}
+	start := int(rc.next.Add(1)-1) % len(rc.servers)
+	return append(append([]Resolver(nil), rc.servers[start:]...), rc.servers[:start]...)
+}
+
+// Query - send a discovery query to each resolver in turn, for the
+// configured number of attempts, until one answers with a response
+// other than SERVFAIL, REFUSED or NOTIMP. The resolver that answered
+// is recorded in the discovery log.
+func (rc *ResolverConfig) Query(ctx context.Context, qname string, qtype uint16, qopts QueryOptions) (*dns.Msg, error) {
+
+	var response *dns.Msg
+	var answeredBy Resolver
+	var err error
+
+	attempts := qopts.retries
+	if rc.attempts > 0 {
+		attempts = rc.attempts
+	}
+	if rc.timeout > 0 {
+		qopts.timeout = rc.timeout
+	}
+	qopts.retries = 1
+
+	servers := rc.order()
+query:
+	for i := 0; i < attempts && ctx.Err() == nil; i++ {
+		for _, r := range servers {
+			var resp *dns.Msg
+			resp, err = SendQuery(ctx, qname, qtype, []net.IP{r.ip}, r.queryOptions(qopts))
+			if err != nil || resp == nil {
+				continue
+			}
+			response, answeredBy = resp, r
+			switch resp.Rcode {
+			case dns.RcodeServerFailure, dns.RcodeRefused, dns.RcodeNotImplemented:
+				continue
+			}
+			break query
+		}
+	}
+
+	entry := DiscoveryQuery{Qname: qname, Qtype: dns.TypeToString[qtype]}
+	if response != nil {
+		err = nil
+		entry.Resolver = answeredBy.label(qopts)
+		entry.Rcode = dns.RcodeToString[response.Rcode]
+	} else {
+		if err == nil {
+			err = fmt.Errorf("no response for %s %s", qname, entry.Qtype)
+		}
+		entry.Error = err.Error()
+	}
+	rc.record(entry)
+	return response, err
+}
+
+// record adds a discovery query to the discovery log.
+func (rc *ResolverConfig) record(entry DiscoveryQuery) {
+	rc.mu.Lock()
+	defer rc.mu.Unlock()
+	rc.log = append(rc.log, entry)
+}
+
+// Discovery - the discovery queries made so far, sorted by query name
+// and type
+func (rc *ResolverConfig) Discovery() []DiscoveryQuery {
+
+	if rc == nil {
+		return nil
+	}
+	rc.mu.Lock()
+	defer rc.mu.Unlock()
+
+	log := append([]DiscoveryQuery(nil), rc.log...)
+	sort.SliceStable(log, func(i, j int) bool {
+		if log[i].Qname != log[j].Qname {
+			return log[i].Qname < log[j].Qname
+		}
+		return log[i].Qtype < log[j].Qtype
+	})
+	return log
+}
+
+// printDiscovery prints which resolver answered each discovery query.
+func printDiscovery(log []DiscoveryQuery) {
+	for _, d := range log {
+		if d.Error != "" {
+			fmt.Printf("## discovery %s %s: %s\n", d.Qname, d.Qtype, d.Error)
+			continue
+		}
+		fmt.Printf("## discovery %s %s: %s from %s\n", d.Qname, d.Qtype, d.Rcode, d.Resolver)
+	}
+}
+
+// setupResolvers sets the resolvers for nameserver discovery: those
+// given with -resolver, or else the ones in resolv.conf.
+func (opts *Options) setupResolvers() error {
+
+	if opts.resolverList != nil {
+		opts.resolvers = NewResolverConfig(opts.resolverList...)
+		return nil
+	}
+	var err error
+	opts.resolvers, err = GetResolver(opts.resolvconf)
+	return err
+}
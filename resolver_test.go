@@ -0,0 +1,248 @@
+package main
+
+import (
+	"context"
+	"net"
+	"os"
+	"path/filepath"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+func TestParseResolver(t *testing.T) {
+	tests := []struct {
+		input     string
+		ip        string
+		port      string
+		transport string
+		label     string
+		wantErr   bool
+	}{
+		{"9.9.9.9", "9.9.9.9", "", "", "9.9.9.9:53", false},
+		{"192.0.2.1:5353", "192.0.2.1", "5353", "", "192.0.2.1:5353", false},
+		{"tcp://192.0.2.1", "192.0.2.1", "", "tcp", "tcp://192.0.2.1:53", false},
+		{"tls://1.1.1.1", "1.1.1.1", "", "tls", "tls://1.1.1.1:853", false},
+		{"TLS://1.1.1.1:8853", "1.1.1.1", "8853", "tls", "tls://1.1.1.1:8853", false},
+		{"2001:db8::53", "2001:db8::53", "", "", "[2001:db8::53]:53", false},
+		{"[2001:db8::53]:5353", "2001:db8::53", "5353", "", "[2001:db8::53]:5353", false},
+		{"udp://192.0.2.1", "192.0.2.1", "", "udp", "192.0.2.1:53", false},
+		{"tls://[2001:db8::53]", "2001:db8::53", "", "tls", "tls://[2001:db8::53]:853", false},
+		{"https://192.0.2.1", "", "", "", "", true},
+		{"resolver.example.net", "", "", "", "", true},
+		{"192.0.2.1:0", "", "", "", "", true},
+		{"192.0.2.1:domain", "", "", "", "", true},
+		{"[2001:db8::53", "", "", "", "", true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.input, func(t *testing.T) {
+			r, err := parseResolver(tt.input)
+			if tt.wantErr {
+				if err == nil {
+					t.Errorf("parseResolver(%q) expected error", tt.input)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("parseResolver(%q) returned error: %v", tt.input, err)
+			}
+			if r.ip.String() != tt.ip || r.port != tt.port || r.transport != tt.transport {
+				t.Errorf("parseResolver(%q) = %s %q %s, want %s %q %s", tt.input,
+					r.ip, r.port, r.transport, tt.ip, tt.port, tt.transport)
+			}
+			if label := r.label(QueryOptions{}); label != tt.label {
+				t.Errorf("label() = %s, want %s", label, tt.label)
+			}
+		})
+	}
+
+	if _, err := parseResolvers(" , "); err == nil {
+		t.Error("parseResolvers() of empty list expected error")
+	}
+	resolvers, err := parseResolvers("9.9.9.9, tls://1.1.1.1")
+	if err != nil || len(resolvers) != 2 {
+		t.Errorf("parseResolvers() = %v, %v, want 2 resolvers", resolvers, err)
+	}
+}
+
+func TestGetResolver(t *testing.T) {
+	tests := []struct {
+		name     string
+		content  string
+		servers  int
+		timeout  time.Duration
+		attempts int
+		rotate   bool
+		wantErr  bool
+	}{
+		{"servers only", "nameserver 192.0.2.1\nnameserver 2001:db8::1\n",
+			2, 0, 0, false, false},
+		{"options", "nameserver 192.0.2.1\noptions timeout:2 attempts:4 rotate ndots:2\n",
+			1, 2 * time.Second, 4, true, false},
+		{"no nameservers", "search example.com\n", 0, 0, 0, false, true},
+		{"nameserver hostname", "nameserver resolver.example.net\n", 0, 0, 0, false, true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			fname := filepath.Join(t.TempDir(), "resolv.conf")
+			if err := os.WriteFile(fname, []byte(tt.content), 0644); err != nil {
+				t.Fatal(err)
+			}
+			rc, err := GetResolver(fname)
+			if tt.wantErr {
+				if err == nil {
+					t.Error("GetResolver() expected error")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("GetResolver() returned error: %v", err)
+			}
+			if len(rc.servers) != tt.servers || rc.timeout != tt.timeout ||
+				rc.attempts != tt.attempts || rc.rotate != tt.rotate {
+				t.Errorf("GetResolver() = %d servers, timeout %v, attempts %d, rotate %v",
+					len(rc.servers), rc.timeout, rc.attempts, rc.rotate)
+			}
+			for _, r := range rc.servers {
+				if r.port != "53" || r.transport != "" {
+					t.Errorf("resolver %s: port %q transport %q, want 53 and none",
+						r.ip, r.port, r.transport)
+				}
+			}
+		})
+	}
+
+	if _, err := GetResolver(filepath.Join(t.TempDir(), "missing")); err == nil {
+		t.Error("GetResolver() of missing file expected error")
+	}
+}
+
+// rcodeResolver starts a mock resolver answering NS queries with rcode,
+// counting the queries it receives, and returns it as a Resolver.
+func rcodeResolver(t *testing.T, rcode int, count *atomic.Int32) Resolver {
+	server := newMockDNSServer(t, dns.HandlerFunc(func(w dns.ResponseWriter, r *dns.Msg) {
+		count.Add(1)
+		m := new(dns.Msg)
+		m.SetRcode(r, rcode)
+		if rcode == dns.RcodeSuccess {
+			m.Answer = []dns.RR{&dns.NS{Hdr: dns.RR_Header{Name: r.Question[0].Name,
+				Rrtype: dns.TypeNS, Class: dns.ClassINET, Ttl: 300}, Ns: "ns1.example.com."}}
+		}
+		w.WriteMsg(m)
+	}))
+	t.Cleanup(server.close)
+	<-server.ready
+	host, port, _ := net.SplitHostPort(server.udpAddr)
+	return Resolver{ip: net.ParseIP(host), Endpoint: Endpoint{port: port, transport: "udp"}}
+}
+
+func TestResolverConfigQuery(t *testing.T) {
+	qopts := QueryOptions{
+		timeout: 2 * time.Second,
+		retries: 3,
+		bufsize: defaultBufsize,
+		rdflag:  true,
+	}
+
+	t.Run("next resolver after refusal", func(t *testing.T) {
+		var refused, answered atomic.Int32
+		r1 := rcodeResolver(t, dns.RcodeRefused, &refused)
+		r2 := rcodeResolver(t, dns.RcodeSuccess, &answered)
+		rc := NewResolverConfig(r1, r2)
+
+		response, err := rc.Query(context.Background(), "example.com.", dns.TypeNS, qopts)
+		if err != nil || response == nil || response.Rcode != dns.RcodeSuccess {
+			t.Fatalf("Query() = %v, %v, want NOERROR response", response, err)
+		}
+		if refused.Load() != 1 || answered.Load() != 1 {
+			t.Errorf("resolvers received %d and %d queries, want 1 and 1",
+				refused.Load(), answered.Load())
+		}
+		log := rc.Discovery()
+		if len(log) != 1 || log[0].Resolver != r2.label(qopts) || log[0].Rcode != "NOERROR" {
+			t.Errorf("Discovery() = %+v, want NOERROR from %s", log, r2.label(qopts))
+		}
+	})
+
+	t.Run("attempts", func(t *testing.T) {
+		var count atomic.Int32
+		rc := NewResolverConfig(rcodeResolver(t, dns.RcodeServerFailure, &count))
+		rc.attempts = 2
+
+		response, err := rc.Query(context.Background(), "example.com.", dns.TypeNS, qopts)
+		if err != nil || response == nil || response.Rcode != dns.RcodeServerFailure {
+			t.Errorf("Query() = %v, %v, want SERVFAIL response", response, err)
+		}
+		if n := count.Load(); n != 2 {
+			t.Errorf("resolver received %d queries, want 2", n)
+		}
+	})
+
+	t.Run("rotate", func(t *testing.T) {
+		var c1, c2 atomic.Int32
+		rc := NewResolverConfig(rcodeResolver(t, dns.RcodeSuccess, &c1),
+			rcodeResolver(t, dns.RcodeSuccess, &c2))
+		rc.rotate = true
+
+		for i := 0; i < 4; i++ {
+			if _, err := rc.Query(context.Background(), "example.com.", dns.TypeNS, qopts); err != nil {
+				t.Fatalf("Query() returned error: %v", err)
+			}
+		}
+		if c1.Load() != 2 || c2.Load() != 2 {
+			t.Errorf("resolvers received %d and %d queries, want 2 and 2", c1.Load(), c2.Load())
+		}
+	})
+
+	t.Run("tcp with -c", func(t *testing.T) {
+		var udp, tcp atomic.Int32
+		server := newMockDNSServer(t, dns.HandlerFunc(func(w dns.ResponseWriter, r *dns.Msg) {
+			if w.LocalAddr().Network() == "tcp" {
+				tcp.Add(1)
+			} else {
+				udp.Add(1)
+			}
+			m := new(dns.Msg)
+			m.SetReply(r)
+			w.WriteMsg(m)
+		}))
+		t.Cleanup(server.close)
+		<-server.ready
+		host, port, _ := net.SplitHostPort(server.tcpAddr)
+		r := Resolver{ip: net.ParseIP(host), Endpoint: Endpoint{port: port}}
+		rc := NewResolverConfig(r)
+		q := qopts
+		q.tcp = true
+
+		if _, err := rc.Query(context.Background(), "example.com.", dns.TypeNS, q); err != nil {
+			t.Fatalf("Query() returned error: %v", err)
+		}
+		if tcp.Load() != 1 || udp.Load() != 0 {
+			t.Errorf("resolver received %d TCP and %d UDP queries, want 1 and 0",
+				tcp.Load(), udp.Load())
+		}
+		if label := r.label(q); label != "tcp://"+server.tcpAddr {
+			t.Errorf("label() = %s, want tcp://%s", label, server.tcpAddr)
+		}
+	})
+
+	t.Run("no response", func(t *testing.T) {
+		rc := NewResolverConfig(Resolver{ip: net.ParseIP("127.0.0.1"),
+			Endpoint: Endpoint{port: "1", transport: "tcp"}})
+		q := qopts
+		q.timeout = 100 * time.Millisecond
+		q.retries = 1
+
+		if _, err := rc.Query(context.Background(), "example.com.", dns.TypeNS, q); err == nil {
+			t.Error("Query() expected error")
+		}
+		log := rc.Discovery()
+		if len(log) != 1 || log[0].Error == "" {
+			t.Errorf("Discovery() = %+v, want an error entry", log)
+		}
+	})
+}
@@ -0,0 +1,161 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"os"
+	"slices"
+	"strconv"
+	"strings"
+
+	"github.com/miekg/dns"
+)
+
+// Transports a server can be queried over
+var transports = []string{"udp", "tcp", "tls"}
+
+// Endpoint - the port and transport to query a server at. Empty values
+// mean the ones given by the query options.
+type Endpoint struct {
+	port      string
+	transport string // udp (with TCP on truncation), tcp or tls
+}
+
+// queryOptions returns qopts adjusted to query at the endpoint.
+func (e Endpoint) queryOptions(qopts QueryOptions) QueryOptions {
+
+	switch e.transport {
+	case "udp":
+		qopts.tcp, qopts.tls = false, false
+	case "tcp":
+		qopts.tcp, qopts.tls = true, false
+	case "tls":
+		qopts.tcp, qopts.tls = false, true
+	}
+	if e.port != "" {
+		qopts.port = e.port
+	}
+	return qopts
+}
+
+// format returns host in the [transport://]host[@port] notation.
+func (e Endpoint) format(host string) string {
+
+	if e.transport != "" {
+		host = e.transport + "://" + host
+	}
+	if e.port != "" {
+		host += "@" + e.port
+	}
+	return host
+}
+
+// parseEndpoint splits a server given as [transport://]host[@port], or
+// with the port as host:port, where an IPv6 address with a port must be
+// enclosed in brackets, into the host and the endpoint.
+func parseEndpoint(s string) (string, Endpoint, error) {
+
+	var e Endpoint
+	var err error
+
+	host := s
+	if transport, rest, ok := strings.Cut(host, "://"); ok {
+		e.transport = strings.ToLower(transport)
+		if !slices.Contains(transports, e.transport) {
+			return "", e, fmt.Errorf("%s: unknown transport %q", s, transport)
+		}
+		host = rest
+	}
+
+	switch {
+	case strings.Contains(host, "@"):
+		host, e.port, _ = strings.Cut(host, "@")
+		host = strings.TrimSuffix(strings.TrimPrefix(host, "["), "]")
+	case strings.HasPrefix(host, "[") && strings.HasSuffix(host, "]"):
+		host = host[1 : len(host)-1]
+	case strings.HasPrefix(host, "[") || strings.Count(host, ":") == 1:
+		host, e.port, err = net.SplitHostPort(host)
+		if err != nil {
+			return "", e, fmt.Errorf("%s: %s", s, err.Error())
+		}
+	}
+
+	if host == "" {
+		return "", e, fmt.Errorf("%s: missing server", s)
+	}
+	if e.port != "" {
+		port, err := strconv.Atoi(e.port)
+		if err != nil || port <= 0 || port > 65535 {
+			return "", e, fmt.Errorf("%s: invalid port %q", s, e.port)
+		}
+	}
+	return host, e, nil
+}
+
+// Server - a nameserver to query, by name or address, and the endpoint
+// to query it at
+type Server struct {
+	name string
+	Endpoint
+}
+
+// String returns the server in the notation parseServer accepts.
+func (s Server) String() string {
+	return s.format(s.name)
+}
+
+// parseServer parses a server given as [transport://]host[@port] or
+// [transport://]host:port, where host is a name or an address.
+func parseServer(s string) (Server, error) {
+
+	host, e, err := parseEndpoint(s)
+	if err != nil {
+		return Server{}, err
+	}
+	if net.ParseIP(host) == nil {
+		if _, ok := dns.IsDomainName(host); !ok {
+			return Server{}, fmt.Errorf("%s: invalid server name", s)
+		}
+		host = dns.Fqdn(host)
+	}
+	return Server{name: host, Endpoint: e}, nil
+}
+
+// parseServers parses a comma separated list of servers.
+func parseServers(list string) ([]Server, error) {
+
+	var servers []Server
+
+	for _, x := range strings.Split(list, ",") {
+		if x = strings.TrimSpace(x); x == "" {
+			continue
+		}
+		s, err := parseServer(x)
+		if err != nil {
+			return nil, err
+		}
+		servers = append(servers, s)
+	}
+	return servers, nil
+}
+
+// getServers parses the servers in nsNameList, which are either names
+// from the zone's NS set or servers given with -a, skipping any that
+// don't parse with a warning.
+func getServers(nsNameList []string) []Server {
+
+	var servers []Server
+
+	for _, x := range nsNameList {
+		if x = strings.TrimSpace(x); x == "" {
+			continue
+		}
+		s, err := parseServer(x)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Warning: %s\n", err)
+			continue
+		}
+		servers = append(servers, s)
+	}
+	return servers
+}
@@ -0,0 +1,136 @@
+package main
+
+import (
+	"context"
+	"net"
+	"testing"
+	"time"
+)
+
+func TestParseServer(t *testing.T) {
+	tests := []struct {
+		input     string
+		name      string
+		port      string
+		transport string
+		wantErr   bool
+	}{
+		{"ns1.example.net", "ns1.example.net.", "", "", false},
+		{"192.0.2.1", "192.0.2.1", "", "", false},
+		{"2001:db8::1", "2001:db8::1", "", "", false},
+		{"ns1.example.net@5353", "ns1.example.net.", "5353", "", false},
+		{"192.0.2.1@5353", "192.0.2.1", "5353", "", false},
+		{"2001:db8::1@5353", "2001:db8::1", "5353", "", false},
+		{"[2001:db8::1]:5353", "2001:db8::1", "5353", "", false},
+		{"[2001:db8::1]", "2001:db8::1", "", "", false},
+		{"192.0.2.1:5353", "192.0.2.1", "5353", "", false},
+		{"ns1.example.net:5353", "ns1.example.net.", "5353", "", false},
+		{"tls://ns2.example.net", "ns2.example.net.", "", "tls", false},
+		{"tcp://192.0.2.1@5353", "192.0.2.1", "5353", "tcp", false},
+		{"UDP://[2001:db8::1]:5353", "2001:db8::1", "5353", "udp", false},
+		{"https://ns1.example.net", "", "", "", true},
+		{"ns1.example.net@0", "", "", "", true},
+		{"ns1.example.net@65536", "", "", "", true},
+		{"ns1.example.net@dns", "", "", "", true},
+		{"@5353", "", "", "", true},
+		{"[2001:db8::1]5353", "", "", "", true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.input, func(t *testing.T) {
+			s, err := parseServer(tt.input)
+			if tt.wantErr {
+				if err == nil {
+					t.Errorf("parseServer(%q) expected error", tt.input)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("parseServer(%q) returned error: %v", tt.input, err)
+			}
+			if s.name != tt.name || s.port != tt.port || s.transport != tt.transport {
+				t.Errorf("parseServer(%q) = %s %q %q, want %s %q %q", tt.input,
+					s.name, s.port, s.transport, tt.name, tt.port, tt.transport)
+			}
+			// The string form parses back to the same server
+			if s2, err := parseServer(s.String()); err != nil || s2 != s {
+				t.Errorf("parseServer(%q) = %+v, %v, want %+v", s.String(), s2, err, s)
+			}
+		})
+	}
+}
+
+func TestEndpointQueryOptions(t *testing.T) {
+	tests := []struct {
+		name     string
+		endpoint Endpoint
+		qopts    QueryOptions
+		tcp      bool
+		tls      bool
+		port     string
+	}{
+		{"empty keeps options", Endpoint{}, QueryOptions{tcp: true, port: "53"}, true, false, "53"},
+		{"port", Endpoint{port: "5353"}, QueryOptions{tls: true}, false, true, "5353"},
+		{"udp overrides tcp", Endpoint{transport: "udp"}, QueryOptions{tcp: true}, false, false, ""},
+		{"tcp", Endpoint{transport: "tcp"}, QueryOptions{tls: true}, true, false, ""},
+		{"tls", Endpoint{transport: "tls", port: "8853"}, QueryOptions{tcp: true}, false, true, "8853"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			q := tt.endpoint.queryOptions(tt.qopts)
+			if q.tcp != tt.tcp || q.tls != tt.tls || q.port != tt.port {
+				t.Errorf("queryOptions() = tcp %v tls %v port %q, want tcp %v tls %v port %q",
+					q.tcp, q.tls, q.port, tt.tcp, tt.tls, tt.port)
+			}
+		})
+	}
+}
+
+func TestRunServerEndpoints(t *testing.T) {
+	master, mhost, mport := newSOAServer(t, 2024010100)
+	defer master.close()
+	secondary := newMockDNSServer(t, soaMockHandler(2024010100))
+	defer secondary.close()
+	<-secondary.ready
+	_, udpPort, _ := net.SplitHostPort(secondary.udpAddr)
+	_, tcpPort, _ := net.SplitHostPort(secondary.tcpAddr)
+
+	rn := NewRunner()
+	opts := Options{
+		noqueryns:      true,
+		additional:     "127.0.0.1@" + udpPort + ",tcp://127.0.0.1:" + tcpPort,
+		masterIP:       net.ParseIP(mhost),
+		masterEndpoint: Endpoint{port: mport},
+		json:           true,
+		Qopts: QueryOptions{
+			timeout: 2 * time.Second,
+			retries: 1,
+			bufsize: defaultBufsize,
+		},
+	}
+
+	status, message := rn.run(context.Background(), "example.com.", opts)
+	if status != 0 {
+		t.Fatalf("run() status = %d, want 0; message = %q", status, message)
+	}
+	if rn.output.Master.Port != mport {
+		t.Errorf("output.Master.Port = %q, want %q", rn.output.Master.Port, mport)
+	}
+	if len(rn.output.Responses) != 2 {
+		t.Fatalf("run() returned %d responses, want 2", len(rn.output.Responses))
+	}
+	transports := map[string]string{}
+	for _, r := range rn.output.Responses {
+		if r.Err != "" {
+			t.Errorf("response %s: error %s", r.address(), r.Err)
+		}
+		transports[r.Port] = r.Transport
+	}
+	if transport, ok := transports[udpPort]; !ok || transport != "" {
+		t.Errorf("no default transport response at port %s: %v", udpPort, transports)
+	}
+	if transport, ok := transports[tcpPort]; !ok || transport != "tcp" {
+		t.Errorf("no tcp response at port %s: %v", tcpPort, transports)
+	}
+}
@@ -0,0 +1,186 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"strings"
+)
+
+// SourceSet - the source addresses to bind the queries of one run to,
+// at most one per address family
+type SourceSet struct {
+	name string // as given on the command line
+	v4   net.IP
+	v6   net.IP
+}
+
+// String returns the source addresses of the set.
+func (s SourceSet) String() string {
+
+	var addrs []string
+
+	for _, ip := range []net.IP{s.v4, s.v6} {
+		if ip != nil {
+			addrs = append(addrs, ip.String())
+		}
+	}
+	return strings.Join(addrs, "+")
+}
+
+// add adds a source address to the set, which must not already have
+// one of its address family.
+func (s *SourceSet) add(ip net.IP) error {
+
+	if ip.To4() != nil {
+		if s.v4 != nil {
+			return fmt.Errorf("%s: more than one IPv4 address", s.name)
+		}
+		s.v4 = ip
+		return nil
+	}
+	if s.v6 != nil {
+		return fmt.Errorf("%s: more than one IPv6 address", s.name)
+	}
+	s.v6 = ip
+	return nil
+}
+
+// interfaceSource returns the first global unicast IPv4 and IPv6
+// addresses of a network interface.
+func interfaceSource(name string) (SourceSet, error) {
+
+	set := SourceSet{name: name}
+
+	ifi, err := net.InterfaceByName(name)
+	if err != nil {
+		return set, err
+	}
+	addrs, err := ifi.Addrs()
+	if err != nil {
+		return set, err
+	}
+	for _, addr := range addrs {
+		ipnet, ok := addr.(*net.IPNet)
+		if !ok || !ipnet.IP.IsGlobalUnicast() {
+			continue
+		}
+		if ipnet.IP.To4() != nil && set.v4 == nil {
+			set.v4 = ipnet.IP.To4()
+		} else if ipnet.IP.To4() == nil && set.v6 == nil {
+			set.v6 = ipnet.IP
+		}
+	}
+	if set.v4 == nil && set.v6 == nil {
+		return set, fmt.Errorf("%s: interface has no global unicast address", name)
+	}
+	return set, nil
+}
+
+// parseSource parses a source address set: an address, an IPv4 and an
+// IPv6 address joined with '+', or a network interface name, which
+// stands for its first IPv4 and IPv6 addresses.
+func parseSource(s string) (SourceSet, error) {
+
+	if !strings.Contains(s, "+") && net.ParseIP(s) == nil {
+		return interfaceSource(s)
+	}
+
+	set := SourceSet{name: s}
+	for _, x := range strings.Split(s, "+") {
+		ip := net.ParseIP(x)
+		if ip == nil {
+			return set, fmt.Errorf("%s: invalid source address: %s", s, x)
+		}
+		if ip.To4() != nil {
+			ip = ip.To4()
+		}
+		if err := set.add(ip); err != nil {
+			return set, err
+		}
+	}
+	return set, nil
+}
+
+// parseSources parses a comma separated list of source address sets,
+// each of which is used for a separate run.
+func parseSources(list string) ([]SourceSet, error) {
+
+	var sets []SourceSet
+
+	for _, x := range strings.Split(list, ",") {
+		if x = strings.TrimSpace(x); x == "" {
+			continue
+		}
+		set, err := parseSource(x)
+		if err != nil {
+			return nil, err
+		}
+		sets = append(sets, set)
+	}
+	if len(sets) == 0 {
+		return nil, fmt.Errorf("no source addresses given")
+	}
+	return sets, nil
+}
+
+// withSource returns the options for a run with queries bound to the
+// source address set. The run queries only the server addresses of the
+// families the set has an address for.
+func (opts Options) withSource(set SourceSet) Options {
+
+	opts.source = set.String()
+	opts.Qopts.source4 = set.v4
+	opts.Qopts.source6 = set.v6
+	if set.v6 == nil {
+		opts.V4Only = true
+	}
+	if set.v4 == nil {
+		opts.V6Only = true
+	}
+	return opts
+}
+
+// sourceFor returns the source address to bind queries to ipaddr to,
+// or nil for the default.
+func (qopts QueryOptions) sourceFor(ipaddr net.IP) net.IP {
+	if ipaddr.To4() != nil {
+		return qopts.source4
+	}
+	return qopts.source6
+}
+
+// dialer returns a dialer for the given network ("udp", "tcp" or
+// "tcp-tls") binding queries to destination to the source address for
+// its address family, or nil if there is none.
+func (qopts QueryOptions) dialer(network, destination string) *net.Dialer {
+
+	host, _, err := net.SplitHostPort(destination)
+	if err != nil {
+		return nil
+	}
+	ip := net.ParseIP(host)
+	if ip == nil {
+		return nil
+	}
+	source := qopts.sourceFor(ip)
+	if source == nil {
+		return nil
+	}
+
+	d := &net.Dialer{Timeout: qopts.timeout}
+	if network == "udp" {
+		d.LocalAddr = &net.UDPAddr{IP: source}
+	} else {
+		d.LocalAddr = &net.TCPAddr{IP: source}
+	}
+	return d
+}
+
+// sourceString returns the source address bound to queries to ipaddr,
+// or an empty string for the default.
+func (qopts QueryOptions) sourceString(ipaddr net.IP) string {
+	if source := qopts.sourceFor(ipaddr); source != nil {
+		return source.String()
+	}
+	return ""
+}
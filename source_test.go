@@ -0,0 +1,129 @@
+package main
+
+import (
+	"context"
+	"net"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+func TestParseSource(t *testing.T) {
+	tests := []struct {
+		input   string
+		v4      string
+		v6      string
+		wantErr bool
+	}{
+		{"192.0.2.10", "192.0.2.10", "<nil>", false},
+		{"2001:db8::10", "<nil>", "2001:db8::10", false},
+		{"192.0.2.10+2001:db8::10", "192.0.2.10", "2001:db8::10", false},
+		{"2001:db8::10+192.0.2.10", "192.0.2.10", "2001:db8::10", false},
+		{"192.0.2.10+192.0.2.11", "", "", true},
+		{"2001:db8::10+2001:db8::11", "", "", true},
+		{"192.0.2.10+bogus", "", "", true},
+		{"nonexistent-interface0", "", "", true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.input, func(t *testing.T) {
+			set, err := parseSource(tt.input)
+			if tt.wantErr {
+				if err == nil {
+					t.Errorf("parseSource(%q) expected error", tt.input)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("parseSource(%q) returned error: %v", tt.input, err)
+			}
+			if set.v4.String() != tt.v4 || set.v6.String() != tt.v6 {
+				t.Errorf("parseSource(%q) = %s %s, want %s %s", tt.input,
+					set.v4, set.v6, tt.v4, tt.v6)
+			}
+		})
+	}
+
+	sets, err := parseSources("192.0.2.10, 192.0.2.11+2001:db8::11")
+	if err != nil || len(sets) != 2 || sets[1].String() != "192.0.2.11+2001:db8::11" {
+		t.Errorf("parseSources() = %v, %v, want 2 sets", sets, err)
+	}
+	if _, err := parseSources(","); err == nil {
+		t.Error("parseSources() of empty list expected error")
+	}
+}
+
+func TestWithSource(t *testing.T) {
+	v4, _ := parseSource("192.0.2.10")
+	opts := Options{}.withSource(v4)
+	if !opts.V4Only || opts.V6Only || opts.source != "192.0.2.10" {
+		t.Errorf("withSource(%s) = V4Only %v V6Only %v source %q", v4,
+			opts.V4Only, opts.V6Only, opts.source)
+	}
+	if src := opts.Qopts.sourceString(net.ParseIP("198.51.100.1")); src != "192.0.2.10" {
+		t.Errorf("sourceString() for IPv4 = %q, want 192.0.2.10", src)
+	}
+	if src := opts.Qopts.sourceString(net.ParseIP("2001:db8::1")); src != "" {
+		t.Errorf("sourceString() for IPv6 = %q, want none", src)
+	}
+
+	both, _ := parseSource("192.0.2.10+2001:db8::10")
+	opts = Options{}.withSource(both)
+	if opts.V4Only || opts.V6Only {
+		t.Errorf("withSource(%s) restricted the address family", both)
+	}
+}
+
+func TestQueryDialer(t *testing.T) {
+	qopts := QueryOptions{timeout: time.Second, source4: net.ParseIP("192.0.2.10")}
+
+	if d := qopts.dialer("udp", "[2001:db8::1]:53"); d != nil {
+		t.Errorf("dialer() for IPv6 destination = %v, want nil", d)
+	}
+	d := qopts.dialer("udp", "198.51.100.1:53")
+	if addr, ok := d.LocalAddr.(*net.UDPAddr); !ok || !addr.IP.Equal(qopts.source4) {
+		t.Errorf("dialer(udp) local address = %v, want %s", d.LocalAddr, qopts.source4)
+	}
+	d = qopts.dialer("tcp-tls", "198.51.100.1:853")
+	if addr, ok := d.LocalAddr.(*net.TCPAddr); !ok || !addr.IP.Equal(qopts.source4) {
+		t.Errorf("dialer(tcp-tls) local address = %v, want %s", d.LocalAddr, qopts.source4)
+	}
+}
+
+func TestQuerySourceAddress(t *testing.T) {
+	var mu sync.Mutex
+	var remotes []string
+	handler := dns.HandlerFunc(func(w dns.ResponseWriter, r *dns.Msg) {
+		host, _, _ := net.SplitHostPort(w.RemoteAddr().String())
+		mu.Lock()
+		remotes = append(remotes, host)
+		mu.Unlock()
+		soaMockHandler(2024010100).ServeDNS(w, r)
+	})
+	server, port := newMockDNSServerSamePort(t, handler)
+	<-server.ready
+
+	for _, tcp := range []bool{false, true} {
+		qopts := QueryOptions{
+			timeout: 2 * time.Second,
+			retries: 1,
+			bufsize: defaultBufsize,
+			port:    port,
+			tcp:     tcp,
+			source4: net.ParseIP("127.0.0.2"),
+		}
+		_, err := SendQuery(context.Background(), "example.com.", dns.TypeSOA,
+			[]net.IP{net.ParseIP("127.0.0.1")}, qopts)
+		if err != nil {
+			t.Fatalf("SendQuery(tcp %v) returned error: %v", tcp, err)
+		}
+	}
+
+	mu.Lock()
+	defer mu.Unlock()
+	if len(remotes) != 2 || remotes[0] != "127.0.0.2" || remotes[1] != "127.0.0.2" {
+		t.Errorf("server saw queries from %v, want 127.0.0.2 twice", remotes)
+	}
+}
@@ -0,0 +1,273 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"math"
+	"net"
+	"sort"
+	"strings"
+	"time"
+)
+
+// ProbeStats - statistics of the repeated SOA queries (-count) sent to a
+// server address. Times are in milliseconds, and loss is a percentage.
+type ProbeStats struct {
+	Sent         int      `json:"sent"`
+	Received     int      `json:"received"`
+	Loss         float64  `json:"loss"`
+	Min          float64  `json:"min"`
+	Avg          float64  `json:"avg"`
+	Median       float64  `json:"median"`
+	P95          float64  `json:"p95"`
+	Max          float64  `json:"max"`
+	Jitter       float64  `json:"jitter"`
+	Inconsistent bool     `json:"inconsistent,omitempty"`
+	Serials      []uint32 `json:"serials,omitempty"`
+}
+
+// newProbeStats computes the statistics of sent queries, given the
+// response times and serials of the successful ones, in the order they
+// were received. Jitter is the mean difference between the response
+// times of consecutive successful queries. If more than one serial was
+// seen, the probes are flagged as inconsistent, and the serials listed.
+func newProbeStats(sent int, rtts []time.Duration, serials []uint32) *ProbeStats {
+
+	ps := &ProbeStats{Sent: sent, Received: len(rtts)}
+	if sent > 0 {
+		ps.Loss = 100 * float64(sent-len(rtts)) / float64(sent)
+	}
+	if len(rtts) == 0 {
+		return ps
+	}
+
+	var total, diffs float64
+	for i, rtt := range rtts {
+		total += MilliSeconds(rtt)
+		if i > 0 {
+			diffs += math.Abs(MilliSeconds(rtt) - MilliSeconds(rtts[i-1]))
+		}
+	}
+	ps.Avg = total / float64(len(rtts))
+	if len(rtts) > 1 {
+		ps.Jitter = diffs / float64(len(rtts)-1)
+	}
+
+	sorted := make([]time.Duration, len(rtts))
+	copy(sorted, rtts)
+	sort.Slice(sorted, func(i, j int) bool { return sorted[i] < sorted[j] })
+	n := len(sorted)
+	ps.Min = MilliSeconds(sorted[0])
+	ps.Max = MilliSeconds(sorted[n-1])
+	if n%2 == 1 {
+		ps.Median = MilliSeconds(sorted[n/2])
+	} else {
+		ps.Median = (MilliSeconds(sorted[n/2-1]) + MilliSeconds(sorted[n/2])) / 2
+	}
+	ps.P95 = MilliSeconds(sorted[int(math.Ceil(0.95*float64(n)))-1])
+
+	for _, s := range serials {
+		seen := false
+		for _, d := range ps.Serials {
+			if d == s {
+				seen = true
+				break
+			}
+		}
+		if !seen {
+			ps.Serials = append(ps.Serials, s)
+		}
+	}
+	if len(ps.Serials) > 1 {
+		ps.Inconsistent = true
+	} else {
+		ps.Serials = nil
+	}
+	return ps
+}
+
+// queryRepeated queries the server address ip opts.count times, waiting
+// opts.interval between queries, and returns the result of the most
+// recent successful query (or of the last one, if none succeeded) with
+// the statistics of all of them.
+func (rn *Runner) queryRepeated(ctx context.Context, zone string, ip net.IP, opts Options) (SerialResult, *ProbeStats, error) {
+
+	var last, latest SerialResult
+	var lastErr error
+	var ok bool
+	var rtts []time.Duration
+	var serials []uint32
+	var sent int
+
+	for i := 0; i < opts.count; i++ {
+		if i > 0 {
+			timer := time.NewTimer(opts.interval)
+			select {
+			case <-timer.C:
+			case <-ctx.Done():
+				timer.Stop()
+			}
+			if ctx.Err() != nil {
+				break
+			}
+		}
+		sent++
+		last, lastErr = getSerial(ctx, zone, ip, opts)
+		if lastErr == nil {
+			latest, ok = last, true
+			rtts = append(rtts, last.took)
+			serials = append(serials, last.serial)
+		}
+	}
+
+	stats := newProbeStats(sent, rtts, serials)
+	if ok {
+		return latest, stats, nil
+	}
+	return last, stats, lastErr
+}
+
+func printProbeStats(ps *ProbeStats, opts *Options) {
+
+	if opts.json || ps == nil {
+		return
+	}
+
+	fmt.Printf("%15s   rtt min/avg/median/p95/max/jitter %.2f/%.2f/%.2f/%.2f/%.2f/%.2fms loss %.1f%% (%d/%d)\n",
+		"", ps.Min, ps.Avg, ps.Median, ps.P95, ps.Max, ps.Jitter,
+		ps.Loss, ps.Sent-ps.Received, ps.Sent)
+	if ps.Inconsistent {
+		fmt.Printf("%15s   inconsistent serials:", "")
+		for _, s := range ps.Serials {
+			fmt.Printf(" %d", s)
+		}
+		fmt.Printf("\n")
+	}
+}
+
+// Response time threshold states
+const (
+	rttWarning  = "warning"
+	rttCritical = "critical"
+)
+
+// rttStatus returns the threshold state of a response time in
+// milliseconds: critical, warning, or an empty string if neither the
+// -rttcrit nor the -rttwarn threshold is reached.
+func (opts *Options) rttStatus(ms float64) string {
+	switch {
+	case opts.rttcrit > 0 && ms >= float64(opts.rttcrit):
+		return rttCritical
+	case opts.rttwarn > 0 && ms >= float64(opts.rttwarn):
+		return rttWarning
+	}
+	return ""
+}
+
+// rtt returns the response time of the server, in milliseconds: the
+// median of the repeated queries with -count, and otherwise the response
+// time of the single query.
+func (r *Response) rtt() float64 {
+	if r.Stats != nil && r.Stats.Received > 0 {
+		return r.Stats.Median
+	}
+	return r.Resptime
+}
+
+// medianRTT returns the median of the response times of the servers that
+// answered, or 0 if none did.
+func medianRTT(responses map[string][]Response) float64 {
+
+	var rtts []float64
+
+	for _, list := range responses {
+		for _, r := range list {
+			if r.err == nil {
+				rtts = append(rtts, r.rtt())
+			}
+		}
+	}
+	if len(rtts) == 0 {
+		return 0
+	}
+	sort.Float64s(rtts)
+	n := len(rtts)
+	if n%2 == 1 {
+		return rtts[n/2]
+	}
+	return (rtts[n/2-1] + rtts[n/2]) / 2
+}
+
+// checkResponseTimes returns the exit status for the response time
+// thresholds: 6 if any server (or the median, with -rttmedian) reached
+// the critical threshold, 5 if any reached the warning threshold, and 0
+// otherwise.
+func (rn *Runner) checkResponseTimes(opts *Options) int {
+
+	var rc int
+
+	status := func(s string) int {
+		switch s {
+		case rttCritical:
+			return 6
+		case rttWarning:
+			return 5
+		}
+		return 0
+	}
+
+	for _, list := range rn.ResponseByName {
+		for _, r := range list {
+			if r.err == nil {
+				rc = max(rc, status(r.RTTStatus))
+			}
+		}
+	}
+	if opts.rttmedian {
+		rn.output.RTTMedian = medianRTT(rn.ResponseByName)
+		rn.output.RTTMedianStatus = opts.rttStatus(rn.output.RTTMedian)
+		rc = max(rc, status(rn.output.RTTMedianStatus))
+		if !opts.json {
+			fmt.Printf("## median response time %.2fms", rn.output.RTTMedian)
+			if rn.output.RTTMedianStatus != "" {
+				fmt.Printf(" [RTT %s]", strings.ToUpper(rn.output.RTTMedianStatus))
+			}
+			fmt.Printf("\n")
+		}
+	}
+	return rc
+}
+
+// severity returns the overall severity of an exit status: ok, warning
+// for response time warnings, or critical for anything else.
+func severity(status int) string {
+	switch status {
+	case 0:
+		return "ok"
+	case 5:
+		return rttWarning
+	}
+	return rttCritical
+}
+
+// moreSevere returns the more severe of two exit statuses: any critical
+// status outranks the warning status 5, which outranks 0. Of two
+// critical statuses, the higher one is returned.
+func moreSevere(a, b int) int {
+	rank := func(status int) int {
+		switch severity(status) {
+		case "ok":
+			return 0
+		case rttWarning:
+			return 1
+		}
+		return 2
+	}
+	if rank(a) != rank(b) {
+		if rank(a) > rank(b) {
+			return a
+		}
+		return b
+	}
+	return max(a, b)
+}
@@ -0,0 +1,245 @@
+package main
+
+import (
+	"context"
+	"net"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+func TestNewProbeStats(t *testing.T) {
+	ms := func(n int) time.Duration { return time.Duration(n) * time.Millisecond }
+
+	tests := []struct {
+		name    string
+		sent    int
+		rtts    []time.Duration
+		serials []uint32
+		want    ProbeStats
+	}{
+		{
+			name: "all lost",
+			sent: 3,
+			want: ProbeStats{Sent: 3, Loss: 100},
+		},
+		{
+			name:    "single answer",
+			sent:    1,
+			rtts:    []time.Duration{ms(10)},
+			serials: []uint32{5},
+			want:    ProbeStats{Sent: 1, Received: 1, Min: 10, Avg: 10, Median: 10, P95: 10, Max: 10},
+		},
+		{
+			name:    "odd count with loss",
+			sent:    4,
+			rtts:    []time.Duration{ms(10), ms(30), ms(20)},
+			serials: []uint32{5, 5, 5},
+			want: ProbeStats{Sent: 4, Received: 3, Loss: 25,
+				Min: 10, Avg: 20, Median: 20, P95: 30, Max: 30, Jitter: 15},
+		},
+		{
+			name:    "even count and inconsistent serials",
+			sent:    4,
+			rtts:    []time.Duration{ms(10), ms(20), ms(30), ms(40)},
+			serials: []uint32{5, 6, 5, 6},
+			want: ProbeStats{Sent: 4, Received: 4,
+				Min: 10, Avg: 25, Median: 25, P95: 40, Max: 40, Jitter: 10,
+				Inconsistent: true, Serials: []uint32{5, 6}},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := newProbeStats(tt.sent, tt.rtts, tt.serials)
+			if got.Sent != tt.want.Sent || got.Received != tt.want.Received ||
+				got.Loss != tt.want.Loss || got.Min != tt.want.Min ||
+				got.Avg != tt.want.Avg || got.Median != tt.want.Median ||
+				got.P95 != tt.want.P95 || got.Max != tt.want.Max ||
+				got.Jitter != tt.want.Jitter || got.Inconsistent != tt.want.Inconsistent {
+				t.Errorf("newProbeStats() = %+v, want %+v", *got, tt.want)
+			}
+			if len(got.Serials) != len(tt.want.Serials) {
+				t.Errorf("newProbeStats() serials = %v, want %v", got.Serials, tt.want.Serials)
+			}
+		})
+	}
+}
+
+// flakyHandler answers SOA queries with serials that increase by one
+// with each query, and drops every third query.
+func flakyHandler() dns.Handler {
+	var queries atomic.Int32
+	return dns.HandlerFunc(func(w dns.ResponseWriter, r *dns.Msg) {
+		n := queries.Add(1)
+		if n%3 == 0 {
+			return
+		}
+		m := new(dns.Msg)
+		m.SetReply(r)
+		m.Authoritative = true
+		m.Answer = []dns.RR{
+			&dns.SOA{
+				Hdr: dns.RR_Header{
+					Name:   r.Question[0].Name,
+					Rrtype: dns.TypeSOA,
+					Class:  dns.ClassINET,
+					Ttl:    3600,
+				},
+				Ns:     "ns1.example.com.",
+				Mbox:   "admin.example.com.",
+				Serial: uint32(100 + n),
+			},
+		}
+		w.WriteMsg(m)
+	})
+}
+
+func TestQueryRepeated(t *testing.T) {
+	server := newMockDNSServer(t, flakyHandler())
+	defer server.close()
+	host, port, _ := net.SplitHostPort(server.udpAddr)
+
+	opts := Options{
+		count:    5,
+		interval: 10 * time.Millisecond,
+		Qopts: QueryOptions{
+			timeout: 200 * time.Millisecond,
+			retries: 1,
+			bufsize: defaultBufsize,
+			port:    port,
+		},
+	}
+	result, stats, err := NewRunner().queryRepeated(context.Background(), "example.com.",
+		net.ParseIP(host), opts)
+	if err != nil {
+		t.Fatalf("queryRepeated() unexpected error: %v", err)
+	}
+	// queries 1, 2, 4 and 5 are answered
+	if result.serial != 105 {
+		t.Errorf("queryRepeated() serial = %d, want 105", result.serial)
+	}
+	if stats.Sent != 5 || stats.Received != 4 || stats.Loss != 20 {
+		t.Errorf("queryRepeated() sent %d received %d loss %v, want 5/4/20",
+			stats.Sent, stats.Received, stats.Loss)
+	}
+	if !stats.Inconsistent || len(stats.Serials) != 4 {
+		t.Errorf("queryRepeated() inconsistent %v serials %v, want 4 serials",
+			stats.Inconsistent, stats.Serials)
+	}
+}
+
+func TestRTTStatus(t *testing.T) {
+	opts := &Options{rttwarn: 100, rttcrit: 500}
+	tests := []struct {
+		ms   float64
+		want string
+	}{
+		{10, ""},
+		{100, rttWarning},
+		{499.9, rttWarning},
+		{500, rttCritical},
+	}
+	for _, tt := range tests {
+		if got := opts.rttStatus(tt.ms); got != tt.want {
+			t.Errorf("rttStatus(%v) = %q, want %q", tt.ms, got, tt.want)
+		}
+	}
+	if got := (&Options{}).rttStatus(10000); got != "" {
+		t.Errorf("rttStatus() without thresholds = %q, want none", got)
+	}
+}
+
+func TestMedianRTT(t *testing.T) {
+	responses := map[string][]Response{
+		"ns1.example.com.": {{Resptime: 10}, {Resptime: 40}},
+		"ns2.example.com.": {{Resptime: 20}, {Resptime: 9999, err: errTimeout}},
+		"ns3.example.com.": {{Resptime: 1, Stats: &ProbeStats{Received: 3, Median: 30}}},
+	}
+	if got := medianRTT(responses); got != 25 {
+		t.Errorf("medianRTT() = %v, want 25", got)
+	}
+	if got := medianRTT(nil); got != 0 {
+		t.Errorf("medianRTT(nil) = %v, want 0", got)
+	}
+}
+
+func TestRunResponseTimeThresholds(t *testing.T) {
+	handler := dns.HandlerFunc(func(w dns.ResponseWriter, r *dns.Msg) {
+		time.Sleep(50 * time.Millisecond)
+		classHandler(dns.RcodeSuccess, true, true, false).ServeDNS(w, r)
+	})
+	server := newMockDNSServer(t, handler)
+	defer server.close()
+	host, port, _ := net.SplitHostPort(server.udpAddr)
+
+	tests := []struct {
+		name      string
+		rttwarn   int
+		rttcrit   int
+		rttmedian bool
+		want      int
+	}{
+		{"no thresholds", 0, 0, false, 0},
+		{"below thresholds", 2000, 3000, false, 0},
+		{"warning", 20, 2000, false, 5},
+		{"critical", 10, 20, false, 6},
+		{"median", 20, 0, true, 5},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			rn := NewRunner()
+			opts := Options{
+				noqueryns:  true,
+				additional: host,
+				json:       true,
+				rttwarn:    tt.rttwarn,
+				rttcrit:    tt.rttcrit,
+				rttmedian:  tt.rttmedian,
+				Qopts: QueryOptions{
+					timeout: 2 * time.Second,
+					retries: 1,
+					bufsize: defaultBufsize,
+					port:    port,
+				},
+			}
+			status, _ := rn.run(context.Background(), "example.com.", opts)
+			if status != tt.want {
+				t.Errorf("run() status = %d, want %d", status, tt.want)
+			}
+			if tt.rttmedian && rn.output.RTTMedianStatus != rttWarning {
+				t.Errorf("rtt_median_status = %q, want warning", rn.output.RTTMedianStatus)
+			}
+		})
+	}
+}
+
+func TestSeverity(t *testing.T) {
+	for status, want := range map[int]string{0: "ok", 1: "critical", 2: "critical", 5: "warning", 6: "critical"} {
+		if got := severity(status); got != want {
+			t.Errorf("severity(%d) = %q, want %q", status, got, want)
+		}
+	}
+}
+
+func TestMoreSevere(t *testing.T) {
+	tests := []struct {
+		a, b, want int
+	}{
+		{0, 0, 0},
+		{0, 5, 5},
+		{5, 1, 1},
+		{4, 5, 4},
+		{5, 8, 8},
+		{2, 3, 3},
+		{7, 0, 7},
+	}
+	for _, tt := range tests {
+		if got := moreSevere(tt.a, tt.b); got != tt.want {
+			t.Errorf("moreSevere(%d, %d) = %d, want %d", tt.a, tt.b, got, tt.want)
+		}
+	}
+}
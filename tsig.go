@@ -0,0 +1,97 @@
+package main
+
+import (
+	"encoding/base64"
+	"fmt"
+	"strings"
+
+	"github.com/miekg/dns"
+)
+
+// TSIG algorithms, by the names accepted for keys
+var tsigAlgorithms = map[string]string{
+	"hmac-sha1":   dns.HmacSHA1,
+	"hmac-sha224": dns.HmacSHA224,
+	"hmac-sha256": dns.HmacSHA256,
+	"hmac-sha384": dns.HmacSHA384,
+	"hmac-sha512": dns.HmacSHA512,
+}
+
+// defaultTSIGAlgorithm is used for keys given without an algorithm
+const defaultTSIGAlgorithm = "hmac-sha256"
+
+// tsigFudge is the allowed time difference for TSIG signatures, in seconds
+const tsigFudge = 300
+
+// TSIGKey - a TSIG key (RFC 8945) to sign the SOA queries with
+type TSIGKey struct {
+	name      string
+	algorithm string
+	secret    string
+}
+
+// parseTSIGKey parses a TSIG key given as [algorithm:]name:secret, with
+// a base64 encoded secret, as in dig -y.
+func parseTSIGKey(s string) (*TSIGKey, error) {
+
+	var alg string
+
+	parts := strings.Split(s, ":")
+	switch len(parts) {
+	case 2:
+		alg = defaultTSIGAlgorithm
+	case 3:
+		alg = strings.ToLower(parts[0])
+		parts = parts[1:]
+	default:
+		return nil, fmt.Errorf("TSIG key must be [algorithm:]name:secret")
+	}
+	return newTSIGKey(alg, parts[0], parts[1])
+}
+
+// newTSIGKey validates the parts of a TSIG key and returns the key
+func newTSIGKey(alg, name, secret string) (*TSIGKey, error) {
+
+	algorithm, ok := tsigAlgorithms[strings.TrimSuffix(strings.ToLower(alg), ".")]
+	if !ok {
+		return nil, fmt.Errorf("unsupported TSIG algorithm: %s", alg)
+	}
+	if name == "" {
+		return nil, fmt.Errorf("empty TSIG key name")
+	}
+	if _, err := base64.StdEncoding.DecodeString(secret); err != nil || secret == "" {
+		return nil, fmt.Errorf("invalid TSIG secret for key %s: must be base64", name)
+	}
+	return &TSIGKey{
+		name:      dns.CanonicalName(name),
+		algorithm: algorithm,
+		secret:    secret,
+	}, nil
+}
+
+// secrets returns the key in the form used by the DNS client and
+// connection, or nil if there is no key.
+func (k *TSIGKey) secrets() map[string]string {
+	if k == nil {
+		return nil
+	}
+	return map[string]string{k.name: k.secret}
+}
+
+// checkTSIG returns an error if a query signed with TSIG got a response
+// that isn't signed, or that carries a TSIG error; the signature itself
+// is verified by the DNS client. Otherwise it returns err.
+func checkTSIG(response *dns.Msg, qopts QueryOptions, err error) error {
+
+	if err != nil || qopts.tsig == nil || response == nil {
+		return err
+	}
+	t := response.IsTsig()
+	if t == nil {
+		return newQueryError(errTSIG, fmt.Errorf("response is not TSIG signed"))
+	}
+	if t.Error != dns.RcodeSuccess {
+		return newQueryError(errTSIG, fmt.Errorf("TSIG error: %s", dns.RcodeToString[int(t.Error)]))
+	}
+	return nil
+}
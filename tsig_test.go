@@ -0,0 +1,123 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+func TestParseTSIGKey(t *testing.T) {
+	tests := []struct {
+		input   string
+		name    string
+		alg     string
+		wantErr bool
+	}{
+		{"mykey:c2VjcmV0", "mykey.", dns.HmacSHA256, false},
+		{"hmac-sha512:MyKey.:c2VjcmV0", "mykey.", dns.HmacSHA512, false},
+		{"HMAC-SHA1:mykey:c2VjcmV0", "mykey.", dns.HmacSHA1, false},
+		{"hmac-md5:mykey:c2VjcmV0", "", "", true},
+		{"mykey:not base64!", "", "", true},
+		{"mykey:", "", "", true},
+		{"mykey", "", "", true},
+		{"a:b:c:d", "", "", true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.input, func(t *testing.T) {
+			key, err := parseTSIGKey(tt.input)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("parseTSIGKey(%q) error = %v, wantErr %v", tt.input, err, tt.wantErr)
+			}
+			if !tt.wantErr && (key.name != tt.name || key.algorithm != tt.alg) {
+				t.Errorf("parseTSIGKey(%q) = %+v, want name %s alg %s", tt.input, key, tt.name, tt.alg)
+			}
+		})
+	}
+}
+
+// newTSIGServer starts a mock server that knows the TSIG key, and
+// answers SOA queries, signing its responses to signed queries. If sign
+// is false, it doesn't sign its responses.
+func newTSIGServer(t *testing.T, key *TSIGKey, sign bool) string {
+	ready := make(chan struct{})
+	handler := dns.HandlerFunc(func(w dns.ResponseWriter, r *dns.Msg) {
+		m := new(dns.Msg)
+		m.SetReply(r)
+		m.Authoritative = true
+		m.Answer = []dns.RR{
+			&dns.SOA{
+				Hdr:    dns.RR_Header{Name: r.Question[0].Name, Rrtype: dns.TypeSOA, Class: dns.ClassINET},
+				Ns:     "ns1.example.com.",
+				Mbox:   "admin.example.com.",
+				Serial: 2024010100,
+			},
+		}
+		if sign && r.IsTsig() != nil && w.TsigStatus() == nil {
+			tsig := r.IsTsig()
+			m.SetTsig(tsig.Hdr.Name, tsig.Algorithm, tsigFudge, time.Now().Unix())
+		}
+		w.WriteMsg(m)
+	})
+	server := &dns.Server{
+		Addr:              "127.0.0.1:0",
+		Net:               "udp",
+		Handler:           handler,
+		TsigSecret:        key.secrets(),
+		NotifyStartedFunc: func() { close(ready) },
+	}
+	go server.ListenAndServe()
+	<-ready
+	t.Cleanup(func() { server.Shutdown() })
+	_, port, _ := net.SplitHostPort(server.PacketConn.LocalAddr().String())
+	return port
+}
+
+func TestTSIGQuery(t *testing.T) {
+	key, _ := parseTSIGKey("hmac-sha256:xfr-key:c2VjcmV0LXNlY3JldC1zZWNyZXQ=")
+	wrongKey, _ := parseTSIGKey("hmac-sha256:xfr-key:b3RoZXItc2VjcmV0")
+
+	tests := []struct {
+		name    string
+		client  *TSIGKey
+		sign    bool
+		wantErr bool
+	}{
+		{"unsigned query", nil, true, false},
+		{"signed query and response", key, true, false},
+		{"unsigned response", key, false, true},
+		{"wrong secret", wrongKey, true, true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			port := newTSIGServer(t, key, tt.sign)
+			opts := Options{
+				Qopts: QueryOptions{
+					timeout: 2 * time.Second,
+					retries: 1,
+					bufsize: defaultBufsize,
+					port:    port,
+					tsig:    tt.client,
+				},
+			}
+			result, err := getSerial(context.Background(), "example.com.", net.ParseIP("127.0.0.1"), opts)
+			if tt.wantErr {
+				if !errors.Is(err, errTSIG) {
+					t.Errorf("getSerial() error = %v, want tsig-failure", err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("getSerial() unexpected error: %v", err)
+			}
+			if result.serial != 2024010100 {
+				t.Errorf("getSerial() serial = %d, want 2024010100", result.serial)
+			}
+		})
+	}
+}
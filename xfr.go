@@ -0,0 +1,292 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"crypto/tls"
+	"encoding/hex"
+	"fmt"
+	"net"
+	"slices"
+	"sort"
+	"strings"
+
+	"github.com/miekg/dns"
+)
+
+// ZoneTransfer - the outcome of a zone transfer from a server: the
+// serial transferred, the number of distinct records, and the SHA-256
+// digest of the zone contents in canonical form, or the error
+type ZoneTransfer struct {
+	Serial   uint32   `json:"serial,omitempty"`
+	Records  int      `json:"records,omitempty"`
+	Digest   string   `json:"digest,omitempty"`
+	Err      string   `json:"error,omitempty"`
+	Mismatch bool     `json:"content_mismatch,omitempty"`
+	Diff     []string `json:"diff,omitempty"`
+	rrsets   map[string][]string
+}
+
+// transferZone transfers zone from the server address ip with AXFR over
+// TCP (or TLS with -tls), signed with the TSIG key if one is given, and
+// returns the records.
+func transferZone(ctx context.Context, zone string, ip net.IP, qopts QueryOptions) ([]dns.RR, error) {
+
+	destination, err := getDestination(ip, qopts)
+	if err != nil {
+		return nil, err
+	}
+	d := qopts.dialer("tcp", destination)
+	if d == nil {
+		d = &net.Dialer{Timeout: qopts.timeout}
+	}
+	conn, err := d.DialContext(ctx, "tcp", destination)
+	if err != nil {
+		return nil, err
+	}
+	if qopts.tls {
+		conn = tls.Client(conn, &tls.Config{InsecureSkipVerify: true})
+	}
+	stop := context.AfterFunc(ctx, func() { conn.Close() })
+	defer stop()
+
+	t := &dns.Transfer{
+		Conn:         &dns.Conn{Conn: conn},
+		ReadTimeout:  qopts.timeout,
+		WriteTimeout: qopts.timeout,
+		TsigSecret:   qopts.tsig.secrets(),
+	}
+	qopts.nsid = false
+	qopts.cookie = ""
+	env, err := t.In(MakeQuery(zone, dns.TypeAXFR, qopts), destination)
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+
+	var records []dns.RR
+	for e := range env {
+		if e.Error != nil {
+			err = e.Error
+			continue
+		}
+		records = append(records, e.RR...)
+	}
+	if err == nil && ctx.Err() != nil {
+		err = cancelledError(ctx)
+	}
+	return records, err
+}
+
+// canonicalRR returns a copy of rr with its owner name, and the domain
+// names in the rdata of the types that RFC 4034 (Section 6.2) lists, in
+// lower case.
+func canonicalRR(rr dns.RR) dns.RR {
+
+	rr = dns.Copy(rr)
+	rr.Header().Name = dns.CanonicalName(rr.Header().Name)
+	switch r := rr.(type) {
+	case *dns.NS:
+		r.Ns = dns.CanonicalName(r.Ns)
+	case *dns.CNAME:
+		r.Target = dns.CanonicalName(r.Target)
+	case *dns.DNAME:
+		r.Target = dns.CanonicalName(r.Target)
+	case *dns.PTR:
+		r.Ptr = dns.CanonicalName(r.Ptr)
+	case *dns.MX:
+		r.Mx = dns.CanonicalName(r.Mx)
+	case *dns.SRV:
+		r.Target = dns.CanonicalName(r.Target)
+	case *dns.SOA:
+		r.Ns = dns.CanonicalName(r.Ns)
+		r.Mbox = dns.CanonicalName(r.Mbox)
+	case *dns.RRSIG:
+		r.SignerName = dns.CanonicalName(r.SignerName)
+	}
+	return rr
+}
+
+// newZoneTransfer digests the records of a zone transfer: the distinct
+// records, in canonical wire form (without name compression) and sorted,
+// are hashed in turn, as ZONEMD (RFC 8976) does, but with all records,
+// TTLs included, so that any difference in the zone data shows.
+func newZoneTransfer(records []dns.RR) (*ZoneTransfer, error) {
+
+	zt := &ZoneTransfer{rrsets: make(map[string][]string)}
+	var wire [][]byte
+
+	for _, rr := range records {
+		if soa, ok := rr.(*dns.SOA); ok && zt.Serial == 0 {
+			zt.Serial = soa.Serial
+		}
+		rr = canonicalRR(rr)
+		buf := make([]byte, dns.Len(rr))
+		n, err := dns.PackRR(rr, buf, 0, nil, false)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %s", rr.String(), err.Error())
+		}
+		wire = append(wire, buf[:n])
+	}
+	sort.Slice(wire, func(i, j int) bool { return bytes.Compare(wire[i], wire[j]) < 0 })
+
+	h := sha256.New()
+	for i, w := range wire {
+		if i > 0 && bytes.Equal(w, wire[i-1]) {
+			continue // the closing SOA record, and any other duplicates
+		}
+		h.Write(w)
+		zt.Records++
+
+		rr, _, err := dns.UnpackRR(w, 0)
+		if err != nil {
+			return nil, err
+		}
+		key := rr.Header().Name + " " + dns.TypeToString[rr.Header().Rrtype]
+		zt.rrsets[key] = append(zt.rrsets[key], rr.String())
+	}
+	zt.Digest = hex.EncodeToString(h.Sum(nil))
+	return zt, nil
+}
+
+// checkTransfer transfers zone from the server address ip, once the per
+// destination limits allow it, and digests its contents.
+func (rn *Runner) checkTransfer(ctx context.Context, zone string, ip net.IP, qopts QueryOptions) *ZoneTransfer {
+
+	if err := qopts.limiter.Acquire(ctx, ip); err != nil {
+		return &ZoneTransfer{Err: cancelledError(ctx).Error()}
+	}
+	records, err := transferZone(ctx, zone, ip, qopts)
+	qopts.limiter.Release(ip)
+	if err != nil {
+		return &ZoneTransfer{Err: err.Error()}
+	}
+	zt, err := newZoneTransfer(records)
+	if err != nil {
+		return &ZoneTransfer{Err: err.Error()}
+	}
+	return zt
+}
+
+// diffTransfers returns the RRsets that differ between the zone
+// transfers zt and ref: "+name type" for an RRset only in zt, "-name
+// type" for one only in ref, and "~name type" for one in both, with
+// different records.
+func diffTransfers(zt, ref *ZoneTransfer) []string {
+
+	var diff []string
+
+	keys := make([]string, 0, len(zt.rrsets)+len(ref.rrsets))
+	for k := range zt.rrsets {
+		keys = append(keys, k)
+	}
+	for k := range ref.rrsets {
+		if _, ok := zt.rrsets[k]; !ok {
+			keys = append(keys, k)
+		}
+	}
+	sort.Strings(keys)
+
+	for _, k := range keys {
+		a, inZT := zt.rrsets[k]
+		b, inRef := ref.rrsets[k]
+		switch {
+		case !inRef:
+			diff = append(diff, "+"+k)
+		case !inZT:
+			diff = append(diff, "-"+k)
+		case !slices.Equal(a, b):
+			diff = append(diff, "~"+k)
+		}
+	}
+	return diff
+}
+
+// compareTransfers compares the zone transfers from the servers with
+// those of the same serial: with the master's, if it has that serial,
+// or else with the digest most servers returned. Servers whose contents
+// differ are flagged, with the RRsets that differ if diff is set. It
+// returns whether any server was flagged.
+func (rn *Runner) compareTransfers(diff bool) bool {
+
+	var master *ZoneTransfer
+	if rn.output.Master != nil && rn.output.Master.Transfer != nil &&
+		rn.output.Master.Transfer.Err == "" {
+		master = rn.output.Master.Transfer
+	}
+
+	nsnames := make([]string, 0, len(rn.ResponseByName))
+	for k := range rn.ResponseByName {
+		nsnames = append(nsnames, k)
+	}
+	sort.Sort(ByCanonicalOrder(nsnames))
+
+	bySerial := make(map[uint32][]*ZoneTransfer)
+	for _, nsname := range nsnames {
+		responses := rn.ResponseByName[nsname]
+		sort.Sort(ByIPversion(responses))
+		for _, r := range responses {
+			if r.Transfer != nil && r.Transfer.Err == "" {
+				bySerial[r.Transfer.Serial] = append(bySerial[r.Transfer.Serial], r.Transfer)
+			}
+		}
+	}
+
+	mismatch := false
+	for serial, transfers := range bySerial {
+		ref := master
+		if ref == nil || ref.Serial != serial {
+			ref = commonTransfer(transfers)
+		}
+		for _, zt := range transfers {
+			if zt.Digest == ref.Digest {
+				continue
+			}
+			zt.Mismatch = true
+			mismatch = true
+			if diff {
+				zt.Diff = diffTransfers(zt, ref)
+			}
+		}
+	}
+	return mismatch
+}
+
+// commonTransfer returns the first of the transfers with the digest
+// that most of them have.
+func commonTransfer(transfers []*ZoneTransfer) *ZoneTransfer {
+	count := make(map[string]int)
+	best := transfers[0]
+	for _, zt := range transfers {
+		count[zt.Digest]++
+		if count[zt.Digest] > count[best.Digest] {
+			best = zt
+		}
+	}
+	return best
+}
+
+// note returns a note on the zone contents for the text output, or an
+// empty string if they match.
+func (zt *ZoneTransfer) note() string {
+	if zt == nil || !zt.Mismatch {
+		return ""
+	}
+	return "[zone content differs]"
+}
+
+func printTransfer(zt *ZoneTransfer, opts *Options) {
+
+	if opts.json || zt == nil {
+		return
+	}
+	if zt.Err != "" {
+		fmt.Printf("%15s   xfr error: %s\n", "", zt.Err)
+		return
+	}
+	fmt.Printf("%15d   xfr: %d records sha256 %s\n", zt.Serial, zt.Records, zt.Digest[:16])
+	if zt.Diff != nil {
+		fmt.Printf("%15s   xfr diff: %s\n", "", strings.Join(zt.Diff, " "))
+	}
+}
@@ -0,0 +1,188 @@
+package main
+
+import (
+	"context"
+	"net"
+	"slices"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+// xfrRecords returns the records of example.com. with the given serial
+// and address of www.example.com., in transfer order.
+func xfrRecords(t *testing.T, serial uint32, www string) []dns.RR {
+	var records []dns.RR
+	for _, s := range []string{
+		"example.com. 3600 IN SOA ns1.example.com. admin.example.com. 1 7200 3600 1209600 300",
+		"example.com. 3600 IN NS ns1.example.com.",
+		"example.com. 3600 IN NS ns2.example.com.",
+		"www.example.com. 300 IN A " + www,
+		"example.com. 3600 IN SOA ns1.example.com. admin.example.com. 1 7200 3600 1209600 300",
+	} {
+		rr, err := dns.NewRR(s)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if soa, ok := rr.(*dns.SOA); ok {
+			soa.Serial = serial
+		}
+		records = append(records, rr)
+	}
+	return records
+}
+
+// xfrHandler answers SOA queries with the serial of records and, if
+// allowed, AXFR queries with the records, refusing them otherwise.
+func xfrHandler(records []dns.RR, allowed bool) dns.Handler {
+	return dns.HandlerFunc(func(w dns.ResponseWriter, r *dns.Msg) {
+		m := new(dns.Msg)
+		m.SetReply(r)
+		switch {
+		case r.Question[0].Qtype == dns.TypeSOA:
+			m.Answer = records[:1]
+		case r.Question[0].Qtype == dns.TypeAXFR && allowed:
+			m.Answer = records
+		default:
+			m.Rcode = dns.RcodeRefused
+		}
+		w.WriteMsg(m)
+	})
+}
+
+// newXFRServers starts mock DNS servers on 127.0.0.1 and 127.0.0.2 on
+// the same port, answering with the given handlers, and returns the port.
+func newXFRServers(t *testing.T, h1, h2 dns.Handler) string {
+	s1 := newMockDNSServerAt(t, h1, "127.0.0.1:0", "127.0.0.1:0")
+	_, port, _ := net.SplitHostPort(s1.tcpAddr)
+	s1.close()
+	s1 = newMockDNSServerAt(t, h1, "127.0.0.1:"+port, "127.0.0.1:"+port)
+	t.Cleanup(s1.close)
+	s2 := newMockDNSServerAt(t, h2, "127.0.0.2:"+port, "127.0.0.2:"+port)
+	t.Cleanup(s2.close)
+	return port
+}
+
+func TestNewZoneTransfer(t *testing.T) {
+	base, err := newZoneTransfer(xfrRecords(t, 10, "192.0.2.80"))
+	if err != nil {
+		t.Fatalf("newZoneTransfer() unexpected error: %v", err)
+	}
+	if base.Serial != 10 || base.Records != 4 || len(base.Digest) != 64 {
+		t.Errorf("newZoneTransfer() = serial %d, %d records, digest %q", base.Serial, base.Records, base.Digest)
+	}
+
+	// Order and case don't matter
+	records := xfrRecords(t, 10, "192.0.2.80")
+	slices.Reverse(records)
+	records[1].Header().Name = "WWW.Example.COM."
+	records[2].(*dns.NS).Ns = "NS2.example.com."
+	same, _ := newZoneTransfer(records)
+	if same.Digest != base.Digest {
+		t.Errorf("digest differs for reordered records with different case")
+	}
+
+	// TTLs and data do
+	records = xfrRecords(t, 10, "192.0.2.80")
+	records[3].Header().Ttl = 600
+	if zt, _ := newZoneTransfer(records); zt.Digest == base.Digest {
+		t.Errorf("digest is the same for records with different TTLs")
+	}
+	if zt, _ := newZoneTransfer(xfrRecords(t, 10, "192.0.2.81")); zt.Digest == base.Digest {
+		t.Errorf("digest is the same for records with different data")
+	}
+}
+
+func TestDiffTransfers(t *testing.T) {
+	ref, _ := newZoneTransfer(xfrRecords(t, 10, "192.0.2.80"))
+
+	records := xfrRecords(t, 10, "192.0.2.81")
+	mail, _ := dns.NewRR("mail.example.com. 300 IN A 192.0.2.25")
+	records = append(records[:2], records[3:]...) // without ns2
+	records = append(records, mail)
+	zt, _ := newZoneTransfer(records)
+
+	want := []string{"~example.com. NS", "+mail.example.com. A", "~www.example.com. A"}
+	if diff := diffTransfers(zt, ref); !slices.Equal(diff, want) {
+		t.Errorf("diffTransfers() = %v, want %v", diff, want)
+	}
+	if diff := diffTransfers(ref, ref); diff != nil {
+		t.Errorf("diffTransfers() of the same zone = %v, want none", diff)
+	}
+}
+
+func TestRunTransfers(t *testing.T) {
+	tests := []struct {
+		name     string
+		www2     string
+		allowed2 bool
+		master   bool
+		status   int
+		flagged  string
+		diff     []string
+	}{
+		{"same contents", "192.0.2.80", true, false, 0, "", nil},
+		{"contents differ", "192.0.2.81", true, false, 1, "127.0.0.2",
+			[]string{"~www.example.com. A"}},
+		{"contents differ from master", "192.0.2.81", true, true, 1, "127.0.0.1",
+			[]string{"~www.example.com. A"}},
+		{"transfer refused", "192.0.2.81", false, false, 0, "", nil},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			port := newXFRServers(t,
+				xfrHandler(xfrRecords(t, 10, "192.0.2.80"), true),
+				xfrHandler(xfrRecords(t, 10, tt.www2), tt.allowed2))
+
+			rn := NewRunner()
+			opts := Options{
+				noqueryns:  true,
+				additional: "127.0.0.1,127.0.0.2",
+				json:       true,
+				xfr:        true,
+				xfrdiff:    true,
+				Qopts: QueryOptions{
+					timeout: 2 * time.Second,
+					retries: 1,
+					bufsize: defaultBufsize,
+					port:    port,
+				},
+			}
+			if tt.master {
+				opts.additional = "127.0.0.1"
+				opts.masterIP = net.ParseIP("127.0.0.2")
+			}
+			status, message := rn.run(context.Background(), "example.com.", opts)
+			if status != tt.status {
+				t.Errorf("run() status = %d, want %d; message = %q", status, tt.status, message)
+			}
+
+			for _, r := range rn.output.Responses {
+				zt := r.Transfer
+				if zt == nil {
+					t.Fatalf("response from %s has no transfer", r.Nsip)
+				}
+				if r.Nsip == "127.0.0.2" && !tt.allowed2 {
+					if zt.Err == "" {
+						t.Errorf("transfer from %s = %+v, want an error", r.Nsip, zt)
+					}
+					continue
+				}
+				if zt.Err != "" || zt.Serial != 10 || zt.Records != 4 {
+					t.Errorf("transfer from %s = %+v", r.Nsip, zt)
+				}
+				if zt.Mismatch != (r.Nsip == tt.flagged) {
+					t.Errorf("transfer from %s mismatch = %v", r.Nsip, zt.Mismatch)
+				}
+				if r.Nsip == tt.flagged && !slices.Equal(zt.Diff, tt.diff) {
+					t.Errorf("transfer from %s diff = %v, want %v", r.Nsip, zt.Diff, tt.diff)
+				}
+			}
+			if tt.master && (rn.output.Master.Transfer == nil || rn.output.Master.Transfer.Err != "") {
+				t.Errorf("master transfer = %+v", rn.output.Master.Transfer)
+			}
+		})
+	}
+}